@@ -2,10 +2,15 @@ module file-server-go
 
 go 1.21.5
 
-require github.com/rs/zerolog v1.31.0
+require (
+	github.com/rs/zerolog v1.31.0
+	golang.org/x/net v0.20.0
+	golang.org/x/time v0.5.0
+)
 
 require (
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/sys v0.12.0 // indirect
+	golang.org/x/sys v0.16.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
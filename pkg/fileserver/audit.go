@@ -0,0 +1,176 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// auditEvent is a line of the audit log, one per upload,
+// download and delete request whatever its outcome
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"clientIP"`
+	Principal string    `json:"principal,omitempty"`
+	Action    string    `json:"action"`
+	FileName  string    `json:"fileName"`
+	Bytes     int64     `json:"bytes"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"`
+}
+
+// auditContextKey is the request context key of the
+// audit event being recorded
+type auditContextKey struct{}
+
+// auditLogger appends audit events to the audit log as
+// JSON lines, apart from the server log so neither its
+// level nor its verbosity affect the trail
+type auditLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newAuditLogger opens the audit log at path for
+// appending, "-" writes the events to stderr along with
+// the server log
+func newAuditLogger(path string) (*auditLogger, error) {
+	if path == "-" {
+		return &auditLogger{w: os.Stderr}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{w: f}, nil
+}
+
+// record appends the event to the audit log
+func (a *auditLogger) record(event *auditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode audit event")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Error().Err(err).Msg("Unable to write audit event")
+	}
+}
+
+// close closes the audit log, unless it is stderr
+func (a *auditLogger) close() error {
+	if f, ok := a.w.(*os.File); ok && f != os.Stderr {
+		return f.Close()
+	}
+	return nil
+}
+
+// setAuditPrincipal records the subject of the request's
+// token in its audit event, if it has one
+func setAuditPrincipal(r *http.Request, principal string) {
+	if event, ok := r.Context().Value(auditContextKey{}).(*auditEvent); ok {
+		event.Principal = principal
+	}
+}
+
+// auditWriter records the status and body size of an
+// audited response
+type auditWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Unwrap returns the ResponseWriter, for
+// http.ResponseController
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// auditReader counts the bytes read of an audited request
+// body
+type auditReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// audited wraps the handler of the action (e.g. upload,
+// download, delete or swap) so every request to it is recorded
+// in the audit log once served, including the ones
+// rejected (e.g. by auth) or failing. It wraps requireScope,
+// which fills in the principal
+func (s *FileService) audited(action, prefix string, h http.Handler) http.Handler {
+	if s.audit == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := &auditEvent{
+			Time:     time.Now().UTC(),
+			ClientIP: s.clientIP(r),
+			Action:   action,
+			FileName: requestFileName(r, prefix),
+		}
+		body := &auditReader{ReadCloser: r.Body}
+		r.Body = body
+		aw := &auditWriter{ResponseWriter: w}
+		h.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, event)))
+
+		// Uploads point at the name the file was stored
+		// under, which can differ from the one asked for
+		if location, found := strings.CutPrefix(aw.Header().Get("Location"), "/download/"); found {
+			if name, err := url.PathUnescape(location); err == nil {
+				event.FileName = name
+			}
+		}
+		event.Status = aw.status
+		if event.Status == 0 {
+			event.Status = http.StatusOK
+		}
+		event.Bytes = aw.written
+		if action == "upload" {
+			event.Bytes = body.read
+		}
+		switch {
+		case event.Status >= 400:
+			event.Result = "failure"
+		case r.Context().Err() != nil:
+			// The client went away before all of it was sent
+			event.Result = "aborted"
+		default:
+			event.Result = "success"
+		}
+		s.audit.record(event)
+	})
+}
@@ -0,0 +1,62 @@
+package fileserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	_, srv := newTestService(t, func(s *FileService) { s.AuditLog = auditPath })
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   auditEvent
+	}{
+		{http.MethodPut, "/upload/a.txt", "hello", auditEvent{Action: "upload", FileName: "a.txt", Bytes: 5, Status: http.StatusCreated, Result: "success"}},
+		{http.MethodPut, "/upload/b.txt", "world", auditEvent{Action: "upload", FileName: "b.txt", Bytes: 5, Status: http.StatusCreated, Result: "success"}},
+		{http.MethodGet, "/download/a.txt", "", auditEvent{Action: "download", FileName: "a.txt", Bytes: 5, Status: http.StatusOK, Result: "success"}},
+		{http.MethodGet, "/download/missing.txt", "", auditEvent{Action: "download", FileName: "missing.txt", Bytes: 12, Status: http.StatusNotFound, Result: "failure"}},
+		{http.MethodPost, "/swap/a.txt?with=b.txt", "", auditEvent{Action: "swap", FileName: "a.txt", Bytes: 23, Status: http.StatusOK, Result: "success"}},
+		{http.MethodDelete, "/delete/b.txt", "", auditEvent{Action: "delete", FileName: "b.txt", Status: http.StatusNoContent, Result: "success"}},
+		{http.MethodPost, "/fetch", `{"url":"http://example.com/c.txt"}`, auditEvent{Action: "fetch", Bytes: 41, Status: http.StatusForbidden, Result: "failure"}},
+	}
+	for _, tt := range tests {
+		doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader(tt.body), nil)
+	}
+	// Events are recorded once the handlers return
+	srv.Close()
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for i, tt := range tests {
+		if !scanner.Scan() {
+			t.Fatalf("audit log has %d events, want %d", i, len(tests))
+		}
+		var got auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+			t.Fatalf("decoding audit event %d: %v", i, err)
+		}
+		if got.Time.IsZero() || got.ClientIP != "127.0.0.1" {
+			t.Errorf("%s %s: event at %v from %q, want a time and the client IP", tt.method, tt.path, got.Time, got.ClientIP)
+		}
+		got.Time, got.ClientIP = tt.want.Time, tt.want.ClientIP
+		if got != tt.want {
+			t.Errorf("%s %s: audit event %+v, want %+v", tt.method, tt.path, got, tt.want)
+		}
+	}
+	if scanner.Scan() {
+		t.Errorf("unexpected audit event %s", scanner.Text())
+	}
+}
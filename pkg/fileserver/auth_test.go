@@ -0,0 +1,67 @@
+package fileserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signHS256 returns a JWT carrying claims signed with secret
+func signHS256(t *testing.T, secret []byte, claims jwtClaims) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Algorithm: "HS256"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequireScope(t *testing.T) {
+	secret := []byte("test-secret")
+	_, srv := newTestService(t, func(s *FileService) {
+		s.AuthMode = AuthModeJWT
+		s.JWTSecret = secret
+	})
+
+	readWrite := signHS256(t, secret, jwtClaims{Subject: "rw", Scope: ScopeRead + " " + ScopeWrite})
+	readOnly := signHS256(t, secret, jwtClaims{Subject: "ro", Scopes: []string{ScopeRead}})
+	expired := signHS256(t, secret, jwtClaims{Subject: "old", Scope: ScopeRead, ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	forged := signHS256(t, []byte("other-secret"), jwtClaims{Subject: "forged", Scope: ScopeRead})
+
+	tests := []struct {
+		desc   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"upload without a token", "", http.MethodPut, "/upload/a.txt", http.StatusUnauthorized},
+		{"upload with write scope", readWrite, http.MethodPut, "/upload/a.txt", http.StatusCreated},
+		{"download with read scope", readOnly, http.MethodGet, "/download/a.txt", http.StatusOK},
+		{"upload with read scope", readOnly, http.MethodPut, "/upload/b.txt", http.StatusForbidden},
+		{"delete without delete scope", readWrite, http.MethodDelete, "/delete/a.txt", http.StatusForbidden},
+		{"consume without delete scope", readWrite, http.MethodGet, "/download/a.txt?consume=true", http.StatusForbidden},
+		{"expired token", expired, http.MethodGet, "/download/a.txt", http.StatusUnauthorized},
+		{"token signed with another key", forged, http.MethodGet, "/download/a.txt", http.StatusUnauthorized},
+		{"malformed token", "not.a-token", http.MethodGet, "/download/a.txt", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.token != "" {
+			header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader("content"), header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: %s %s got %d (%s), want %d", tt.desc, tt.method, tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+}
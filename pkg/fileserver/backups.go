@@ -0,0 +1,270 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errNoBackup is returned when rolling back a file that
+// wasn't overwritten within OverwriteBackupRetention
+var errNoBackup = fmt.Errorf("%w: no backup to roll back to", ErrNotFound)
+
+// backup is the content of a file before it was
+// overwritten, along with its attributes
+type backup struct {
+	path      string
+	attrs     fileAttrs
+	createdAt time.Time
+}
+
+// backupsDir is where the backups of overwritten files
+// are kept
+func (s *FileService) backupsDir() string {
+	return filepath.Join(s.StoragePath, internalDir, "backups")
+}
+
+// backupFile keeps the current content of the file name
+// as its latest backup before it is overwritten, the
+// caller must hold the DB write lock and the file's
+// write lock
+func (s *FileService) backupFile(name string, previous *FileObject) error {
+	backupPath, attrs, err := linkPrevious(previous, s.backupsDir())
+	if err != nil {
+		return err
+	}
+	s.backups[name] = append(s.backups[name], backup{
+		path:      backupPath,
+		attrs:     attrs,
+		createdAt: time.Now(),
+	})
+	return nil
+}
+
+// linkPrevious links the current content of the file
+// under a random name in dir, returning its path and the
+// file's attributes. Linking leaves the file in place, so
+// it is still replaced atomically by the rename
+func linkPrevious(previous *FileObject, dir string) (string, fileAttrs, error) {
+	linkPath, err := randomPath(dir)
+	if err != nil {
+		return "", fileAttrs{}, err
+	}
+	if err := os.Link(previous.Path, linkPath); err != nil {
+		return "", fileAttrs{}, err
+	}
+
+	previous.attrMu.RLock()
+	defer previous.attrMu.RUnlock()
+	return linkPath, fileAttrs{
+		size:       previous.Size,
+		metadata:   previous.Metadata,
+		checksums:  previous.Checksums,
+		uploadedAt: previous.UploadedAt,
+	}, nil
+}
+
+// randomPath returns a random path in dir, creating dir
+func randomPath(dir string) (string, error) {
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0774); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, hex.EncodeToString(rawID)), nil
+}
+
+// keepPrevious keeps the content of the file name being
+// overwritten as a backup and/or a revision, as enabled,
+// returning a func undoing that for when the overwrite
+// fails. The caller must hold the DB write lock and the
+// file's write lock
+func (s *FileService) keepPrevious(name string, previous *FileObject, srcPath string) (func(), error) {
+	// Restoring a backup doesn't make one
+	backedUp := false
+	if s.OverwriteBackupRetention > 0 && !s.isBackup(srcPath) {
+		if err := s.backupFile(name, previous); err != nil {
+			return nil, fmt.Errorf("unable to back up the previous file: %w", err)
+		}
+		backedUp = true
+	}
+
+	revised := false
+	if s.MaxRevisions > 0 {
+		if err := s.keepRevision(name, previous); err != nil {
+			if backedUp {
+				s.discardLatestBackup(name)
+			}
+			return nil, fmt.Errorf("unable to keep a revision of the previous file: %w", err)
+		}
+		revised = true
+	}
+
+	return func() {
+		if backedUp {
+			s.discardLatestBackup(name)
+		}
+		if revised {
+			s.discardLatestRevision(name)
+		}
+	}, nil
+}
+
+// lockForReplace looks up the file name and takes its
+// write lock, for replacing its content with a previous
+// one. A file replaced by another upload meanwhile is
+// looked up again, the FileObject of a file that isn't
+// stored (anymore) is a new one
+func (s *FileService) lockForReplace(name string) (*FileObject, error) {
+	for {
+		fileObj, found := s.lookup(name)
+		if !found {
+			filePath, err := s.localPath(name)
+			if err != nil {
+				return nil, withKind(ErrInvalidName, err)
+			}
+			fileObj = &FileObject{Path: filePath}
+		}
+		fileObj.Mu.Lock()
+		if current, stillFound := s.lookup(name); !stillFound || current == fileObj {
+			return fileObj, nil
+		}
+		fileObj.Mu.Unlock()
+	}
+}
+
+// discardLatestBackup removes the latest backup of the
+// file name, the caller must hold the DB write lock
+func (s *FileService) discardLatestBackup(name string) {
+	backups := s.backups[name]
+	if len(backups) == 0 {
+		return
+	}
+	os.Remove(backups[len(backups)-1].path)
+	s.setBackups(name, backups[:len(backups)-1])
+}
+
+// setBackups replaces the backups of the file name, the
+// caller must hold the DB write lock
+func (s *FileService) setBackups(name string, backups []backup) {
+	if len(backups) == 0 {
+		delete(s.backups, name)
+		return
+	}
+	s.backups[name] = backups
+}
+
+// isBackup reports whether path is that of a backup
+func (s *FileService) isBackup(path string) bool {
+	return strings.HasPrefix(path, s.backupsDir()+string(filepath.Separator))
+}
+
+// Rollback restores the file name to its content before
+// it was last overwritten, discarding the current content
+// A deleted file is restored as well, as long as it was
+// overwritten within OverwriteBackupRetention
+func (s *FileService) Rollback(name string) (StoredFile, error) {
+	name = s.resolveName(name)
+	fileObj, err := s.lockForReplace(name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer fileObj.Mu.Unlock()
+
+	s.DBMu.Lock()
+	backups := s.backups[name]
+	if len(backups) == 0 {
+		s.DBMu.Unlock()
+		return StoredFile{}, errNoBackup
+	}
+	latest := backups[len(backups)-1]
+	s.setBackups(name, backups[:len(backups)-1])
+	s.DBMu.Unlock()
+
+	if err := s.putFile(name, fileObj, latest.path, latest.attrs); err != nil {
+		s.DBMu.Lock()
+		s.backups[name] = append(s.backups[name], latest)
+		s.DBMu.Unlock()
+		return StoredFile{}, newServerError("Server encountered an exception restoring the backup", err)
+	}
+	s.uploadCommitted(name, latest.attrs.size)
+
+	return StoredFile{
+		Name:       name,
+		Size:       latest.attrs.size,
+		Metadata:   copyStringMap(latest.attrs.metadata),
+		Checksums:  copyStringMap(latest.attrs.checksums),
+		UploadedAt: latest.attrs.uploadedAt,
+	}, nil
+}
+
+// rollback restores a file to its content before it was
+// last overwritten
+func (s *FileService) rollback(w http.ResponseWriter, r *http.Request) {
+	fileName := requestFileName(r, "/rollback/")
+	log.Info().
+		Str("fileName", fileName).
+		Msg("Processing rollback")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Please POST to roll back a file"))
+		return
+	}
+
+	stored, err := s.Rollback(fileName)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	log.Info().
+		Str("fileName", stored.Name).
+		Time("uploadedAt", stored.UploadedAt).
+		Msg("Rolled back file")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Rolled back to the upload of " + stored.UploadedAt.UTC().Format(time.RFC3339)))
+}
+
+// pruneBackups periodically removes the backups older
+// than OverwriteBackupRetention until the service is
+// stopped
+func (s *FileService) pruneBackups() {
+	ticker := time.NewTicker(min(s.OverwriteBackupRetention, time.Minute))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.DBMu.Lock()
+			for name, backups := range s.backups {
+				// Backups are appended as they are made, so the
+				// expired ones come first
+				expired := 0
+				for expired < len(backups) && time.Since(backups[expired].createdAt) > s.OverwriteBackupRetention {
+					os.Remove(backups[expired].path)
+					expired++
+				}
+				if expired > 0 {
+					log.Debug().
+						Str("fileName", name).
+						Int("backups", expired).
+						Msg("Pruned expired backups")
+					s.setBackups(name, backups[expired:])
+				}
+			}
+			s.DBMu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package fileserver
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"sync"
+	"time"
+)
+
+// CacheStats are the download cache counters reported
+// by the stats endpoint
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// downloadCache keeps the content of the most recently
+// downloaded small files in memory, evicting the least
+// recently used once it holds maxEntries files
+type downloadCache struct {
+	mu          sync.Mutex
+	maxEntries  int
+	maxFileSize int64
+	entries     map[string]*list.Element
+	lru         *list.List
+	stats       CacheStats
+}
+
+// cacheEntry is the content of a file as it was when
+// uploaded at uploadedAt
+type cacheEntry struct {
+	name       string
+	fileObj    *FileObject
+	uploadedAt time.Time
+	content    []byte
+}
+
+// newDownloadCache returns a cache of at most maxEntries
+// files of at most maxFileSize bytes
+func newDownloadCache(maxEntries int, maxFileSize int64) *downloadCache {
+	return &downloadCache{
+		maxEntries:  maxEntries,
+		maxFileSize: maxFileSize,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+// get returns the cached content of the file, entries of a
+// file that has since been replaced are misses
+func (c *downloadCache) get(name string, fileObj *FileObject, uploadedAt time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[name]
+	if found {
+		entry := elem.Value.(*cacheEntry)
+		if entry.fileObj == fileObj && entry.uploadedAt.Equal(uploadedAt) {
+			c.lru.MoveToFront(elem)
+			c.stats.Hits++
+			return entry.content, true
+		}
+		c.remove(elem)
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// put caches the content of the file, as uploaded at
+// uploadedAt
+func (c *downloadCache) put(name string, fileObj *FileObject, uploadedAt time.Time, content []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[name]; found {
+		c.remove(elem)
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{
+		name:       name,
+		fileObj:    fileObj,
+		uploadedAt: uploadedAt,
+		content:    content,
+	})
+	c.stats.Entries++
+	c.stats.Bytes += int64(len(content))
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate drops the cached content of the file
+func (c *downloadCache) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, found := c.entries[name]; found {
+		c.remove(elem)
+	}
+}
+
+// remove drops the entry, the caller must hold mu
+func (c *downloadCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.stats.Entries--
+	c.stats.Bytes -= int64(len(entry.content))
+}
+
+// invalidateCache drops the cached content of the file
+// once it is replaced or removed
+func (s *FileService) invalidateCache(name string) {
+	if s.cache != nil {
+		s.cache.invalidate(name)
+	}
+}
+
+// cacheStats returns the download cache counters, nil
+// when the cache is disabled
+func (s *FileService) cacheStats() *CacheStats {
+	if s.cache == nil {
+		return nil
+	}
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	stats := s.cache.stats
+	return &stats
+}
+
+// nopReadSeekCloser is a ReadSeekCloser whose Close does
+// nothing
+type nopReadSeekCloser struct {
+	io.ReadSeeker
+}
+
+// Close does nothing
+func (nopReadSeekCloser) Close() error {
+	return nil
+}
+
+// cachedContent returns a reader of the cached content
+func cachedContent(content []byte) io.ReadSeekCloser {
+	return nopReadSeekCloser{bytes.NewReader(content)}
+}
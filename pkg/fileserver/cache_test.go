@@ -0,0 +1,73 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDownloadCache(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) {
+		s.DownloadCacheEntries = 2
+		s.DownloadCacheMaxFileSize = 16
+	})
+	uploadFile(t, srv, "small.txt", "small")
+	uploadFile(t, srv, "large.txt", strings.Repeat("l", 32))
+
+	// The steps run in order, each followed by the counters
+	tests := []struct {
+		desc       string
+		method     string
+		path       string
+		body       string
+		wantBody   string
+		wantHits   int64
+		wantMisses int64
+	}{
+		{"first download", http.MethodGet, "/download/small.txt", "", "small", 0, 1},
+		{"cached download", http.MethodGet, "/download/small.txt", "", "small", 1, 1},
+		{"large file bypasses the cache", http.MethodGet, "/download/large.txt", "", strings.Repeat("l", 32), 1, 1},
+		{"overwrite", http.MethodPut, "/upload/small.txt", "changed", "", 1, 1},
+		{"download after the overwrite", http.MethodGet, "/download/small.txt", "", "changed", 1, 2},
+		{"cached again", http.MethodGet, "/download/small.txt", "", "changed", 2, 2},
+		{"delete", http.MethodDelete, "/delete/small.txt", "", "", 2, 2},
+	}
+	for _, tt := range tests {
+		_, body := doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader(tt.body), nil)
+		if tt.method == http.MethodGet && body != tt.wantBody {
+			t.Errorf("%s: got %q, want %q", tt.desc, body, tt.wantBody)
+		}
+		if stats := s.Stats(); stats.Cache == nil || stats.Cache.Hits != tt.wantHits || stats.Cache.Misses != tt.wantMisses {
+			t.Errorf("%s: cache stats %+v, want %d hits and %d misses", tt.desc, stats.Cache, tt.wantHits, tt.wantMisses)
+		}
+	}
+	if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/small.txt", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download after the delete got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+// BenchmarkDownloadCache downloads small files with and
+// without the download cache
+func BenchmarkDownloadCache(b *testing.B) {
+	for _, entries := range []int64{0, 256} {
+		s, srv := newTestService(b, func(s *FileService) { s.DownloadCacheEntries = entries })
+		for i := 0; i < 100; i++ {
+			uploadFile(b, srv, fmt.Sprintf("file-%03d.txt", i), strings.Repeat("x", 4<<10))
+		}
+		handler := s.HTTPServer.Handler
+
+		b.Run(fmt.Sprintf("entries=%d", entries), func(b *testing.B) {
+			b.SetBytes(4 << 10)
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/download/file-%03d.txt", i%100), nil)
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("download got %d", rec.Code)
+				}
+			}
+		})
+	}
+}
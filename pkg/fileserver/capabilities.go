@@ -0,0 +1,114 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Capabilities describes the features and limits of the
+// server, it is the JSON body returned by the capabilities
+// endpoint so clients can pick a code path on startup
+type Capabilities struct {
+	// Mode is the write mode, e.g. ModeAppendOnly
+	Mode string `json:"mode"`
+
+	// Auth is the authentication required, "none" or
+	// AuthModeJWT
+	Auth string `json:"auth"`
+
+	// MaxUploadSize is the largest upload (in bytes), 0
+	// means unlimited. ExtensionMaxUploadSizes override it
+	// per extension (e.g. ".txt")
+	MaxUploadSize           int64            `json:"maxUploadSize"`
+	ExtensionMaxUploadSizes map[string]int64 `json:"extensionMaxUploadSizes,omitempty"`
+
+	// RequireContentLength is set when chunked uploads are
+	// rejected, AllowEmpty when empty ones are stored
+	RequireContentLength bool `json:"requireContentLength"`
+	AllowEmpty           bool `json:"allowEmpty"`
+
+	// Checksums are the algorithms computed over uploads
+	Checksums []string `json:"checksums"`
+
+	// ResumableUploads (Content-Range) and UploadSessions
+	// (/upload/start) are always available
+	ResumableUploads bool `json:"resumableUploads"`
+	UploadSessions   bool `json:"uploadSessions"`
+
+	// Fetch is set when /fetch/ may download files
+	Fetch bool `json:"fetch"`
+
+	// Compression are the content encodings downloads may
+	// be sent with
+	Compression []string `json:"compression"`
+
+	// Thumbnails is set when ?thumbnail=WxH is served, up
+	// to ThumbnailMaxSize
+	Thumbnails       bool  `json:"thumbnails"`
+	ThumbnailMaxSize int64 `json:"thumbnailMaxSize,omitempty"`
+
+	// DataURLMaxSize is the largest file sent with
+	// ?encoding=dataurl, 0 when they are disabled
+	DataURLMaxSize int64 `json:"dataURLMaxSize"`
+
+	// List is set unless the list endpoint is disabled
+	List bool `json:"list"`
+
+	// MaxRevisions is how many revisions are kept, 0 when
+	// versioning is disabled
+	MaxRevisions int64 `json:"maxRevisions"`
+
+	// StorageClasses are the X-Storage-Class hints accepted
+	StorageClasses []string `json:"storageClasses"`
+
+	// RequiredNamePrefix is the prefix every uploaded name
+	// must start with
+	RequiredNamePrefix string `json:"requiredNamePrefix,omitempty"`
+}
+
+// Capabilities returns the features and limits derived
+// from the configuration of the service
+func (s *FileService) Capabilities() Capabilities {
+	auth := s.AuthMode
+	if auth == "" {
+		auth = "none"
+	}
+	compression := []string{}
+	if s.GzipSidecars {
+		compression = append(compression, "gzip")
+	}
+	capabilities := Capabilities{
+		Mode:                    s.mode(),
+		Auth:                    auth,
+		MaxUploadSize:           s.MaxUploadSize,
+		ExtensionMaxUploadSizes: s.ExtensionMaxUploadSizes,
+		RequireContentLength:    s.RequireContentLength,
+		AllowEmpty:              s.AllowEmpty,
+		Checksums:               s.Checksums,
+		ResumableUploads:        true,
+		UploadSessions:          true,
+		Fetch:                   len(s.FetchAllowedHosts) > 0,
+		Compression:             compression,
+		Thumbnails:              s.Thumbnails,
+		DataURLMaxSize:          s.DataURLMaxSize,
+		List:                    !s.DisableList,
+		MaxRevisions:            s.MaxRevisions,
+		StorageClasses:          s.StorageClasses,
+		RequiredNamePrefix:      s.RequiredNamePrefix,
+	}
+	if s.Thumbnails {
+		capabilities.ThumbnailMaxSize = s.ThumbnailMaxSize
+	}
+	return capabilities
+}
+
+// capabilities returns the features and limits of the
+// server as JSON, clients query it before authenticating
+func (s *FileService) capabilities(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("Processing capabilities")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Capabilities())
+}
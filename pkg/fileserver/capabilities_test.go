@@ -0,0 +1,75 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	s, _ := newTestService(t, func(s *FileService) {
+		s.AppendOnly = true
+		s.AuthMode = AuthModeJWT
+		s.JWTSecret = []byte("test-secret")
+		s.MaxUploadSize = 1 << 20
+		s.ExtensionMaxUploadSizes = map[string]int64{".txt": 1 << 10}
+		s.RequireContentLength = true
+		s.Checksums = []string{ChecksumSHA256, ChecksumMD5}
+		s.FetchAllowedHosts = []string{"example.com"}
+		s.GzipSidecars = true
+		s.Thumbnails = true
+		s.ThumbnailMaxSize = 256
+		s.DataURLMaxSize = 0
+		s.DisableList = true
+		s.MaxRevisions = 3
+		s.StorageClasses = []string{"hot"}
+		s.RequiredNamePrefix = "team-a/"
+		s.CanonicalHost = "files.example.com"
+	})
+
+	// Clients query it before authenticating, from any host
+	req := httptest.NewRequest(http.MethodGet, "/capabilities", nil)
+	req.Host = "10.0.0.1:8080"
+	rec := httptest.NewRecorder()
+	s.HTTPServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("/capabilities got %d with Content-Type %q (%s)", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	var got Capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the capabilities: %v", err)
+	}
+	want := Capabilities{
+		Mode:                    ModeAppendOnly,
+		Auth:                    AuthModeJWT,
+		MaxUploadSize:           1 << 20,
+		ExtensionMaxUploadSizes: map[string]int64{".txt": 1 << 10},
+		RequireContentLength:    true,
+		AllowEmpty:              false,
+		Checksums:               []string{ChecksumSHA256, ChecksumMD5},
+		ResumableUploads:        true,
+		UploadSessions:          true,
+		Fetch:                   true,
+		Compression:             []string{"gzip"},
+		Thumbnails:              true,
+		ThumbnailMaxSize:        256,
+		DataURLMaxSize:          0,
+		List:                    false,
+		MaxRevisions:            3,
+		StorageClasses:          []string{"hot"},
+		RequiredNamePrefix:      "team-a/",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("capabilities are\n%+v\nwant\n%+v", got, want)
+	}
+
+	// Unconfigured features are reported as such
+	defaults, _ := newTestService(t)
+	capabilities := defaults.Capabilities()
+	if capabilities.Auth != "none" || capabilities.Fetch || len(capabilities.Compression) != 0 || capabilities.ThumbnailMaxSize != 0 || !capabilities.List {
+		t.Errorf("default capabilities are %+v", capabilities)
+	}
+}
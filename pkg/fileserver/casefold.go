@@ -0,0 +1,77 @@
+package fileserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// errNameConflict is returned when storing a file whose
+// name only differs in case from a stored file's while
+// names are case-insensitive
+var errNameConflict = fmt.Errorf("%w in a different case", ErrConflict)
+
+// foldName returns the key of name in the case folded index
+func foldName(name string) string {
+	return strings.ToLower(name)
+}
+
+// indexName adds name to the case folded index, the caller
+// must hold the DB write lock
+func (s *FileService) indexName(name string) {
+	if !s.CaseInsensitiveNames {
+		return
+	}
+	if _, found := s.foldedNames[foldName(name)]; !found {
+		s.foldedNames[foldName(name)] = name
+	}
+}
+
+// unindexName removes name from the case folded index, the
+// caller must hold the DB write lock
+func (s *FileService) unindexName(name string) {
+	if !s.CaseInsensitiveNames {
+		return
+	}
+	if s.foldedNames[foldName(name)] == name {
+		delete(s.foldedNames, foldName(name))
+	}
+}
+
+// conflictingName returns the stored name differing only in
+// case from name, the caller must hold the DB lock
+func (s *FileService) conflictingName(name string) (string, bool) {
+	if !s.CaseInsensitiveNames {
+		return "", false
+	}
+	stored, found := s.foldedNames[foldName(name)]
+	if !found || stored == name {
+		return "", false
+	}
+	return stored, true
+}
+
+// resolveName returns the name of the stored file name
+// refers to, which (while names are case-insensitive) may
+// differ in case, e.g. "README.md" for "readme.md"
+func (s *FileService) resolveName(name string) string {
+	s.DBMu.RLock()
+	defer s.DBMu.RUnlock()
+	if stored, found := s.conflictingName(name); found {
+		return stored
+	}
+	return name
+}
+
+// checkNameConflict returns an error if a file whose name
+// only differs in case from name is stored
+func (s *FileService) checkNameConflict(name string) error {
+	s.DBMu.RLock()
+	defer s.DBMu.RUnlock()
+	if stored, found := s.conflictingName(name); found {
+		return fmt.Errorf("%w (%s)", errNameConflict, stored)
+	}
+	if _, found := s.DB[name]; found && s.AppendOnly {
+		return errAppendOnlyExists
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package fileserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	type step struct {
+		method   string
+		path     string
+		body     string
+		want     int
+		wantBody string
+	}
+	// The steps of each mode run in order, after README.md
+	// is stored
+	tests := []struct {
+		insensitive bool
+		steps       []step
+	}{
+		{true, []step{
+			{http.MethodPut, "/upload/readme.md", "lower", http.StatusConflict, ""},
+			{http.MethodPut, "/upload/README.MD", "upper", http.StatusConflict, ""},
+			{http.MethodGet, "/download/readme.md", "", http.StatusOK, "original"},
+			{http.MethodGet, "/list/", "", http.StatusOK, "README.md"},
+			{http.MethodPut, "/upload/README.md", "overwrite", http.StatusCreated, ""},
+			{http.MethodGet, "/download/readme.MD", "", http.StatusOK, "overwrite"},
+			{http.MethodDelete, "/delete/readme.md", "", http.StatusNoContent, ""},
+			{http.MethodGet, "/download/README.md", "", http.StatusNotFound, ""},
+			{http.MethodPut, "/upload/readme.md", "lower", http.StatusCreated, ""},
+		}},
+		{false, []step{
+			{http.MethodPut, "/upload/readme.md", "lower", http.StatusCreated, ""},
+			{http.MethodGet, "/download/README.md", "", http.StatusOK, "original"},
+			{http.MethodGet, "/download/readme.md", "", http.StatusOK, "lower"},
+			{http.MethodGet, "/list/", "", http.StatusOK, "readme.md\nREADME.md"},
+		}},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) { s.CaseInsensitiveNames = tt.insensitive })
+		uploadFile(t, srv, "README.md", "original")
+
+		for _, step := range tt.steps {
+			resp, body := doRequest(t, step.method, srv.URL+step.path, strings.NewReader(step.body), nil)
+			if resp.StatusCode != step.want {
+				t.Errorf("insensitive %v: %s %s got %d (%s), want %d", tt.insensitive, step.method, step.path, resp.StatusCode, body, step.want)
+			}
+			if step.wantBody != "" && body != step.wantBody {
+				t.Errorf("insensitive %v: %s %s got %q, want %q", tt.insensitive, step.method, step.path, body, step.wantBody)
+			}
+		}
+	}
+}
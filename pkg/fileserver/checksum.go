@@ -0,0 +1,203 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Checksum algorithms computed over uploaded files
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumMD5    = "md5"
+	ChecksumCRC32  = "crc32"
+)
+
+// checksumAlgorithms maps the supported checksum
+// algorithms to their hash constructors
+var checksumAlgorithms = map[string]func() hash.Hash{
+	ChecksumSHA256: sha256.New,
+	ChecksumMD5:    md5.New,
+	ChecksumCRC32:  func() hash.Hash { return crc32.NewIEEE() },
+}
+
+// checksummer computes several digests in a single
+// pass over the data written to it
+type checksummer map[string]hash.Hash
+
+// newChecksummer returns a checksummer for the algorithms
+func newChecksummer(algorithms []string) checksummer {
+	c := checksummer{}
+	for _, algorithm := range algorithms {
+		c[algorithm] = checksumAlgorithms[algorithm]()
+	}
+	return c
+}
+
+// Write writes p to every digest
+func (c checksummer) Write(p []byte) (int, error) {
+	for _, h := range c {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// sums returns the hex encoded digests by algorithm
+func (c checksummer) sums() map[string]string {
+	sums := make(map[string]string, len(c))
+	for algorithm, h := range c {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// checksumFile computes the digests of the file at path
+func checksumFile(path string, algorithms []string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := newChecksummer(algorithms)
+	if _, err := io.Copy(c, f); err != nil {
+		return nil, err
+	}
+	return c.sums(), nil
+}
+
+// checksumQueueSize is how many files may wait for their
+// checksums to be computed in the background, files asked
+// for past it are queued again by a later listing
+const checksumQueueSize = 1024
+
+// checksumJob asks for the checksums of a file
+type checksumJob struct {
+	name       string
+	fileObj    *FileObject
+	algorithms []string
+}
+
+// queueChecksums asks for the missing checksums of the
+// file to be computed in the background, unless they
+// already are
+func (s *FileService) queueChecksums(name string, fileObj *FileObject, algorithms []string) {
+	s.checksumMu.Lock()
+	defer s.checksumMu.Unlock()
+	if s.checksumPending[fileObj] {
+		return
+	}
+	select {
+	case s.checksumJobs <- checksumJob{name: name, fileObj: fileObj, algorithms: algorithms}:
+		s.checksumPending[fileObj] = true
+	default:
+	}
+}
+
+// computeChecksums computes the queued checksums one file
+// at a time until the service is stopped
+func (s *FileService) computeChecksums() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.done
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case job := <-s.checksumJobs:
+			if _, err := s.fileChecksums(ctx, job.fileObj, job.algorithms); err != nil && !isAborted(err) {
+				log.Error().Err(err).Str("fileName", job.name).Msg("Unable to checksum file")
+			}
+			s.checksumMu.Lock()
+			delete(s.checksumPending, job.fileObj)
+			s.checksumMu.Unlock()
+		}
+	}
+}
+
+// fileChecksums returns the digests of the file for the
+// algorithms, computing the ones missing (e.g. for files
+// found on disk rather than uploaded) and keeping them
+// with the file until it is replaced
+func (s *FileService) fileChecksums(ctx context.Context, fileObj *FileObject, algorithms []string) (map[string]string, error) {
+	// An upload replacing the file meanwhile would change
+	// its content and checksums
+	fileObj.Mu.RLock()
+	defer fileObj.Mu.RUnlock()
+
+	checksums := fileObj.copyChecksums()
+	var missing []string
+	for _, algorithm := range algorithms {
+		if _, found := checksums[algorithm]; !found {
+			missing = append(missing, algorithm)
+		}
+	}
+	if len(missing) == 0 {
+		return checksums, nil
+	}
+
+	content, _, err := s.openFile(fileObj.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	sums := newChecksummer(missing)
+	if _, err := copyWithContext(ctx, sums, content); err != nil {
+		return nil, err
+	}
+
+	fileObj.attrMu.Lock()
+	defer fileObj.attrMu.Unlock()
+	updated := copyStringMap(fileObj.Checksums)
+	if updated == nil {
+		updated = map[string]string{}
+	}
+	for algorithm, sum := range sums.sums() {
+		updated[algorithm] = sum
+	}
+	fileObj.Checksums = updated
+	return copyStringMap(updated), nil
+}
+
+// verifyContentMD5 compares the base64 encoded Content-MD5
+// sent by the client to the hex encoded digest computed
+func verifyContentMD5(contentMD5, computed string) error {
+	expected, err := base64.StdEncoding.DecodeString(contentMD5)
+	if err != nil {
+		return fmt.Errorf("Content-MD5 is not valid base64: %w", err)
+	}
+	if hex.EncodeToString(expected) != computed {
+		return fmt.Errorf("Content-MD5 does not match the uploaded data")
+	}
+	return nil
+}
+
+// setChecksumHeaders sets the response headers carrying
+// the digests of a file
+func setChecksumHeaders(h http.Header, checksums map[string]string) {
+	if sum, found := checksums[ChecksumSHA256]; found {
+		h.Set("X-Checksum-Sha256", sum)
+	}
+	if sum, found := checksums[ChecksumMD5]; found {
+		raw, _ := hex.DecodeString(sum)
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(raw))
+	}
+	if sum, found := checksums[ChecksumCRC32]; found {
+		h.Set("X-Checksum-Crc32", sum)
+	}
+}
@@ -0,0 +1,56 @@
+package fileserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the IP of the client making the request,
+// used by every IP based feature (e.g. the upload quota)
+// X-Forwarded-For is only honored for requests coming from
+// a trusted proxy, in which case the rightmost hop that
+// isn't a trusted proxy is the client, as the hops left
+// of it could have been set by the client itself
+func (s *FileService) clientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if !s.trustedProxy(remoteIP) {
+		return remoteIP
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	if len(hops) == 0 {
+		return remoteIP
+	}
+	for i := len(hops) - 1; i > 0; i-- {
+		if !s.trustedProxy(hops[i]) {
+			return hops[i]
+		}
+	}
+	return hops[0]
+}
+
+// trustedProxy reports whether ip is within one of the
+// trusted proxy networks
+func (s *FileService) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range s.TrustedProxies {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
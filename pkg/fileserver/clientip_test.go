@@ -0,0 +1,46 @@
+package fileserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	var proxies []*net.IPNet
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.1/32"} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, network)
+	}
+	s := &FileService{TrustedProxies: proxies}
+
+	tests := []struct {
+		desc         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct client", "203.0.113.1:1234", nil, "203.0.113.1"},
+		{"untrusted peer can't spoof", "203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"},
+		{"trusted proxy without the header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"spoofed hop before an untrusted one", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"several headers", "10.0.0.1:1234", []string{"198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"proxy outside the trusted host", "192.168.1.2:1234", []string{"198.51.100.1"}, "192.168.1.2"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, header := range tt.forwardedFor {
+			r.Header.Add("X-Forwarded-For", header)
+		}
+		if got := s.clientIP(r); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package fileserver
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadConfig reads the optional FILESERVER_* environment
+// variables into the service. Unset variables leave the
+// defaults set by NewFileService untouched.
+func (s *FileService) loadConfig() error {
+	var err error
+
+	s.Backend = envString("FILESERVER_BACKEND", s.Backend)
+	switch s.Backend {
+	case BackendLocal:
+	case "s3", "mem":
+		return fmt.Errorf("FILESERVER_BACKEND %q is not supported by this build, only %q is available", s.Backend, BackendLocal)
+	default:
+		return fmt.Errorf("unknown FILESERVER_BACKEND %q", s.Backend)
+	}
+
+	layout := envString("FILESERVER_STORAGE_LAYOUT", StorageLayoutFlat)
+	switch layout {
+	case StorageLayoutFlat:
+	case StorageLayoutSharded:
+		s.KeyFunc = ShardedKey
+		s.NameFunc = ShardedName
+	case StorageLayoutDate:
+		if timezone := envString("FILESERVER_DATE_LAYOUT_TIMEZONE", ""); timezone != "" {
+			if s.DateLayoutLocation, err = time.LoadLocation(timezone); err != nil {
+				return fmt.Errorf("invalid FILESERVER_DATE_LAYOUT_TIMEZONE %q: %w", timezone, err)
+			}
+		}
+		if s.DateLayoutNames, err = envBool("FILESERVER_DATE_LAYOUT_NAMES", s.DateLayoutNames); err != nil {
+			return err
+		}
+
+		// Dated names are stored as is, under the date dirs
+		// they start with
+		if !s.DateLayoutNames {
+			s.KeyFunc, s.NameFunc = DateKeys(s.DateLayoutLocation, time.Now)
+		}
+	default:
+		return fmt.Errorf("unknown FILESERVER_STORAGE_LAYOUT %q", layout)
+	}
+	if s.CaseInsensitiveNames, err = envBool("FILESERVER_CASE_INSENSITIVE_NAMES", s.CaseInsensitiveNames); err != nil {
+		return err
+	}
+	if s.TypeDirs, err = envMap("FILESERVER_TYPE_DIRS", s.TypeDirs); err != nil {
+		return err
+	}
+	if len(s.TypeDirs) > 0 {
+		if s.KeyFunc, s.NameFunc, err = TypeDirKeys(s.TypeDirs, s.KeyFunc, s.NameFunc); err != nil {
+			return fmt.Errorf("invalid FILESERVER_TYPE_DIRS: %w", err)
+		}
+	}
+
+	if s.DownloadCacheEntries, err = envInt64("FILESERVER_DOWNLOAD_CACHE_ENTRIES", s.DownloadCacheEntries); err != nil {
+		return err
+	}
+	if s.DownloadCacheMaxFileSize, err = envInt64("FILESERVER_DOWNLOAD_CACHE_MAX_FILE_SIZE", s.DownloadCacheMaxFileSize); err != nil {
+		return err
+	}
+
+	if s.DownloadBufferSize, err = envInt64("FILESERVER_DOWNLOAD_BUFFER_SIZE", s.DownloadBufferSize); err != nil {
+		return err
+	}
+	if s.DownloadBufferSize < 0 {
+		return fmt.Errorf("FILESERVER_DOWNLOAD_BUFFER_SIZE must not be negative (got %d)", s.DownloadBufferSize)
+	}
+
+	if s.Thumbnails, err = envBool("FILESERVER_THUMBNAILS", s.Thumbnails); err != nil {
+		return err
+	}
+	if s.ThumbnailMaxSize, err = envInt64("FILESERVER_THUMBNAIL_MAX_SIZE", s.ThumbnailMaxSize); err != nil {
+		return err
+	}
+	if s.ThumbnailMaxSize < 1 {
+		return fmt.Errorf("FILESERVER_THUMBNAIL_MAX_SIZE must be at least 1 (got %d)", s.ThumbnailMaxSize)
+	}
+	if s.ThumbnailCacheEntries, err = envInt64("FILESERVER_THUMBNAIL_CACHE_ENTRIES", s.ThumbnailCacheEntries); err != nil {
+		return err
+	}
+	if s.ThumbnailCacheEntries < 0 {
+		return fmt.Errorf("FILESERVER_THUMBNAIL_CACHE_ENTRIES must not be negative (got %d)", s.ThumbnailCacheEntries)
+	}
+
+	if s.MaxDownloadsPerFile, err = envInt64("FILESERVER_MAX_DOWNLOADS_PER_FILE", s.MaxDownloadsPerFile); err != nil {
+		return err
+	}
+	if s.MaxDownloadsPerFile < 0 {
+		return fmt.Errorf("FILESERVER_MAX_DOWNLOADS_PER_FILE must not be negative (got %d)", s.MaxDownloadsPerFile)
+	}
+	if s.DownloadQueueTimeout, err = envDuration("FILESERVER_DOWNLOAD_QUEUE_TIMEOUT", s.DownloadQueueTimeout); err != nil {
+		return err
+	}
+
+	if s.DataURLMaxSize, err = envInt64("FILESERVER_DATA_URL_MAX_SIZE", s.DataURLMaxSize); err != nil {
+		return err
+	}
+	if s.DataURLMaxSize < 0 {
+		return fmt.Errorf("FILESERVER_DATA_URL_MAX_SIZE must not be negative (got %d)", s.DataURLMaxSize)
+	}
+
+	if s.GzipSidecars, err = envBool("FILESERVER_GZIP_SIDECARS", s.GzipSidecars); err != nil {
+		return err
+	}
+
+	if s.DownloadRateLimit, err = envInt64("FILESERVER_DOWNLOAD_RATE_LIMIT", s.DownloadRateLimit); err != nil {
+		return err
+	}
+	if s.DownloadRateLimit < 0 {
+		return fmt.Errorf("FILESERVER_DOWNLOAD_RATE_LIMIT must not be negative (got %d)", s.DownloadRateLimit)
+	}
+
+	if s.AllowEmpty, err = envBool("FILESERVER_ALLOW_EMPTY", s.AllowEmpty); err != nil {
+		return err
+	}
+
+	if s.FailFastWrites, err = envBool("FILESERVER_FAIL_FAST_WRITES", s.FailFastWrites); err != nil {
+		return err
+	}
+
+	if s.FsyncOnUpload, err = envBool("FILESERVER_FSYNC_ON_UPLOAD", s.FsyncOnUpload); err != nil {
+		return err
+	}
+
+	if s.MaxUploadSize, err = envInt64("FILESERVER_MAX_UPLOAD_SIZE", s.MaxUploadSize); err != nil {
+		return err
+	}
+	if s.MaxUploadSize < 0 {
+		return fmt.Errorf("FILESERVER_MAX_UPLOAD_SIZE must not be negative (got %d)", s.MaxUploadSize)
+	}
+
+	extensionMaxUploadSizes, err := envMap("FILESERVER_EXTENSION_MAX_UPLOAD_SIZES", nil)
+	if err != nil {
+		return err
+	}
+	if extensionMaxUploadSizes != nil {
+		s.ExtensionMaxUploadSizes = make(map[string]int64, len(extensionMaxUploadSizes))
+		for ext, size := range extensionMaxUploadSizes {
+			limit, err := strconv.ParseInt(size, 10, 64)
+			if err != nil || limit < 0 {
+				return fmt.Errorf("invalid size %q of %s for FILESERVER_EXTENSION_MAX_UPLOAD_SIZES, expected a number of bytes", size, ext)
+			}
+			s.ExtensionMaxUploadSizes["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = limit
+		}
+	}
+
+	if s.MinUploadRate, err = envInt64("FILESERVER_MIN_UPLOAD_RATE", s.MinUploadRate); err != nil {
+		return err
+	}
+	if s.MinUploadRate < 0 {
+		return fmt.Errorf("FILESERVER_MIN_UPLOAD_RATE must not be negative (got %d)", s.MinUploadRate)
+	}
+	if s.MinUploadRateGrace, err = envDuration("FILESERVER_MIN_UPLOAD_RATE_GRACE", s.MinUploadRateGrace); err != nil {
+		return err
+	}
+
+	if s.KeepAlives, err = envBool("FILESERVER_KEEP_ALIVES", s.KeepAlives); err != nil {
+		return err
+	}
+	if s.IdleTimeout, err = envDuration("FILESERVER_IDLE_TIMEOUT", s.IdleTimeout); err != nil {
+		return err
+	}
+
+	if s.MaxConnections, err = envInt64("FILESERVER_MAX_CONNECTIONS", s.MaxConnections); err != nil {
+		return err
+	}
+	if s.MaxConnections < 0 {
+		return fmt.Errorf("FILESERVER_MAX_CONNECTIONS must not be negative (got %d)", s.MaxConnections)
+	}
+
+	if s.MaxHeaderBytes, err = envInt64("FILESERVER_MAX_HEADER_BYTES", s.MaxHeaderBytes); err != nil {
+		return err
+	}
+	if s.MaxHeaderBytes < 1 || s.MaxHeaderBytes > math.MaxInt32 {
+		return fmt.Errorf("FILESERVER_MAX_HEADER_BYTES out of range (got %d)", s.MaxHeaderBytes)
+	}
+
+	s.Checksums = envList("FILESERVER_CHECKSUMS", s.Checksums)
+	for _, algorithm := range s.Checksums {
+		if _, found := checksumAlgorithms[algorithm]; !found {
+			return fmt.Errorf("unknown checksum algorithm %q in FILESERVER_CHECKSUMS", algorithm)
+		}
+	}
+
+	s.UploadWebhookURL = envString("FILESERVER_UPLOAD_WEBHOOK_URL", s.UploadWebhookURL)
+	if s.UploadWebhookAttempts, err = envInt64("FILESERVER_UPLOAD_WEBHOOK_ATTEMPTS", s.UploadWebhookAttempts); err != nil {
+		return err
+	}
+	if s.UploadWebhookAttempts < 1 {
+		return fmt.Errorf("FILESERVER_UPLOAD_WEBHOOK_ATTEMPTS must be at least 1 (got %d)", s.UploadWebhookAttempts)
+	}
+
+	if s.H2C, err = envBool("FILESERVER_H2C", s.H2C); err != nil {
+		return err
+	}
+	if s.HTTP2MaxConcurrentStreams, err = envInt64("FILESERVER_HTTP2_MAX_CONCURRENT_STREAMS", s.HTTP2MaxConcurrentStreams); err != nil {
+		return err
+	}
+	if s.HTTP2MaxConcurrentStreams < 1 || s.HTTP2MaxConcurrentStreams > math.MaxUint32 {
+		return fmt.Errorf("FILESERVER_HTTP2_MAX_CONCURRENT_STREAMS out of range (got %d)", s.HTTP2MaxConcurrentStreams)
+	}
+
+	if s.NormalizePaths, err = envBool("FILESERVER_NORMALIZE_PATHS", s.NormalizePaths); err != nil {
+		return err
+	}
+	s.CanonicalHost = envString("FILESERVER_CANONICAL_HOST", s.CanonicalHost)
+	if s.SlugifyNames, err = envBool("FILESERVER_SLUGIFY_NAMES", s.SlugifyNames); err != nil {
+		return err
+	}
+
+	s.AuthMode = envString("FILESERVER_AUTH_MODE", s.AuthMode)
+	if secret := envString("FILESERVER_JWT_HS256_SECRET", ""); secret != "" {
+		s.JWTSecret = []byte(secret)
+	}
+	if keyFile := envString("FILESERVER_JWT_RS256_PUBLIC_KEY_FILE", ""); keyFile != "" {
+		if s.JWTPublicKey, err = loadRSAPublicKey(keyFile); err != nil {
+			return fmt.Errorf("unable to load FILESERVER_JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+		}
+	}
+	switch s.AuthMode {
+	case "":
+	case AuthModeJWT:
+		if len(s.JWTSecret) == 0 && s.JWTPublicKey == nil {
+			return fmt.Errorf("FILESERVER_AUTH_MODE %q needs FILESERVER_JWT_HS256_SECRET or FILESERVER_JWT_RS256_PUBLIC_KEY_FILE", s.AuthMode)
+		}
+	default:
+		return fmt.Errorf("unknown FILESERVER_AUTH_MODE %q", s.AuthMode)
+	}
+
+	s.DefaultContentType = envString("FILESERVER_DEFAULT_CONTENT_TYPE", s.DefaultContentType)
+	if s.ContentTypes, err = envMap("FILESERVER_CONTENT_TYPES", s.ContentTypes); err != nil {
+		return err
+	}
+	contentTypes := make(map[string]string, len(s.ContentTypes))
+	for ext, contentType := range s.ContentTypes {
+		contentTypes["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = contentType
+	}
+	s.ContentTypes = contentTypes
+
+	if s.UntrustedContent, err = envBool("FILESERVER_UNTRUSTED_CONTENT", s.UntrustedContent); err != nil {
+		return err
+	}
+	untrustedExtensions := envList("FILESERVER_UNTRUSTED_EXTENSIONS", s.UntrustedExtensions)
+	s.UntrustedExtensions = make([]string, 0, len(untrustedExtensions))
+	for _, ext := range untrustedExtensions {
+		s.UntrustedExtensions = append(s.UntrustedExtensions, "."+strings.TrimPrefix(strings.ToLower(ext), "."))
+	}
+
+	s.ContentCheck = envString("FILESERVER_CONTENT_CHECK", s.ContentCheck)
+	switch s.ContentCheck {
+	case ContentCheckOff, ContentCheckWarn, ContentCheckReject:
+	default:
+		return fmt.Errorf("unknown FILESERVER_CONTENT_CHECK %q", s.ContentCheck)
+	}
+
+	if s.TrustedProxies, err = envCIDRs("FILESERVER_TRUSTED_PROXIES", s.TrustedProxies); err != nil {
+		return err
+	}
+
+	if key := envString("FILESERVER_ENCRYPTION_KEY", ""); key != "" {
+		if s.encryption, err = newEncryption(key); err != nil {
+			return fmt.Errorf("invalid FILESERVER_ENCRYPTION_KEY, expected a base64 encoded 16, 24 or 32 byte key: %w", err)
+		}
+	}
+
+	s.MirrorPath = envString("FILESERVER_MIRROR_PATH", s.MirrorPath)
+
+	if s.UploadQuota, err = envInt64("FILESERVER_UPLOAD_QUOTA_BYTES", s.UploadQuota); err != nil {
+		return err
+	}
+	if s.UploadQuota < 0 {
+		return fmt.Errorf("FILESERVER_UPLOAD_QUOTA_BYTES must not be negative (got %d)", s.UploadQuota)
+	}
+	if s.UploadQuotaWindow, err = envDuration("FILESERVER_UPLOAD_QUOTA_WINDOW", s.UploadQuotaWindow); err != nil {
+		return err
+	}
+	if s.UploadQuota > 0 && s.UploadQuotaWindow == 0 {
+		return fmt.Errorf("FILESERVER_UPLOAD_QUOTA_WINDOW must be set when FILESERVER_UPLOAD_QUOTA_BYTES is")
+	}
+
+	if s.RequireContentLength, err = envBool("FILESERVER_REQUIRE_CONTENT_LENGTH", s.RequireContentLength); err != nil {
+		return err
+	}
+
+	if s.MaxInFlightUploadBytes, err = envInt64("FILESERVER_MAX_IN_FLIGHT_UPLOAD_BYTES", s.MaxInFlightUploadBytes); err != nil {
+		return err
+	}
+	if s.MaxInFlightUploadBytes < 0 {
+		return fmt.Errorf("FILESERVER_MAX_IN_FLIGHT_UPLOAD_BYTES must not be negative (got %d)", s.MaxInFlightUploadBytes)
+	}
+
+	if s.ListRateLimit, err = envInt64("FILESERVER_LIST_RATE_LIMIT", s.ListRateLimit); err != nil {
+		return err
+	}
+	if s.ListRateLimit < 0 {
+		return fmt.Errorf("FILESERVER_LIST_RATE_LIMIT must not be negative (got %d)", s.ListRateLimit)
+	}
+	if s.ListRateBurst, err = envInt64("FILESERVER_LIST_RATE_BURST", s.ListRateBurst); err != nil {
+		return err
+	}
+	if s.ListRateBurst < 1 {
+		return fmt.Errorf("FILESERVER_LIST_RATE_BURST must be at least 1 (got %d)", s.ListRateBurst)
+	}
+
+	if s.ReadOnly, err = envBool("FILESERVER_READ_ONLY", s.ReadOnly); err != nil {
+		return err
+	}
+	if s.AppendOnly, err = envBool("FILESERVER_APPEND_ONLY", s.AppendOnly); err != nil {
+		return err
+	}
+
+	if s.ExpirySweepInterval, err = envDuration("FILESERVER_EXPIRY_SWEEP_INTERVAL", s.ExpirySweepInterval); err != nil {
+		return err
+	}
+
+	storageClasses := envList("FILESERVER_STORAGE_CLASSES", s.StorageClasses)
+	s.StorageClasses = make([]string, 0, len(storageClasses))
+	for _, class := range storageClasses {
+		s.StorageClasses = append(s.StorageClasses, strings.ToLower(class))
+	}
+
+	if s.DisableList, err = envBool("FILESERVER_DISABLE_LIST", s.DisableList); err != nil {
+		return err
+	}
+
+	if s.ListCache, err = envBool("FILESERVER_LIST_CACHE", s.ListCache); err != nil {
+		return err
+	}
+
+	if s.EmptyListNoContent, err = envBool("FILESERVER_EMPTY_LIST_NO_CONTENT", s.EmptyListNoContent); err != nil {
+		return err
+	}
+
+	s.ErrorTemplates = envString("FILESERVER_ERROR_TEMPLATES", s.ErrorTemplates)
+
+	if s.FeedEntries, err = envInt64("FILESERVER_FEED_ENTRIES", s.FeedEntries); err != nil {
+		return err
+	}
+	if s.FeedEntries < 1 {
+		return fmt.Errorf("FILESERVER_FEED_ENTRIES must be at least 1 (got %d)", s.FeedEntries)
+	}
+
+	if s.ListTimeout, err = envDuration("FILESERVER_LIST_TIMEOUT", s.ListTimeout); err != nil {
+		return err
+	}
+
+	if s.RequestTimeout, err = envDuration("FILESERVER_REQUEST_TIMEOUT", s.RequestTimeout); err != nil {
+		return err
+	}
+	s.RequestTimeoutExempt = envList("FILESERVER_REQUEST_TIMEOUT_EXEMPT", s.RequestTimeoutExempt)
+
+	if s.LazyLoad, err = envBool("FILESERVER_LAZY_LOAD", s.LazyLoad); err != nil {
+		return err
+	}
+	if s.LazyLoad && layout == StorageLayoutDate && !s.DateLayoutNames {
+		return fmt.Errorf("FILESERVER_LAZY_LOAD needs FILESERVER_DATE_LAYOUT_NAMES with the %q FILESERVER_STORAGE_LAYOUT, the date dir of a file can't be told from its name", layout)
+	}
+	if s.RescanInterval, err = envDuration("FILESERVER_RESCAN_INTERVAL", s.RescanInterval); err != nil {
+		return err
+	}
+
+	if s.UploadSessionTTL, err = envDuration("FILESERVER_UPLOAD_SESSION_TTL", s.UploadSessionTTL); err != nil {
+		return err
+	}
+	if s.RangeUploadTTL, err = envDuration("FILESERVER_RANGE_UPLOAD_TTL", s.RangeUploadTTL); err != nil {
+		return err
+	}
+
+	if s.OverwriteBackupRetention, err = envDuration("FILESERVER_OVERWRITE_BACKUP_RETENTION", s.OverwriteBackupRetention); err != nil {
+		return err
+	}
+
+	s.FetchAllowedHosts = envList("FILESERVER_FETCH_ALLOWED_HOSTS", s.FetchAllowedHosts)
+	if s.FetchAllowedNetworks, err = envCIDRs("FILESERVER_FETCH_ALLOWED_NETWORKS", s.FetchAllowedNetworks); err != nil {
+		return err
+	}
+	if s.FetchTimeout, err = envDuration("FILESERVER_FETCH_TIMEOUT", s.FetchTimeout); err != nil {
+		return err
+	}
+	if s.FetchMaxSize, err = envInt64("FILESERVER_FETCH_MAX_SIZE", s.FetchMaxSize); err != nil {
+		return err
+	}
+	if s.FetchMaxSize < 0 {
+		return fmt.Errorf("FILESERVER_FETCH_MAX_SIZE must not be negative (got %d)", s.FetchMaxSize)
+	}
+
+	s.RequiredNamePrefix = envString("FILESERVER_REQUIRED_NAME_PREFIX", s.RequiredNamePrefix)
+
+	if s.MaxNameDepth, err = envInt64("FILESERVER_MAX_NAME_DEPTH", s.MaxNameDepth); err != nil {
+		return err
+	}
+	if s.MaxNameDepth < 0 {
+		return fmt.Errorf("FILESERVER_MAX_NAME_DEPTH must not be negative (got %d)", s.MaxNameDepth)
+	}
+	if s.MaxNameSegmentLength, err = envInt64("FILESERVER_MAX_NAME_SEGMENT_LENGTH", s.MaxNameSegmentLength); err != nil {
+		return err
+	}
+	if s.MaxNameSegmentLength < 0 {
+		return fmt.Errorf("FILESERVER_MAX_NAME_SEGMENT_LENGTH must not be negative (got %d)", s.MaxNameSegmentLength)
+	}
+
+	s.AuditLog = envString("FILESERVER_AUDIT_LOG", s.AuditLog)
+
+	s.ClamdAddress = envString("FILESERVER_CLAMD_ADDRESS", s.ClamdAddress)
+	if s.ClamdTimeout, err = envDuration("FILESERVER_CLAMD_TIMEOUT", s.ClamdTimeout); err != nil {
+		return err
+	}
+
+	if s.AccessLog, err = envBool("FILESERVER_ACCESS_LOG_ENABLED", s.AccessLog); err != nil {
+		return err
+	}
+	if s.AccessLogSampleRate, err = envInt64("FILESERVER_ACCESS_LOG_SAMPLE_RATE", s.AccessLogSampleRate); err != nil {
+		return err
+	}
+	if s.AccessLogSampleRate < 1 {
+		return fmt.Errorf("FILESERVER_ACCESS_LOG_SAMPLE_RATE must be at least 1 (got %d)", s.AccessLogSampleRate)
+	}
+
+	if s.LogStream, err = envBool("FILESERVER_LOG_STREAM", s.LogStream); err != nil {
+		return err
+	}
+
+	if s.MaxRevisions, err = envInt64("FILESERVER_MAX_REVISIONS", s.MaxRevisions); err != nil {
+		return err
+	}
+	if s.MaxRevisions < 0 {
+		return fmt.Errorf("FILESERVER_MAX_REVISIONS must not be negative (got %d)", s.MaxRevisions)
+	}
+
+	if s.VerifyConcurrency, err = envInt64("FILESERVER_VERIFY_CONCURRENCY", s.VerifyConcurrency); err != nil {
+		return err
+	}
+	if s.VerifyConcurrency < 1 {
+		return fmt.Errorf("FILESERVER_VERIFY_CONCURRENCY must be at least 1 (got %d)", s.VerifyConcurrency)
+	}
+	if s.VerifyTimeout, err = envDuration("FILESERVER_VERIFY_TIMEOUT", s.VerifyTimeout); err != nil {
+		return err
+	}
+
+	if s.DriftCheckInterval, err = envDuration("FILESERVER_DRIFT_CHECK_INTERVAL", s.DriftCheckInterval); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// envString returns the value of the environment
+// variable key, or def if it is unset
+func envString(key, def string) string {
+	val, found := os.LookupEnv(key)
+	if !found || val == "" {
+		return def
+	}
+	return val
+}
+
+// envList returns the comma separated values of the
+// environment variable key, or def if it is unset
+func envList(key string, def []string) []string {
+	val, found := os.LookupEnv(key)
+	if !found || val == "" {
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envMap returns the comma separated key=value pairs of
+// the environment variable key, or def if it is unset
+func envMap(key string, def map[string]string) (map[string]string, error) {
+	list := envList(key, nil)
+	if list == nil {
+		return def, nil
+	}
+	m := make(map[string]string, len(list))
+	for _, item := range list {
+		k, v, found := strings.Cut(item, "=")
+		if !found || strings.TrimSpace(k) == "" {
+			return def, fmt.Errorf("invalid entry %q for %s, expected key=value", item, key)
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// envCIDRs returns the comma separated CIDRs (or single
+// IPs) of the environment variable key, or def if it is unset
+func envCIDRs(key string, def []*net.IPNet) ([]*net.IPNet, error) {
+	list := envList(key, nil)
+	if list == nil {
+		return def, nil
+	}
+	cidrs := make([]*net.IPNet, 0, len(list))
+	for _, item := range list {
+		if !strings.Contains(item, "/") {
+			if ip := net.ParseIP(item); ip != nil && ip.To4() != nil {
+				item += "/32"
+			} else {
+				item += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(item)
+		if err != nil {
+			return def, fmt.Errorf("invalid value %q for %s: %w", item, key, err)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+// envBool returns the boolean value of the environment
+// variable key, or def if it is unset
+func envBool(key string, def bool) (bool, error) {
+	val, found := os.LookupEnv(key)
+	if !found || val == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return def, fmt.Errorf("invalid value %q for %s: %w", val, key, err)
+	}
+	return b, nil
+}
+
+// envInt64 returns the integer value of the environment
+// variable key, or def if it is unset
+func envInt64(key string, def int64) (int64, error) {
+	val, found := os.LookupEnv(key)
+	if !found || val == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid value %q for %s: %w", val, key, err)
+	}
+	return n, nil
+}
+
+// envDuration returns the duration value (e.g. "30s") of the
+// environment variable key, or def if it is unset
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	val, found := os.LookupEnv(key)
+	if !found || val == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return def, fmt.Errorf("invalid value %q for %s: %w", val, key, err)
+	}
+	if d < 0 {
+		return def, fmt.Errorf("invalid value %q for %s: must not be negative", val, key)
+	}
+	return d, nil
+}
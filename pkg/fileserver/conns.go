@@ -0,0 +1,46 @@
+package fileserver
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// connTracker keeps the state of the server's open
+// connections, fed by the http.Server ConnState callback
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+// newConnTracker returns an empty connTracker
+func newConnTracker() *connTracker {
+	return &connTracker{conns: map[net.Conn]http.ConnState{}}
+}
+
+// track records a connection changing state
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(t.conns, conn)
+	default:
+		t.conns[conn] = state
+	}
+}
+
+// counts returns the number of open connections and how
+// many of them are active (serving a request)
+func (t *connTracker) counts() (open, active int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, state := range t.conns {
+		if state == http.StateActive {
+			active++
+		}
+	}
+	return len(t.conns), active
+}
@@ -0,0 +1,51 @@
+package fileserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxConnections(t *testing.T) {
+	s, baseURL := startTestService(t, func(s *FileService) { s.MaxConnections = 1 })
+	defer s.Stop(context.Background())
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	// A connection holds the only slot until it is closed
+	held, err := net.Dial("tcp", strings.TrimPrefix(baseURL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for open, _ := s.conns.counts(); open == 0; open, _ = s.conns.counts() {
+		time.Sleep(time.Millisecond)
+	}
+
+	served := make(chan int)
+	go func() {
+		resp, err := client.Get(baseURL + "/healthz")
+		if err != nil {
+			served <- 0
+			return
+		}
+		resp.Body.Close()
+		served <- resp.StatusCode
+	}()
+	select {
+	case status := <-served:
+		t.Fatalf("request over the connection limit got %d while the slot was held", status)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	held.Close()
+	select {
+	case status := <-served:
+		if status != http.StatusOK {
+			t.Errorf("request once the slot was freed got %d, want %d", status, http.StatusOK)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request wasn't served once the slot was freed")
+	}
+}
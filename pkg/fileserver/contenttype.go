@@ -0,0 +1,203 @@
+package fileserver
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Content checks applied to uploads, comparing the type
+// sniffed from a file's first bytes to its extension's
+const (
+	ContentCheckOff    = "off"
+	ContentCheckWarn   = "warn"
+	ContentCheckReject = "reject"
+)
+
+// contentTypeAliases maps the types registered for
+// extensions to the name http.DetectContentType uses
+var contentTypeAliases = map[string]string{
+	"application/gzip":         "application/x-gzip",
+	"audio/wav":                "audio/wave",
+	"audio/x-wav":              "audio/wave",
+	"audio/ogg":                "application/ogg",
+	"video/x-msvideo":          "video/avi",
+	"image/vnd.microsoft.icon": "image/x-icon",
+}
+
+// sniffableContentTypes are the (non text) types
+// http.DetectContentType recognizes reliably, only
+// files claiming one of them can be checked
+var sniffableContentTypes = map[string]bool{
+	"application/pdf":               true,
+	"application/postscript":        true,
+	"image/x-icon":                  true,
+	"image/bmp":                     true,
+	"image/gif":                     true,
+	"image/webp":                    true,
+	"image/png":                     true,
+	"image/jpeg":                    true,
+	"audio/aiff":                    true,
+	"audio/mpeg":                    true,
+	"application/ogg":               true,
+	"audio/midi":                    true,
+	"video/avi":                     true,
+	"audio/wave":                    true,
+	"video/mp4":                     true,
+	"video/webm":                    true,
+	"font/ttf":                      true,
+	"font/otf":                      true,
+	"font/collection":               true,
+	"font/woff":                     true,
+	"font/woff2":                    true,
+	"application/x-gzip":            true,
+	"application/zip":               true,
+	"application/x-rar-compressed":  true,
+	"application/wasm":              true,
+	"application/vnd.ms-fontobject": true,
+}
+
+// sniffLen is how many leading bytes of a file are
+// looked at to detect its content type
+const sniffLen = 512
+
+// genericContentType is what sniffing yields when it
+// can't tell what the content is
+const genericContentType = "application/octet-stream"
+
+// contentType returns the Content-Type to serve a file
+// with, from (in order) the configured extension overrides,
+// the extension's registered type, sniffing the file's
+// first bytes and finally the configured default
+func (s *FileService) contentType(name string, head []byte) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext != "" {
+		if contentType, found := s.ContentTypes[ext]; found {
+			return contentType
+		}
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+
+	contentType := http.DetectContentType(head)
+	if contentType == genericContentType && s.DefaultContentType != "" {
+		return s.DefaultContentType
+	}
+	return contentType
+}
+
+// untrustedContentHeaders are set on downloads of
+// untrusted content so browsers neither render it inline
+// nor run anything in it, whatever its type
+var untrustedContentHeaders = map[string]string{
+	"Content-Disposition":     "attachment",
+	"X-Content-Type-Options":  "nosniff",
+	"Content-Security-Policy": "default-src 'none'; sandbox",
+}
+
+// untrustedContent reports whether the file should be
+// served as untrusted content, either because all files are
+// or because of its extension (e.g. HTML or SVG, which
+// could carry scripts)
+func (s *FileService) untrustedContent(name string) bool {
+	if s.UntrustedContent {
+		return true
+	}
+	return slices.Contains(s.UntrustedExtensions, strings.ToLower(filepath.Ext(name)))
+}
+
+// setUntrustedContentHeaders sets the headers of
+// untrustedContentHeaders, keeping the file name of an
+// existing Content-Disposition
+func setUntrustedContentHeaders(header http.Header) {
+	for key, value := range untrustedContentHeaders {
+		if key == "Content-Disposition" && strings.HasPrefix(header.Get(key), value) {
+			continue
+		}
+		header.Set(key, value)
+	}
+}
+
+// baseContentType returns the media type without
+// parameters, using the sniffer's name for aliases
+func baseContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	if alias, found := contentTypeAliases[mediaType]; found {
+		return alias
+	}
+	return mediaType
+}
+
+// checkContent applies ContentCheck to an upload starting
+// with head, returning ErrContentMismatch when it rejects
+// the upload
+func (s *FileService) checkContent(name string, head []byte) error {
+	err := s.checkContentMagic(name, head)
+	if err == nil {
+		return nil
+	}
+	if s.ContentCheck == ContentCheckReject {
+		log.Error().Err(err).Msg("Upload content does not match its extension. Skipping.")
+		return withKind(ErrContentMismatch, err)
+	}
+	log.Warn().Err(err).
+		Str("fileName", name).
+		Msg("Upload content does not match its extension")
+	return nil
+}
+
+// checkContentFile applies ContentCheck to the file
+// assembled at path
+func (s *FileService) checkContentFile(name, path string) error {
+	if s.ContentCheck == ContentCheckOff {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+	return s.checkContent(name, head[:n])
+}
+
+// checkContentMagic compares the type sniffed from the
+// first bytes of an upload to the type its extension
+// claims (e.g. a ".jpg" that is actually an executable)
+// Extensions whose type can't be sniffed reliably pass
+func (s *FileService) checkContentMagic(name string, head []byte) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return nil
+	}
+	claimed := s.ContentTypes[ext]
+	if claimed == "" {
+		claimed = mime.TypeByExtension(ext)
+	}
+	claimed = baseContentType(claimed)
+	if !sniffableContentTypes[claimed] {
+		return nil
+	}
+
+	detected := baseContentType(http.DetectContentType(head))
+	if detected != claimed {
+		return fmt.Errorf("content looks like %s, not the %s its extension claims", detected, claimed)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestContentCheck(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+	pdf := "%PDF-1.7\n" + strings.Repeat("x", 32)
+	exe := "MZ\x90\x00" + strings.Repeat("\x00", 32)
+
+	tests := []struct {
+		mode    string
+		name    string
+		content string
+		want    int
+	}{
+		{ContentCheckReject, "image.png", png, http.StatusCreated},
+		{ContentCheckReject, "doc.pdf", pdf, http.StatusCreated},
+		{ContentCheckReject, "image.png", pdf, http.StatusUnsupportedMediaType},
+		{ContentCheckReject, "image.jpg", exe, http.StatusUnsupportedMediaType},
+		// Text types can't be sniffed reliably, they pass
+		{ContentCheckReject, "notes.txt", png, http.StatusCreated},
+		{ContentCheckReject, "noext", exe, http.StatusCreated},
+		{ContentCheckWarn, "image.png", pdf, http.StatusCreated},
+		{ContentCheckOff, "image.jpg", exe, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) { s.ContentCheck = tt.mode })
+
+		resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/"+tt.name, strings.NewReader(tt.content), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: upload of %s got %d (%s), want %d", tt.mode, tt.name, resp.StatusCode, body, tt.want)
+		}
+
+		// Resumable uploads are checked once assembled
+		half := len(tt.content) / 2
+		name := "parts-" + tt.name
+		for _, part := range [][2]int{{0, half}, {half, len(tt.content)}} {
+			header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", part[0], part[1]-1, len(tt.content))}}
+			resp, body = doRequest(t, http.MethodPut, srv.URL+"/upload/"+name, strings.NewReader(tt.content[part[0]:part[1]]), header)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: range upload of %s got %d (%s), want %d", tt.mode, name, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	binary := "\x00\x01\x02\x03"
+	tests := []struct {
+		defaultType string
+		name        string
+		content     string
+		want        string
+	}{
+		{"application/x-custom", "noext", binary, "application/x-custom"},
+		{"", "noext", binary, genericContentType},
+		// Sniffed and registered types win over the default
+		{"application/x-custom", "notes", "plain text", "text/plain; charset=utf-8"},
+		{"application/x-custom", "data.json", binary, "application/json"},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) { s.DefaultContentType = tt.defaultType })
+		uploadFile(t, srv, tt.name, tt.content)
+
+		resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, nil)
+		if got := resp.Header.Get("Content-Type"); got != tt.want {
+			t.Errorf("%s with default %q: Content-Type %q, want %q", tt.name, tt.defaultType, got, tt.want)
+		}
+	}
+}
+
+func TestUntrustedContentHeaders(t *testing.T) {
+	tests := []struct {
+		untrustedAll bool
+		name         string
+		want         bool
+	}{
+		{false, "page.html", true},
+		{false, "PAGE.HTM", true},
+		{false, "image.svg", true},
+		{false, "app.js", true},
+		{false, "notes.txt", false},
+		{true, "notes.txt", true},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) { s.UntrustedContent = tt.untrustedAll })
+		uploadFile(t, srv, tt.name, "<html><script>alert(1)</script></html>")
+
+		resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, nil)
+		for key, value := range untrustedContentHeaders {
+			got := resp.Header.Get(key)
+			if key == "Content-Disposition" {
+				// The file name is kept, served as an attachment
+				if got != "attachment; filename="+tt.name {
+					t.Errorf("%s: Content-Disposition %q, want an attachment named after the file", tt.name, got)
+				}
+				continue
+			}
+			if tt.want && got != value {
+				t.Errorf("%s: %s %q, want %q", tt.name, key, got, value)
+			}
+			if !tt.want && got != "" {
+				t.Errorf("%s: %s %q on trusted content", tt.name, key, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"syscall"
+)
+
+// copyBufferSize is the size of the chunks copied at a
+// time, the same 32KB buffer io.Copy allocates by default
+const copyBufferSize = 32 << 10
+
+// copyWithContext copies from src to dst like io.Copy, but
+// checks ctx between chunks so the copy stops promptly
+// once the request is cancelled (e.g. the client went away)
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var written int64
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		nr, readErr := src.Read(buf)
+		if nr > 0 {
+			nw, writeErr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if writeErr != nil {
+				return written, &writeError{writeErr}
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// writeError wraps an error returned by the destination
+// of a copy, so callers can tell it apart from read errors
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+func (e *writeError) Unwrap() error { return e.err }
+
+// isWriteError reports whether err came from the
+// destination of a copy
+func isWriteError(err error) bool {
+	var we *writeError
+	return errors.As(err, &we)
+}
+
+// isAborted reports whether err is the result of the
+// request being cancelled rather than a real failure
+func isAborted(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isDiskFull reports whether err is the result of the
+// storage running out of space
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,66 @@
+package fileserver
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fullDiskWriter accepts room bytes, then fails every write
+// with ENOSPC like a full disk
+type fullDiskWriter struct {
+	room int
+}
+
+func (w *fullDiskWriter) Write(p []byte) (int, error) {
+	if len(p) > w.room {
+		n := w.room
+		w.room = 0
+		return n, &fs.PathError{Op: "write", Path: "/data/file", Err: syscall.ENOSPC}
+	}
+	w.room -= len(p)
+	return len(p), nil
+}
+
+func TestCopyDiskFull(t *testing.T) {
+	s, _ := newTestService(t)
+
+	tests := []struct {
+		desc        string
+		room        int
+		size        int
+		wantErr     bool
+		wantWritten int64
+	}{
+		{"fits", 100 << 10, 64 << 10, false, 64 << 10},
+		{"full from the start", 0, 64 << 10, true, 0},
+		{"full mid copy", 40 << 10, 64 << 10, true, 40 << 10},
+	}
+	for _, tt := range tests {
+		written, err := copyWithContext(context.Background(), &fullDiskWriter{room: tt.room}, strings.NewReader(strings.Repeat("x", tt.size)))
+		if written != tt.wantWritten {
+			t.Errorf("%s: wrote %d bytes, want %d", tt.desc, written, tt.wantWritten)
+		}
+		if !tt.wantErr {
+			if err != nil {
+				t.Errorf("%s: copy failed: %v", tt.desc, err)
+			}
+			continue
+		}
+		if !isWriteError(err) || !isDiskFull(err) {
+			t.Errorf("%s: copy returned %v, want a disk full write error", tt.desc, err)
+		}
+
+		// Uploads failing so are reported as a 507, which
+		// clients can retry once space is freed
+		rec := httptest.NewRecorder()
+		s.writeError(rec, withKind(ErrStorageFull, err))
+		if rec.Code != http.StatusInsufficientStorage {
+			t.Errorf("%s: responded %d (%s), want %d", tt.desc, rec.Code, rec.Body, http.StatusInsufficientStorage)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// downloadDataURL sends a small file as a data URI, e.g.
+// data:image/png;base64,iVBORw0..., for clients to embed
+// it in HTML or CSS as is
+func (s *FileService) downloadDataURL(w http.ResponseWriter, r *http.Request, fileName string) {
+	if s.DataURLMaxSize <= 0 {
+		log.Info().Msg("Rejecting data URL, data URLs are disabled")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Data URLs are disabled on this server"))
+		return
+	}
+
+	file, err := s.Open(fileName)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	if file.Size > s.DataURLMaxSize {
+		log.Info().
+			Str("fileName", file.Name).
+			Int64("size", file.Size).
+			Msg("Rejecting data URL of a file over the maximum size")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("File exceeds the maximum data URL size of %d bytes", s.DataURLMaxSize)))
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(file, s.DataURLMaxSize))
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to read file on the server.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception in processing the download"))
+		return
+	}
+
+	var dataURL strings.Builder
+	dataURL.WriteString("data:")
+	dataURL.WriteString(s.contentType(file.Name, content[:min(len(content), sniffLen)]))
+	dataURL.WriteString(";base64,")
+	dataURL.WriteString(base64.StdEncoding.EncodeToString(content))
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("ETag", strings.TrimSuffix(file.etag(), `"`)+`-dataurl"`)
+	http.ServeContent(w, r, file.Name, file.UploadedAt, bytes.NewReader([]byte(dataURL.String())))
+}
@@ -0,0 +1,65 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDataURL(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(1, 1, color.RGBA{R: 255, A: 255})
+	var icon bytes.Buffer
+	if err := png.Encode(&icon, img); err != nil {
+		t.Fatal(err)
+	}
+
+	_, srv := newTestService(t, func(s *FileService) { s.DataURLMaxSize = 1 << 10 })
+	uploadFile(t, srv, "icon.png", icon.String())
+	uploadFile(t, srv, "large.png", icon.String()+strings.Repeat("\x00", 1<<10))
+
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/icon.png?encoding=dataurl", nil, nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf("data URL got %d with Content-Type %q (%s)", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+	encoded, found := strings.CutPrefix(body, "data:image/png;base64,")
+	if !found {
+		t.Fatalf("got %q, want a base64 PNG data URI", body)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatalf("data URI isn't base64: %v", err)
+	}
+	if !bytes.Equal(decoded, icon.Bytes()) {
+		t.Errorf("data URI decodes to %d bytes, want the %d of the PNG", len(decoded), icon.Len())
+	}
+	if decodedImg, err := png.Decode(bytes.NewReader(decoded)); err != nil || decodedImg.Bounds() != img.Bounds() {
+		t.Errorf("data URI isn't the PNG: %v", err)
+	}
+
+	tests := []struct {
+		desc string
+		url  string
+		want int
+	}{
+		{"over the size limit", srv.URL + "/download/large.png?encoding=dataurl", http.StatusRequestEntityTooLarge},
+		{"missing", srv.URL + "/download/missing.png?encoding=dataurl", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if resp, body := doRequest(t, http.MethodGet, tt.url, nil, nil); resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	// Data URLs can be turned off
+	_, disabled := newTestService(t, func(s *FileService) { s.DataURLMaxSize = 0 })
+	uploadFile(t, disabled, "icon.png", icon.String())
+	if resp, body := doRequest(t, http.MethodGet, disabled.URL+"/download/icon.png?encoding=dataurl", nil, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("disabled: got %d (%s), want %d", resp.StatusCode, body, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,175 @@
+package fileserver
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// davPrefix is the path WebDAV clients mount the server at
+const davPrefix = "/dav/"
+
+// davAllow lists the methods served under davPrefix
+const davAllow = "OPTIONS, PROPFIND, GET, HEAD, PUT, DELETE"
+
+// davMultistatus is the body of a PROPFIND response
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+// davResponse describes a single resource (the storage
+// dir itself or a file) in a PROPFIND response
+type davResponse struct {
+	Href   string  `xml:"D:href"`
+	Prop   davProp `xml:"D:propstat>D:prop"`
+	Status string  `xml:"D:propstat>D:status"`
+}
+
+// davProp holds the properties reported for a resource
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+}
+
+// davResourceType marks collections, it is left empty
+// for files
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// davHandlers are the handlers of the regular endpoints
+// (wrapped as they are routed) the WebDAV methods map to,
+// so DAV clients are limited, checked and audited alike
+type davHandlers struct {
+	propfind http.Handler
+	download http.Handler
+	upload   http.Handler
+	delete   http.Handler
+}
+
+// dav provides minimal WebDAV compatibility so desktop
+// clients can mount the server and browse it, with GET,
+// PUT and DELETE mapped to the download, upload and
+// delete endpoints
+// Names are listed flat (a name may contain slashes), so
+// the only collection is the root and MKCOL is not allowed
+func (s *FileService) dav(w http.ResponseWriter, r *http.Request) {
+	fileName := strings.TrimPrefix(r.URL.Path, davPrefix)
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", davAllow)
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		s.davHandlers.propfind.ServeHTTP(w, r)
+	case http.MethodGet, http.MethodHead:
+		s.davHandlers.download.ServeHTTP(w, davRewrite(r, "/download/"+fileName))
+	case http.MethodPut:
+		s.davHandlers.upload.ServeHTTP(w, davRewrite(r, "/upload/"+fileName))
+	case http.MethodDelete:
+		s.davHandlers.delete.ServeHTTP(w, davRewrite(r, "/delete/"+fileName))
+	default:
+		log.Info().
+			Str("method", r.Method).
+			Msg("Unsupported WebDAV method")
+		w.Header().Set("Allow", davAllow)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not supported by the WebDAV endpoint"))
+	}
+}
+
+// davRewrite returns a copy of the request for the
+// endpoint at path, so the WebDAV methods share the
+// handlers of the regular endpoints
+func davRewrite(r *http.Request, path string) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// davPropfind lists the properties of the storage dir
+// (and, unless Depth is 0, of every file in it) or of a
+// single file
+func (s *FileService) davPropfind(w http.ResponseWriter, r *http.Request) {
+	fileName := strings.TrimPrefix(r.URL.Path, davPrefix)
+	log.Debug().
+		Str("fileName", fileName).
+		Str("depth", r.Header.Get("Depth")).
+		Msg("Processing PROPFIND")
+
+	var responses []davResponse
+	if fileName == "" {
+		responses = append(responses, davResponse{
+			Href: davPrefix,
+			Prop: davProp{
+				DisplayName:  "/",
+				ResourceType: davResourceType{Collection: &struct{}{}},
+			},
+			Status: "HTTP/1.1 200 OK",
+		})
+
+		// Listing the files reveals their names
+		if r.Header.Get("Depth") != "0" && !s.DisableList {
+			for _, name := range s.fileList().names {
+				if response, ok := s.davFileResponse(name); ok {
+					responses = append(responses, response)
+				}
+			}
+		}
+	} else {
+		response, ok := s.davFileResponse(fileName)
+		if !ok {
+			log.Debug().
+				Msg("No such file found")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("No such file"))
+			return
+		}
+		responses = append(responses, response)
+	}
+
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(davMultistatus{
+		Namespace: "DAV:",
+		Responses: responses,
+	})
+}
+
+// davFileResponse returns the PROPFIND response of the
+// file name, false if it isn't stored
+func (s *FileService) davFileResponse(name string) (davResponse, bool) {
+	name = s.resolveName(name)
+	fileObj, found := s.lookup(name)
+	if !found {
+		return davResponse{}, false
+	}
+	fi, err := os.Stat(fileObj.Path)
+	if err != nil {
+		log.Error().Err(err).Str("fileName", name).Msg("Unable to validate file on disk")
+		return davResponse{}, false
+	}
+
+	size := s.plainSize(fi.Size())
+	return davResponse{
+		Href: davPrefix + url.PathEscape(name),
+		Prop: davProp{
+			DisplayName:   name,
+			ContentLength: &size,
+			LastModified:  fi.ModTime().UTC().Format(http.TimeFormat),
+		},
+		Status: "HTTP/1.1 200 OK",
+	}, true
+}
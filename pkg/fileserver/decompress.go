@@ -0,0 +1,59 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+)
+
+// gzipMagic are the first bytes of a gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip reports whether the content starting with head
+// is gzip compressed
+func isGzip(head []byte) bool {
+	return bytes.HasPrefix(head, gzipMagic)
+}
+
+// gzipReader decompresses a gzip stream
+type gzipReader struct {
+	*bufio.Reader
+	gz *gzip.Reader
+}
+
+// Close releases the decompressor
+func (g *gzipReader) Close() error {
+	return g.gz.Close()
+}
+
+// newGzipReader returns a reader decompressing r along
+// with the first decompressed bytes (to sniff the content
+// type from), failing early if the stream is corrupt at
+// its start
+func newGzipReader(r io.Reader) (io.ReadCloser, []byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	decompressed := bufio.NewReaderSize(gz, sniffLen)
+	head, err := decompressed.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		gz.Close()
+		return nil, nil, err
+	}
+	return &gzipReader{Reader: decompressed, gz: gz}, head, nil
+}
+
+// decompressedName returns the name of a gzip file once
+// decompressed, e.g. "app.log.gz" becomes "app.log"
+func decompressedName(name string) string {
+	for _, ext := range []string{".gz", ".gzip"} {
+		if trimmed, found := strings.CutSuffix(name, ext); found && trimmed != "" {
+			return trimmed
+		}
+	}
+	return name
+}
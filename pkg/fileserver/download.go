@@ -0,0 +1,138 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// errSliceOutOfRange is returned for an ?offset= and
+// ?length= slice that doesn't fit in the file
+var errSliceOutOfRange = errors.New("slice is beyond the end of the file")
+
+// parseSlice returns the slice of a file of size bytes the
+// ?offset= and ?length= params ask for, the length defaults
+// to the rest of the file. sliced is false without either
+func parseSlice(query url.Values, size int64) (offset, length int64, sliced bool, err error) {
+	if !query.Has("offset") && !query.Has("length") {
+		return 0, 0, false, nil
+	}
+	if query.Has("offset") {
+		if offset, err = strconv.ParseInt(query.Get("offset"), 10, 64); err != nil || offset < 0 {
+			return 0, 0, true, fmt.Errorf("invalid offset %q", query.Get("offset"))
+		}
+	}
+	if offset > size {
+		return 0, 0, true, errSliceOutOfRange
+	}
+	length = size - offset
+	if query.Has("length") {
+		if length, err = strconv.ParseInt(query.Get("length"), 10, 64); err != nil || length < 0 {
+			return 0, 0, true, fmt.Errorf("invalid length %q", query.Get("length"))
+		}
+	}
+	if length > size-offset {
+		return 0, 0, true, errSliceOutOfRange
+	}
+	return offset, length, true, nil
+}
+
+// etag returns the ETag of the file, its SHA-256 checksum
+// when it has one, otherwise derived from its size and
+// upload time
+func (f *File) etag() string {
+	if sum, found := f.Checksums[ChecksumSHA256]; found {
+		return `"` + sum + `"`
+	}
+	return fmt.Sprintf(`"%x-%x"`, f.Size, f.UploadedAt.UnixNano())
+}
+
+// servedWriter records the status and body size of a
+// response written by http.ServeContent
+type servedWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// WriteHeader records the status
+func (w *servedWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the bytes written
+func (w *servedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// contentSHA256Header is the trailer (or header, when
+// trailers can't be sent) with the SHA-256 of the body
+const contentSHA256Header = "X-Content-SHA256"
+
+// canSendTrailers reports whether the response to r can
+// carry trailers, which need a chunked (HTTP/1.1) or
+// HTTP/2 body
+func canSendTrailers(r *http.Request) bool {
+	return r.ProtoAtLeast(1, 1) && r.Method != http.MethodHead
+}
+
+// checksumTrailer computes the SHA-256 of a 200 response
+// body as it is written, to be sent in the trailer once
+// the whole body is
+type checksumTrailer struct {
+	http.ResponseWriter
+	hash        hash.Hash
+	wroteHeader bool
+	trailing    bool
+}
+
+func newChecksumTrailer(w http.ResponseWriter) *checksumTrailer {
+	return &checksumTrailer{ResponseWriter: w, hash: sha256.New()}
+}
+
+// WriteHeader declares the trailer on a 200, the length
+// is dropped since HTTP/1.1 only sends trailers with a
+// chunked body
+func (w *checksumTrailer) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if status == http.StatusOK {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Trailer", contentSHA256Header)
+		w.trailing = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write hashes the bytes written
+func (w *checksumTrailer) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+// finish sets the trailer, only called once the whole
+// body is written so an incomplete body has none
+func (w *checksumTrailer) finish() {
+	if w.trailing {
+		w.Header().Set(contentSHA256Header, hex.EncodeToString(w.hash.Sum(nil)))
+	}
+}
@@ -0,0 +1,228 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIfRange(t *testing.T) {
+	_, srv := newTestService(t)
+	uploadFile(t, srv, "a.txt", "0123456789")
+	resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, nil)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("download has no ETag")
+	}
+
+	// The steps run in order
+	tests := []struct {
+		desc      string
+		overwrite string
+		ifRange   string
+		want      int
+		wantBody  string
+	}{
+		{"unchanged", "", etag, http.StatusPartialContent, "01234"},
+		{"other ETag", "", `"other"`, http.StatusOK, "0123456789"},
+		{"changed", "abcdefghij", etag, http.StatusOK, "abcdefghij"},
+	}
+	for _, tt := range tests {
+		if tt.overwrite != "" {
+			uploadFile(t, srv, "a.txt", tt.overwrite)
+		}
+		header := http.Header{"Range": {"bytes=0-4"}, "If-Range": {tt.ifRange}}
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, header)
+		if resp.StatusCode != tt.want || body != tt.wantBody {
+			t.Errorf("%s: got %d %q, want %d %q", tt.desc, resp.StatusCode, body, tt.want, tt.wantBody)
+		}
+	}
+
+	// The ETag of the new content resumes it
+	resp, _ = doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, nil)
+	header := http.Header{"Range": {"bytes=5-"}, "If-Range": {resp.Header.Get("ETag")}}
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, header)
+	if resp.StatusCode != http.StatusPartialContent || body != "fghij" {
+		t.Errorf("resuming the new content got %d %q, want %d %q", resp.StatusCode, body, http.StatusPartialContent, "fghij")
+	}
+}
+
+func TestDownloadSlice(t *testing.T) {
+	_, srv := newTestService(t)
+	uploadFile(t, srv, "a.txt", "0123456789")
+
+	tests := []struct {
+		query    string
+		want     int
+		wantBody string
+	}{
+		{"?offset=2&length=3", http.StatusOK, "234"},
+		{"?offset=7", http.StatusOK, "789"},
+		{"?length=4", http.StatusOK, "0123"},
+		{"?offset=10", http.StatusOK, ""},
+		{"?offset=0&length=10", http.StatusOK, "0123456789"},
+		{"?offset=11", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"?offset=5&length=6", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"?length=11", http.StatusRequestedRangeNotSatisfiable, ""},
+		{"?offset=-1", http.StatusBadRequest, ""},
+		{"?offset=2&length=x", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt"+tt.query, nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.query, resp.StatusCode, body, tt.want)
+			continue
+		}
+		switch tt.want {
+		case http.StatusOK:
+			if body != tt.wantBody || resp.ContentLength != int64(len(tt.wantBody)) {
+				t.Errorf("%s: got %q with Content-Length %d, want %q", tt.query, body, resp.ContentLength, tt.wantBody)
+			}
+		case http.StatusRequestedRangeNotSatisfiable:
+			if got := resp.Header.Get("Content-Range"); got != "bytes */10" {
+				t.Errorf("%s: Content-Range %q, want %q", tt.query, got, "bytes */10")
+			}
+		}
+	}
+
+	// A slice doesn't consume the file
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt?offset=1&length=2&consume=true", nil, nil)
+	if resp.StatusCode != http.StatusOK || body != "12" {
+		t.Errorf("consuming slice got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "12")
+	}
+	if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("download after a consuming slice got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestChecksumTrailer(t *testing.T) {
+	_, srv := newTestService(t, func(s *FileService) { s.DownloadBufferSize = 0 })
+	content := strings.Repeat("0123456789", 10<<10)
+	uploadFile(t, srv, "a.bin", content)
+	sum := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	tests := []struct {
+		desc        string
+		query       string
+		header      http.Header
+		want        int
+		wantTrailer string
+	}{
+		{"trailer", "?trailer=true", nil, http.StatusOK, sum(content)},
+		{"slice", "?trailer=true&offset=10&length=20", nil, http.StatusOK, sum(content[10:30])},
+		{"range", "?trailer=true", http.Header{"Range": {"bytes=0-9"}}, http.StatusPartialContent, ""},
+		{"no trailer asked for", "", nil, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.bin"+tt.query, nil, tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.desc, resp.StatusCode, tt.want)
+		}
+		if got := resp.Trailer.Get(contentSHA256Header); got != tt.wantTrailer {
+			t.Errorf("%s: trailer %q, want %q", tt.desc, got, tt.wantTrailer)
+		}
+		if tt.wantTrailer != "" && (resp.ContentLength != -1 || sum(body) != tt.wantTrailer) {
+			t.Errorf("%s: body of %d bytes (Content-Length %d) doesn't match its trailer", tt.desc, len(body), resp.ContentLength)
+		}
+	}
+}
+
+func BenchmarkDownloadBuffering(b *testing.B) {
+	sizes := []int{1 << 10, 16 << 10, 64 << 10, 1 << 20}
+	modes := []struct {
+		desc       string
+		bufferSize int64
+	}{
+		{"streamed", 0},
+		{"buffered", 1 << 30},
+	}
+	for _, mode := range modes {
+		_, srv := newTestService(b, func(s *FileService) {
+			s.DownloadBufferSize = mode.bufferSize
+			s.DownloadCacheEntries = 0
+		})
+		for _, size := range sizes {
+			uploadFile(b, srv, fmt.Sprintf("%d.bin", size), strings.Repeat("x", size))
+		}
+		client := srv.Client()
+
+		for _, size := range sizes {
+			b.Run(fmt.Sprintf("%s/size=%dKB", mode.desc, size>>10), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					resp, err := client.Get(fmt.Sprintf("%s/download/%d.bin", srv.URL, size))
+					if err != nil {
+						b.Fatal(err)
+					}
+					n, _ := io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+					if resp.StatusCode != http.StatusOK || n != int64(size) {
+						b.Fatalf("download got %d with %d bytes", resp.StatusCode, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMultipartRanges(t *testing.T) {
+	_, srv := newTestService(t)
+	content := strings.Repeat("0123456789", 10)
+	uploadFile(t, srv, "a.txt", content)
+
+	header := http.Header{"Range": {"bytes=0-4,90-"}}
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, header)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got %d, want %d", resp.StatusCode, http.StatusPartialContent)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		t.Fatalf("Content-Type %q, want multipart/byteranges with a boundary", resp.Header.Get("Content-Type"))
+	}
+
+	want := []struct {
+		contentRange string
+		body         string
+	}{
+		{"bytes 0-4/100", "01234"},
+		{"bytes 90-99/100", "0123456789"},
+	}
+	parts := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for i := 0; ; i++ {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("got %d parts, want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if i >= len(want) {
+			t.Fatalf("got more than %d parts", len(want))
+		}
+		partBody, _ := io.ReadAll(part)
+		if got := part.Header.Get("Content-Range"); got != want[i].contentRange || string(partBody) != want[i].body {
+			t.Errorf("part %d is %q of %q, want %q of %q", i, partBody, got, want[i].body, want[i].contentRange)
+		}
+		if got := part.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+			t.Errorf("part %d: Content-Type %q, want the file's", i, got)
+		}
+	}
+
+	// A single range isn't multipart
+	resp, body = doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, http.Header{"Range": {"bytes=10-14"}})
+	if resp.StatusCode != http.StatusPartialContent || body != "01234" || resp.Header.Get("Content-Range") != "bytes 10-14/100" {
+		t.Errorf("single range got %d %q (%s)", resp.StatusCode, body, resp.Header.Get("Content-Range"))
+	}
+}
@@ -0,0 +1,48 @@
+package fileserver
+
+import (
+	"context"
+	"time"
+)
+
+// downloadSlots returns the semaphore bounding the
+// concurrent downloads of the file to limit, made on
+// first use
+func (f *FileObject) downloadSlots(limit int64) chan struct{} {
+	f.downloadsOnce.Do(func() {
+		f.downloads = make(chan struct{}, limit)
+	})
+	return f.downloads
+}
+
+// acquireDownload takes one of the MaxDownloadsPerFile
+// download slots of the file, returning the func that
+// gives it back. Once all are taken the download waits up
+// to DownloadQueueTimeout for one to free up, false is
+// returned when none did (or the client went away)
+func (s *FileService) acquireDownload(ctx context.Context, fileObj *FileObject) (func(), bool) {
+	if s.MaxDownloadsPerFile <= 0 {
+		return func() {}, true
+	}
+	slots := fileObj.downloadSlots(s.MaxDownloadsPerFile)
+	release := func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if s.DownloadQueueTimeout <= 0 {
+		return nil, false
+	}
+	timer := time.NewTimer(s.DownloadQueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
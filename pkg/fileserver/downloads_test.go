@@ -0,0 +1,55 @@
+package fileserver
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaxDownloadsPerFile(t *testing.T) {
+	tests := []struct {
+		desc         string
+		max          int64
+		queueTimeout time.Duration
+		releaseAfter time.Duration
+		want         int
+	}{
+		{"over the cap", 1, 0, 0, http.StatusServiceUnavailable},
+		{"queue times out", 1, 50 * time.Millisecond, 0, http.StatusServiceUnavailable},
+		{"queued until a slot is free", 1, 5 * time.Second, 50 * time.Millisecond, http.StatusOK},
+		{"under the cap", 2, 0, 0, http.StatusOK},
+		{"no cap", 0, 0, 0, http.StatusOK},
+	}
+	for _, tt := range tests {
+		s, srv := newTestService(t, func(s *FileService) {
+			s.MaxDownloadsPerFile = tt.max
+			s.DownloadQueueTimeout = tt.queueTimeout
+		})
+		uploadFile(t, srv, "popular.txt", "content")
+		uploadFile(t, srv, "other.txt", "content")
+
+		// A download in progress holds a slot of the file
+		fileObj, _ := s.lookup("popular.txt")
+		release, ok := s.acquireDownload(context.Background(), fileObj)
+		if !ok {
+			t.Fatalf("%s: the first download didn't get a slot", tt.desc)
+		}
+		if tt.releaseAfter > 0 {
+			time.AfterFunc(tt.releaseAfter, release)
+		} else {
+			defer release()
+		}
+
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/popular.txt", nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: download got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+
+		// The cap is per file
+		resp, body = doRequest(t, http.MethodGet, srv.URL+"/download/other.txt", nil, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: download of another file got %d (%s), want %d", tt.desc, resp.StatusCode, body, http.StatusOK)
+		}
+	}
+}
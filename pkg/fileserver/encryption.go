@@ -0,0 +1,300 @@
+package fileserver
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Files encrypted at rest are stored as a random nonce
+// followed by the content sealed with AES-GCM in chunks of
+// encryptionChunkSize bytes, so they can be streamed (and
+// read from any offset) without holding the whole file
+// Each chunk's nonce is the file nonce XORed with the chunk
+// number, and the last chunk is sealed with different
+// additional data so a truncated file fails to decrypt
+const (
+	encryptionChunkSize = 64 << 10
+	encryptionNonceSize = 12
+	encryptionTagSize   = 16
+	encryptedChunkSize  = encryptionChunkSize + encryptionTagSize
+)
+
+// errEncryptedFileCorrupt is returned when reading an
+// encrypted file that is truncated or fails to decrypt
+var errEncryptedFileCorrupt = errors.New("encrypted file is corrupt")
+
+// newEncryption returns the AES-GCM cipher for the base64
+// encoded 128, 192 or 256 bit key
+func newEncryption(key string) (cipher.AEAD, error) {
+	rawKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk n of a file
+func chunkNonce(fileNonce []byte, n int64) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	copy(nonce, fileNonce)
+	counter := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(n)
+	binary.BigEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// chunkAdditionalData marks whether a chunk is the last
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plainSize returns the size of the content of a stored
+// file of diskSize bytes
+func (s *FileService) plainSize(diskSize int64) int64 {
+	if s.encryption == nil {
+		return diskSize
+	}
+	sealed := diskSize - encryptionNonceSize
+	if sealed < encryptionTagSize {
+		return 0
+	}
+	chunks := (sealed + encryptedChunkSize - 1) / encryptedChunkSize
+	return sealed - chunks*encryptionTagSize
+}
+
+// nopWriteCloser is a WriteCloser whose Close does nothing
+type nopWriteCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// encryptWriter seals the content written to it in chunks,
+// Close must be called to seal the last one
+type encryptWriter struct {
+	dst   io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	n     int64
+
+	buf    []byte
+	sealed []byte
+}
+
+// newFileWriter returns a writer storing content in f, it
+// is encrypted when encryption at rest is enabled. Closing
+// the writer doesn't close f
+func (s *FileService) newFileWriter(f io.Writer) (io.WriteCloser, error) {
+	if s.encryption == nil {
+		return nopWriteCloser{f}, nil
+	}
+
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(nonce); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		dst:   f,
+		aead:  s.encryption,
+		nonce: nonce,
+		buf:   make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+// Write buffers p, sealing each chunk once it is full
+// and more content follows
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cap(e.buf)], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+// seal writes the buffered chunk to dst encrypted
+func (e *encryptWriter) seal(last bool) error {
+	e.sealed = e.aead.Seal(e.sealed[:0], chunkNonce(e.nonce, e.n), e.buf, chunkAdditionalData(last))
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.dst.Write(e.sealed)
+	return err
+}
+
+// decryptReader reads the content of an encrypted file,
+// decrypting the chunk at the current offset on demand
+type decryptReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	nonce  []byte
+	size   int64
+	chunks int64
+	offset int64
+
+	// chunk is the decrypted content of chunk n
+	n      int64
+	chunk  []byte
+	sealed []byte
+}
+
+// openFile opens a stored file for reading, returning
+// its content (decrypted when encryption at rest is
+// enabled) and size
+func (s *FileService) openFile(path string) (io.ReadSeekCloser, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if s.encryption == nil {
+		return f, fi.Size(), nil
+	}
+
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := f.ReadAt(nonce, 0); err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("%w: %v", errEncryptedFileCorrupt, err)
+	}
+	sealed := fi.Size() - encryptionNonceSize
+	size := s.plainSize(fi.Size())
+	return &decryptReader{
+		f:      f,
+		aead:   s.encryption,
+		nonce:  nonce,
+		size:   size,
+		chunks: (sealed + encryptedChunkSize - 1) / encryptedChunkSize,
+		n:      -1,
+		sealed: make([]byte, encryptedChunkSize),
+	}, size, nil
+}
+
+// Read decrypts the content at the current offset
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		// An empty file still has its (empty) last chunk
+		// to authenticate
+		if d.size == 0 && d.n != 0 {
+			if err := d.decrypt(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+
+	n := d.offset / encryptionChunkSize
+	if n != d.n {
+		if err := d.decrypt(n); err != nil {
+			return 0, err
+		}
+	}
+	copied := copy(p, d.chunk[d.offset%encryptionChunkSize:])
+	d.offset += int64(copied)
+	return copied, nil
+}
+
+// decrypt reads and decrypts the chunk n
+func (d *decryptReader) decrypt(n int64) error {
+	if n >= d.chunks {
+		return errEncryptedFileCorrupt
+	}
+	read, err := d.f.ReadAt(d.sealed, encryptionNonceSize+n*encryptedChunkSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	chunk, err := d.aead.Open(d.chunk[:0], chunkNonce(d.nonce, n), d.sealed[:read], chunkAdditionalData(n == d.chunks-1))
+	if err != nil {
+		d.n = -1
+		return errEncryptedFileCorrupt
+	}
+	d.chunk = chunk
+	d.n = n
+	return nil
+}
+
+// Seek sets the offset in the decrypted content
+func (d *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+// Close closes the underlying file
+func (d *decryptReader) Close() error {
+	return d.f.Close()
+}
+
+// encryptFile writes an encrypted copy of the file at
+// srcPath to a temp file next to it, returning its path
+func (s *FileService) encryptFile(srcPath string) (string, error) {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(srcPath), ".encrypt-*")
+	if err != nil {
+		return "", err
+	}
+	enc, err := s.newFileWriter(dst)
+	if err == nil {
+		if _, err = io.Copy(enc, src); err == nil {
+			err = enc.Close()
+		}
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
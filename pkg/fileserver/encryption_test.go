@@ -0,0 +1,119 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	t.Setenv("FILESERVER_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	s, srv := newTestService(t)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"tiny.txt", 1},
+		{"chunk.bin", encryptionChunkSize},
+		{"chunk-plus-one.bin", encryptionChunkSize + 1},
+		{"chunks.bin", 3*encryptionChunkSize - 100},
+	}
+	for _, tt := range tests {
+		content := strings.Repeat("plaintext!", tt.size/10+1)[:tt.size]
+		uploadFile(t, srv, tt.name, content)
+
+		fileObj, _ := s.lookup(tt.name)
+		stored, err := os.ReadFile(fileObj.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(stored, []byte("plaintext!")) {
+			t.Errorf("%s is stored in plaintext", tt.name)
+		}
+
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, nil)
+		if body != content {
+			t.Errorf("%s: downloaded %d bytes that don't match the %d uploaded", tt.name, len(body), len(content))
+		}
+		if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(tt.size) {
+			t.Errorf("%s: Content-Length %s, want %d", tt.name, got, tt.size)
+		}
+
+		// Ranges are read from the middle of the sealed chunks
+		start, end := tt.size/2, tt.size-1
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}}
+		resp, body = doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, header)
+		if resp.StatusCode != http.StatusPartialContent || body != content[start:end+1] {
+			t.Errorf("%s: range %d-%d got %d with %d bytes, want %d", tt.name, start, end, resp.StatusCode, len(body), end-start+1)
+		}
+	}
+}
+
+// writeHeaderCounter counts the WriteHeader calls reaching
+// the response
+type writeHeaderCounter struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (w *writeHeaderCounter) WriteHeader(status int) {
+	w.calls++
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func (w *writeHeaderCounter) Write(p []byte) (int, error) {
+	if w.calls == 0 {
+		w.calls++
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDownloadErrorAfterPartialWrite(t *testing.T) {
+	t.Setenv("FILESERVER_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	s, srv := newTestService(t, func(s *FileService) { s.DownloadBufferSize = 0 })
+	content := strings.Repeat("plaintext!", 3*encryptionChunkSize/10)
+	uploadFile(t, srv, "a.bin", content)
+
+	// Corrupting the last chunk fails the download once the
+	// first chunks are sent
+	fileObj, _ := s.lookup("a.bin")
+	stored, err := os.ReadFile(fileObj.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored[len(stored)-20] ^= 0xff
+	if err := os.WriteFile(fileObj.Path, stored, 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w := &writeHeaderCounter{ResponseRecorder: httptest.NewRecorder()}
+		s.HTTPServer.Handler.ServeHTTP(w, httptest.NewRequest(method, "/download/a.bin", nil))
+
+		// The status and headers are only written once, for
+		// the whole file
+		if w.calls != 1 || w.Code != http.StatusOK {
+			t.Errorf("%s: status written %d times, last %d, want once with %d", method, w.calls, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(content)) {
+			t.Errorf("%s: Content-Length %q, want %d", method, got, len(content))
+		}
+		if method == http.MethodHead {
+			continue
+		}
+
+		// The body stops short, without an error message
+		// appended to it
+		body := w.Body.String()
+		if len(body) == 0 || len(body) >= len(content) || !strings.HasPrefix(content, body) {
+			t.Errorf("%s: body has %d bytes, want a prefix of the %d bytes of content", method, len(body), len(content))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package fileserver
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxErrorMessage is the most bytes of an error message
+// rendered into an error page
+const maxErrorMessage = 4 << 10
+
+// errorPage is the data error page templates are rendered
+// with, e.g. {{.Status}} {{.StatusText}}: {{.Message}}
+type errorPage struct {
+	Status     int
+	StatusText string
+
+	// Message is the plain text error of the response
+	Message string
+}
+
+// errorPages are the HTML templates of error responses
+type errorPages struct {
+	byStatus map[int]*template.Template
+
+	// fallback renders the statuses without a template of
+	// their own, nil if there is none
+	fallback *template.Template
+}
+
+// loadErrorPages parses the error page template at path,
+// a file used for every error status or a dir of
+// templates named after the status they are used for
+// (e.g. 404.html) along with an optional error.html used
+// for the other statuses
+func loadErrorPages(path string) (*errorPages, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	pages := &errorPages{byStatus: map[int]*template.Template{}}
+	if !fi.IsDir() {
+		if pages.fallback, err = template.ParseFiles(path); err != nil {
+			return nil, err
+		}
+		return pages, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.html"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		tmpl, err := template.ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".html")
+		if name == "error" {
+			pages.fallback = tmpl
+			continue
+		}
+		status, err := strconv.Atoi(name)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("template %q is not named after an error status (e.g. 404.html) or error.html", file)
+		}
+		pages.byStatus[status] = tmpl
+	}
+	if len(pages.byStatus) == 0 && pages.fallback == nil {
+		return nil, fmt.Errorf("no *.html templates in %q", path)
+	}
+	return pages, nil
+}
+
+// template returns the template of the status, nil if
+// there is none
+func (p *errorPages) template(status int) *template.Template {
+	if tmpl, found := p.byStatus[status]; found {
+		return tmpl
+	}
+	return p.fallback
+}
+
+// acceptsHTML reports whether the client asked for HTML,
+// as browsers do (a bare */* doesn't count, API clients
+// like curl send it)
+func acceptsHTML(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml") {
+			return true
+		}
+	}
+	return false
+}
+
+// errorPageWriter holds back the plain text body of an
+// error response, so it can be rendered as an error page
+// once the handler is done
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages   *errorPages
+	status  int
+	tmpl    *template.Template
+	message bytes.Buffer
+}
+
+// WriteHeader holds back an error status with a template
+func (w *errorPageWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if status >= 400 {
+		if w.tmpl = w.pages.template(status); w.tmpl != nil {
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write keeps the message of an error page
+func (w *errorPageWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.tmpl == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	if remaining := maxErrorMessage - w.message.Len(); remaining > 0 {
+		w.message.Write(p[:min(len(p), remaining)])
+	}
+	return len(p), nil
+}
+
+// FlushError flushes the response unless it is an error
+// page, which is only written once it is rendered
+func (w *errorPageWriter) FlushError() error {
+	if w.tmpl != nil {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the ResponseWriter, for
+// http.ResponseController
+func (w *errorPageWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// render writes the error page, if the response is one
+func (w *errorPageWriter) render() {
+	if w.tmpl == nil {
+		return
+	}
+	var page bytes.Buffer
+	err := w.tmpl.Execute(&page, errorPage{
+		Status:     w.status,
+		StatusText: http.StatusText(w.status),
+		Message:    strings.TrimSpace(w.message.String()),
+	})
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	h.Add("Vary", "Accept")
+	if err != nil {
+		log.Error().Err(err).Int("status", w.status).Msg("Unable to render error page")
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(w.message.Bytes())
+		return
+	}
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(page.Bytes())
+}
+
+// withErrorPages renders the error responses to clients
+// asking for HTML with the ErrorTemplates, other clients
+// get them as plain text (or JSON) as before
+func (s *FileService) withErrorPages(h http.Handler) http.Handler {
+	if s.errorPages == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsHTML(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorPageWriter{ResponseWriter: w, pages: s.errorPages}
+		h.ServeHTTP(ew, r)
+		ew.render()
+	})
+}
@@ -0,0 +1,62 @@
+package fileserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	templates := map[string]string{
+		"404.html":   "<h1>Not here: {{.Message}}</h1>",
+		"error.html": "<h1>{{.Status}} {{.StatusText}}</h1>",
+	}
+	for name, content := range templates {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, srv := newTestService(t, func(s *FileService) { s.ErrorTemplates = dir })
+	uploadFile(t, srv, "a.txt", "content")
+
+	tests := []struct {
+		desc     string
+		method   string
+		path     string
+		accept   string
+		want     int
+		wantType string
+		wantBody string
+	}{
+		{"browser 404", http.MethodGet, "/download/missing.txt", "text/html,application/xhtml+xml,*/*;q=0.8", http.StatusNotFound, "text/html; charset=utf-8", "<h1>Not here: "},
+		{"browser other error", http.MethodGet, "/download/a.txt?offset=-1", "text/html", http.StatusBadRequest, "text/html; charset=utf-8", "<h1>400 Bad Request</h1>"},
+		{"API client 404", http.MethodGet, "/download/missing.txt", "*/*", http.StatusNotFound, "text/plain; charset=utf-8", ""},
+		{"browser success", http.MethodGet, "/download/a.txt", "text/html", http.StatusOK, "", "content"},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, nil, http.Header{"Accept": {tt.accept}})
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.desc, resp.StatusCode, tt.want)
+		}
+		if tt.wantType != "" && resp.Header.Get("Content-Type") != tt.wantType {
+			t.Errorf("%s: Content-Type %q, want %q", tt.desc, resp.Header.Get("Content-Type"), tt.wantType)
+		}
+		if !strings.HasPrefix(body, tt.wantBody) {
+			t.Errorf("%s: got %q, want it to start with %q", tt.desc, body, tt.wantBody)
+		}
+		if tt.wantType == "text/plain; charset=utf-8" && strings.Contains(body, "<h1>") {
+			t.Errorf("%s: API client got an error page: %q", tt.desc, body)
+		}
+	}
+
+	// A template that doesn't parse fails at startup
+	if err := os.WriteFile(filepath.Join(dir, "500.html"), []byte("{{.Status"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileService(func(s *FileService) { s.ErrorTemplates = dir }); err == nil {
+		t.Error("NewFileService with a broken template succeeded")
+	}
+}
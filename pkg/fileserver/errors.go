@@ -0,0 +1,149 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Errors returned by the FileService API (e.g. Put, Open
+// and Delete), check for them with errors.Is. The HTTP
+// handlers map them to status codes in writeError
+var (
+	ErrNotFound         = errors.New("no such file")
+	ErrConflict         = errors.New("name conflicts with a stored file")
+	ErrTooLarge         = errors.New("file exceeds the maximum upload size")
+	ErrQuotaExceeded    = errors.New("upload quota exceeded")
+	ErrInvalidName      = errors.New("invalid file name")
+	ErrEmptyFile        = errors.New("file is empty")
+	ErrStorageFull      = errors.New("storage is out of space")
+	ErrContentMismatch  = errors.New("content does not match its extension")
+	ErrChecksumMismatch = errors.New("content does not match its checksum")
+	ErrInfected         = errors.New("file is infected")
+	ErrExpired          = errors.New("file has expired")
+)
+
+// errFileBusy is returned when storing a file that another
+// request is transferring while FailFastWrites is set
+var errFileBusy = fmt.Errorf("%w: file is busy", ErrConflict)
+
+// errAppendOnlyExists is returned when storing a file that
+// is already stored while AppendOnly is set
+var errAppendOnlyExists = fmt.Errorf("%w: file exists and the server is append-only", ErrConflict)
+
+// errAppendOnly is returned when deleting a file while
+// AppendOnly is set
+var errAppendOnly = errors.New("server is append-only")
+
+// kindError tags an error with one of the Err* kinds while
+// keeping its message
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// withKind tags err with the kind, so errors.Is matches
+// both
+func withKind(kind, err error) error {
+	return &kindError{kind: kind, err: err}
+}
+
+// serverError is an unexpected failure, msg is what the
+// client is told went wrong
+type serverError struct {
+	msg string
+	err error
+}
+
+func (e *serverError) Error() string { return e.err.Error() }
+func (e *serverError) Unwrap() error { return e.err }
+
+// newServerError wraps err with the message for the client
+func newServerError(msg string, err error) error {
+	return &serverError{msg: msg, err: err}
+}
+
+// writeError writes the response for an error returned by
+// the FileService API, errors are logged where they occur
+// Nothing is written when the client went away
+func (s *FileService) writeError(w http.ResponseWriter, err error) {
+	var srvErr *serverError
+	switch {
+	case isAborted(err):
+	case errors.Is(err, errNoBackup):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No backup of the file to roll back to"))
+	case errors.Is(err, errNoRevision):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such revision of the file"))
+	case errors.Is(err, ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such file"))
+	case errors.Is(err, errMissingNamePrefix):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Please provide a file name starting with %s (or upload with ?autoprefix=true)", s.RequiredNamePrefix)))
+	case errors.Is(err, ErrInvalidName):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a valid file name."))
+	case errors.Is(err, ErrEmptyFile):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please upload a non-empty file."))
+	case errors.Is(err, errFileBusy):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("File is being transferred by another request, please try again later"))
+	case errors.Is(err, ErrExpired):
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte("File has expired"))
+	case errors.Is(err, errAppendOnlyExists):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("File already exists, the server is append-only so it can't be overwritten"))
+	case errors.Is(err, errAppendOnly):
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Server is append-only, files can't be modified or deleted"))
+	case errors.Is(err, ErrConflict):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("Upload rejected, file names are case-insensitive (%v)", err)))
+	case errors.Is(err, errUploadTooSlow):
+		// The rest of the body isn't read
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusRequestTimeout)
+		w.Write([]byte(fmt.Sprintf("Upload is too slow, it must average at least %d bytes per second", s.MinUploadRate)))
+	case errors.Is(err, ErrTooLarge):
+		var sizeErr *uploadSizeError
+		if !errors.As(err, &sizeErr) {
+			sizeErr = &uploadSizeError{limit: s.MaxUploadSize}
+		}
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(sizeErr.message()))
+	case errors.Is(err, errTooManyInFlight):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Server is busy with other uploads, please try again later"))
+	case errors.Is(err, ErrQuotaExceeded):
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Upload quota exceeded, please try again later"))
+	case errors.Is(err, ErrContentMismatch):
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		w.Write([]byte(fmt.Sprintf("Upload rejected (%v)", err)))
+	case errors.Is(err, ErrInfected):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(fmt.Sprintf("Upload rejected (%v)", err)))
+	case errors.Is(err, ErrChecksumMismatch):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Upload failed validation (%v)", err)))
+	case errors.Is(err, ErrStorageFull):
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte("Server is out of storage space, please try again later"))
+	case errors.As(err, &srvErr):
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(srvErr.msg))
+	default:
+		log.Error().Err(err).Msg("Unexpected error")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception processing the request"))
+	}
+}
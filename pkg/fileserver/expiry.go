@@ -0,0 +1,202 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Headers clients set the expiry of an upload with, an
+// RFC 3339 time or a duration from now (e.g. "1h30m")
+const (
+	expiresAtHeader = "X-Expires-At"
+	expiresInHeader = "X-Expires-In"
+)
+
+// ExpiresAtMetadataKey is the custom metadata key the
+// expiry of a file is kept under, as an RFC 3339 time
+const ExpiresAtMetadataKey = "expires-at"
+
+// parseExpiry adds the expiry set with X-Expires-At or
+// X-Expires-In (or X-Meta-Expires-At) to the metadata of an
+// upload, normalized to UTC
+func parseExpiry(h http.Header, metadata map[string]string) (map[string]string, error) {
+	var expiresAt time.Time
+	switch {
+	case h.Get(expiresAtHeader) != "":
+		t, err := time.Parse(time.RFC3339, h.Get(expiresAtHeader))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s, expected an RFC 3339 time (%v)", expiresAtHeader, err)
+		}
+		expiresAt = t
+	case h.Get(expiresInHeader) != "":
+		d, err := time.ParseDuration(h.Get(expiresInHeader))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid %s %q, expected a positive duration", expiresInHeader, h.Get(expiresInHeader))
+		}
+		expiresAt = time.Now().Add(d)
+	default:
+		value, found := metadata[ExpiresAtMetadataKey]
+		if !found {
+			return metadata, nil
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s metadata, expected an RFC 3339 time (%v)", ExpiresAtMetadataKey, err)
+		}
+		expiresAt = t
+	}
+
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	metadata[ExpiresAtMetadataKey] = expiresAt.UTC().Format(time.RFC3339)
+	return metadata, nil
+}
+
+// expiresAt returns the expiry the file was uploaded
+// with, false if it has none
+func (f *FileObject) expiresAt() (time.Time, bool) {
+	f.attrMu.RLock()
+	value, found := f.Metadata[ExpiresAtMetadataKey]
+	f.attrMu.RUnlock()
+	if !found {
+		return time.Time{}, false
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	return expiresAt, err == nil
+}
+
+// expired reports whether the file is past the expiry it
+// was uploaded with, if any
+func (f *FileObject) expired(now time.Time) bool {
+	expiresAt, found := f.expiresAt()
+	return found && !now.Before(expiresAt)
+}
+
+// expiryDir returns the dir the expiries of the files are
+// kept in, as the rest of their metadata only lives in
+// memory the expiries would be lost on a restart
+func (s *FileService) expiryDir() string {
+	return filepath.Join(s.StoragePath, internalDir, "expiry")
+}
+
+// expiryPath returns the path the expiry of the file name
+// is kept at
+func (s *FileService) expiryPath(name string) string {
+	return filepath.Join(s.expiryDir(), url.QueryEscape(name))
+}
+
+// saveExpiry keeps the expiry in the metadata of the file
+// name on disk, or removes the one kept when it has none
+func (s *FileService) saveExpiry(name string, metadata map[string]string) {
+	value, found := metadata[ExpiresAtMetadataKey]
+	if !found {
+		if err := os.Remove(s.expiryPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Err(err).Str("fileName", name).Msg("Unable to remove the expiry of the file")
+		}
+		return
+	}
+	err := os.MkdirAll(s.expiryDir(), 0774)
+	if err == nil {
+		err = os.WriteFile(s.expiryPath(name), []byte(value), 0664)
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("fileName", name).Msg("Unable to keep the expiry of the file, it is lost on a restart")
+	}
+}
+
+// readExpiry returns the metadata holding the expiry kept
+// for the file name, nil when it has none
+func (s *FileService) readExpiry(name string) map[string]string {
+	value, err := os.ReadFile(s.expiryPath(name))
+	if err != nil {
+		return nil
+	}
+	return map[string]string{ExpiresAtMetadataKey: string(value)}
+}
+
+// restoreExpiries sets the expiries kept on disk on the
+// files found at startup, the caller must hold DBMu (or
+// not have started serving). The expiries of files that
+// are gone are removed, unless files are lazily loaded
+func (s *FileService) restoreExpiries() {
+	entries, err := os.ReadDir(s.expiryDir())
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn().Err(err).Msg("Unable to read the expiries of the files")
+		}
+		return
+	}
+	for _, entry := range entries {
+		name, err := url.QueryUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		fileObj, found := s.DB[name]
+		if !found {
+			if !s.LazyLoad {
+				os.Remove(filepath.Join(s.expiryDir(), entry.Name()))
+			}
+			continue
+		}
+		fileObj.attrMu.Lock()
+		fileObj.Metadata = s.readExpiry(name)
+		fileObj.attrMu.Unlock()
+	}
+}
+
+// sweepExpired deletes the files past their expiry
+func (s *FileService) sweepExpired() {
+	now := time.Now()
+	var expired []string
+	s.DBMu.RLock()
+	for name, fileObj := range s.DB {
+		if fileObj.expired(now) {
+			expired = append(expired, name)
+		}
+	}
+	s.DBMu.RUnlock()
+
+	for _, name := range expired {
+		fileObj, found := s.lookup(name)
+		if !found {
+			continue
+		}
+
+		// Waits for transfers of the file, which may have
+		// replaced it with one that hasn't expired
+		fileObj.Mu.Lock()
+		if current, stillFound := s.lookup(name); stillFound && current == fileObj && fileObj.expired(now) {
+			if err := s.removeFile(name, fileObj); err != nil {
+				log.Error().Err(err).Str("fileName", name).Msg("Unable to delete expired file")
+			} else {
+				log.Info().Str("fileName", name).Msg("Deleted expired file")
+			}
+		}
+		fileObj.Mu.Unlock()
+	}
+}
+
+// sweepExpiredFiles calls sweepExpired every
+// ExpirySweepInterval until the service is stopped
+func (s *FileService) sweepExpiredFiles() {
+	ticker := time.NewTicker(s.ExpirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sweepExpired()
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package fileserver
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPerFileExpiry(t *testing.T) {
+	// The sweeper isn't started with the test service, the
+	// sweep is run by hand as the next tick would, long
+	// after the file expired
+	s, srv := newTestService(t, func(s *FileService) { s.ExpirySweepInterval = time.Hour })
+	uploadFile(t, srv, "kept.txt", "content")
+
+	header := http.Header{"X-Expires-In": {"2s"}}
+	resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/temp.txt", strings.NewReader("content"), header)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload with an expiry got %d (%s)", resp.StatusCode, body)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/temp.txt", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("download before the expiry got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	fileObj, found := s.lookup("temp.txt")
+	if !found {
+		t.Fatal("temp.txt isn't in the DB")
+	}
+
+	// Expired but not swept yet
+	deadline := time.Now().Add(5 * time.Second)
+	for resp.StatusCode != http.StatusGone && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		resp, body = doRequest(t, http.MethodGet, srv.URL+"/download/temp.txt", nil, nil)
+	}
+	if resp.StatusCode != http.StatusGone {
+		t.Fatalf("download after the expiry got %d (%s), want %d", resp.StatusCode, body, http.StatusGone)
+	}
+	if _, err := os.Stat(fileObj.Path); err != nil {
+		t.Errorf("expired file was removed before the sweep: %v", err)
+	}
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil); body != "kept.txt" {
+		t.Errorf("list got %q, want the expired file left out", body)
+	}
+
+	s.sweepExpired()
+	if _, found := s.lookup("temp.txt"); found {
+		t.Error("expired file is still in the DB after the sweep")
+	}
+	if _, err := os.Stat(fileObj.Path); !os.IsNotExist(err) {
+		t.Errorf("expired file is still on disk after the sweep: %v", err)
+	}
+	if _, err := os.Stat(s.expiryPath("temp.txt")); !os.IsNotExist(err) {
+		t.Errorf("expiry of the swept file is still kept: %v", err)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/temp.txt", nil, nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("download after the sweep got %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+	if resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/kept.txt", nil, nil); resp.StatusCode != http.StatusOK || body != "content" {
+		t.Errorf("file without an expiry got %d %q after the sweep", resp.StatusCode, body)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		header  http.Header
+		want    string
+		wantErr bool
+	}{
+		{http.Header{"X-Expires-At": {"2030-01-02T03:04:05+02:00"}}, "2030-01-02T01:04:05Z", false},
+		{http.Header{"X-Meta-Expires-At": {"2030-01-02T03:04:05Z"}}, "2030-01-02T03:04:05Z", false},
+		{http.Header{"X-Expires-At": {"tomorrow"}}, "", true},
+		{http.Header{"X-Expires-In": {"-1h"}}, "", true},
+		{http.Header{"X-Expires-In": {"soon"}}, "", true},
+		{http.Header{}, "", false},
+	}
+	for _, tt := range tests {
+		metadata, err := parseMetadata(tt.header)
+		if err == nil {
+			metadata, err = parseExpiry(tt.header, metadata)
+		}
+		if (err != nil) != tt.wantErr || metadata[ExpiresAtMetadataKey] != tt.want {
+			t.Errorf("%v: got %q (%v), want %q", tt.header, metadata[ExpiresAtMetadataKey], err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package fileserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// atomFeed is the Atom (RFC 4287) document served by /feed
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Summary string   `xml:"summary"`
+}
+
+// feedFile is a file listed in the feed
+type feedFile struct {
+	name       string
+	size       int64
+	uploadedAt time.Time
+}
+
+// recentFiles returns the n most recently uploaded files,
+// newest first, leaving out the expired ones
+func (s *FileService) recentFiles(n int) []feedFile {
+	now := time.Now()
+	s.DBMu.RLock()
+	files := make([]feedFile, 0, len(s.DB))
+	for name, fileObj := range s.DB {
+		if fileObj.expired(now) {
+			continue
+		}
+		fileObj.attrMu.RLock()
+		files = append(files, feedFile{
+			name:       name,
+			size:       fileObj.Size,
+			uploadedAt: fileObj.UploadedAt,
+		})
+		fileObj.attrMu.RUnlock()
+	}
+	s.DBMu.RUnlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].uploadedAt.Equal(files[j].uploadedAt) {
+			return files[i].uploadedAt.After(files[j].uploadedAt)
+		}
+		return files[i].name < files[j].name
+	})
+	if len(files) > n {
+		files = files[:n]
+	}
+	return files
+}
+
+// feed serves the most recently uploaded files as an Atom
+// feed, each entry linking to the file's download URL
+func (s *FileService) feed(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("Processing feed")
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := scheme + "://" + r.Host
+	files := s.recentFiles(int(s.FeedEntries))
+
+	// An empty feed was last updated when it was served
+	updated := time.Now()
+	if len(files) > 0 {
+		updated = files[0].uploadedAt
+	}
+	feed := atomFeed{
+		Title:   "Recently uploaded files",
+		ID:      base + "/feed",
+		Updated: updated.UTC().Format(time.RFC3339),
+		Link:    atomLink{Href: base + "/feed", Rel: "self"},
+		Author:  atomAuthor{Name: "file-server-go"},
+		Entries: make([]atomEntry, 0, len(files)),
+	}
+	for _, file := range files {
+		link := base + "/download/" + url.PathEscape(file.name)
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title: file.name,
+			// Each upload of a name is a new entry
+			ID:      fmt.Sprintf("%s#%d", link, file.uploadedAt.UnixNano()),
+			Updated: file.uploadedAt.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: link},
+			Summary: fmt.Sprintf("%s, %d bytes", file.name, file.size),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(feed); err != nil {
+		log.Error().Err(err).Msg("Unable to write the feed")
+	}
+}
@@ -0,0 +1,71 @@
+package fileserver
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeed(t *testing.T) {
+	_, srv := newTestService(t, func(s *FileService) { s.FeedEntries = 2 })
+
+	// An empty store has a valid feed with no entries
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/feed", nil, nil)
+	var feed atomFeed
+	if err := xml.Unmarshal([]byte(body), &feed); err != nil {
+		t.Fatalf("empty feed isn't valid XML: %v\n%s", err, body)
+	}
+	if resp.StatusCode != http.StatusOK || len(feed.Entries) != 0 {
+		t.Errorf("empty feed got %d with %d entries, want %d with none", resp.StatusCode, len(feed.Entries), http.StatusOK)
+	}
+
+	for _, name := range []string{"old.txt", "a b.txt", "new.txt"} {
+		uploadFile(t, srv, name, "content")
+		time.Sleep(10 * time.Millisecond)
+	}
+	resp, body = doRequest(t, http.MethodGet, srv.URL+"/feed", nil, nil)
+	if got := resp.Header.Get("Content-Type"); got != "application/atom+xml; charset=utf-8" {
+		t.Errorf("Content-Type %q, want %q", got, "application/atom+xml; charset=utf-8")
+	}
+	if !strings.HasPrefix(body, xml.Header) {
+		t.Errorf("feed doesn't start with the XML declaration:\n%s", body)
+	}
+	feed = atomFeed{}
+	if err := xml.Unmarshal([]byte(body), &feed); err != nil {
+		t.Fatalf("feed isn't valid XML: %v\n%s", err, body)
+	}
+	if feed.XMLName.Space != "http://www.w3.org/2005/Atom" || feed.Link.Href != srv.URL+"/feed" {
+		t.Errorf("feed is in namespace %q linking to %q, want an Atom feed linking to itself", feed.XMLName.Space, feed.Link.Href)
+	}
+
+	// The newest files first, limited to FeedEntries
+	want := []struct {
+		title string
+		link  string
+	}{
+		{"new.txt", srv.URL + "/download/new.txt"},
+		{"a b.txt", srv.URL + "/download/a%20b.txt"},
+	}
+	if len(feed.Entries) != len(want) {
+		t.Fatalf("feed has %d entries, want %d:\n%s", len(feed.Entries), len(want), body)
+	}
+	for i, entry := range feed.Entries {
+		if entry.Title != want[i].title || entry.Link.Href != want[i].link {
+			t.Errorf("entry %d is %q linking to %q, want %q linking to %q", i, entry.Title, entry.Link.Href, want[i].title, want[i].link)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Updated); err != nil {
+			t.Errorf("entry %d: updated %q isn't RFC 3339", i, entry.Updated)
+		}
+	}
+	if feed.Updated != feed.Entries[0].Updated {
+		t.Errorf("feed updated %q, want the newest entry's %q", feed.Updated, feed.Entries[0].Updated)
+	}
+
+	// Each entry links to the file
+	resp, body = doRequest(t, http.MethodGet, feed.Entries[1].Link.Href, nil, nil)
+	if resp.StatusCode != http.StatusOK || body != "content" {
+		t.Errorf("entry link got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "content")
+	}
+}
@@ -0,0 +1,313 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxFetchRedirects is the most redirects followed when
+// fetching a file
+const maxFetchRedirects = 10
+
+// fetchRequestMaxSize is the largest accepted fetch
+// request body
+const fetchRequestMaxSize = 64 << 10
+
+// errFetchHostNotAllowed is returned for a URL whose host
+// isn't in FetchAllowedHosts
+var errFetchHostNotAllowed = errors.New("host is not allowed")
+
+// errFetchAddressNotAllowed is returned when the host of
+// a URL only resolves to addresses files may not be
+// fetched from
+var errFetchAddressNotAllowed = errors.New("address is not allowed")
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC
+// 6598), which is internal to a provider's network like
+// the private ranges
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// fetchRequest is the body of a fetch request
+type fetchRequest struct {
+	URL  string `json:"url"`
+	Name string `json:"name"`
+}
+
+// fetchHostAllowed reports whether files may be fetched
+// from host, FetchAllowedHosts has host names (matched
+// exactly) and "*.example.com" wildcards (matching any sub
+// domain of example.com)
+func (s *FileService) fetchHostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range s.FetchAllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if domain, found := strings.CutPrefix(allowed, "*."); found {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFetchURL returns an error if files may not be
+// fetched from u
+func (s *FileService) checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if !s.fetchHostAllowed(u.Hostname()) {
+		return fmt.Errorf("%w: %s", errFetchHostNotAllowed, u.Hostname())
+	}
+	return nil
+}
+
+// fetchIPAllowed reports whether files may be fetched
+// from ip, which must be in one of FetchAllowedNetworks
+// when any are set, and otherwise be a public address (so
+// neither e.g. localhost nor the cloud metadata service at
+// 169.254.169.254 can be reached)
+func (s *FileService) fetchIPAllowed(ip net.IP) bool {
+	if len(s.FetchAllowedNetworks) > 0 {
+		for _, network := range s.FetchAllowedNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// dialFetch connects to the host of a fetched URL at an
+// address it resolves to that files may be fetched from
+// Dialing the checked address rather than the host name
+// means a second lookup (e.g. rebinding the name to
+// 127.0.0.1) can't change where it connects
+func (s *FileService) dialFetch(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	for _, ipAddr := range ipAddrs {
+		if !s.fetchIPAllowed(ipAddr.IP) {
+			log.Warn().
+				Str("host", host).
+				Str("ip", ipAddr.String()).
+				Msg("Refusing to fetch from a disallowed address")
+			continue
+		}
+		conn, dialErr := dialer.DialContext(ctx, network, net.JoinHostPort(ipAddr.String(), port))
+		if dialErr == nil {
+			return conn, nil
+		}
+		err = dialErr
+	}
+	if err == nil {
+		err = fmt.Errorf("%w: %s only resolves to disallowed addresses", errFetchAddressNotAllowed, host)
+	}
+	return nil, err
+}
+
+// newFetchClient returns the client fetching files, which
+// checks every redirect against FetchAllowedHosts too and
+// only connects to allowed addresses. Proxies aren't used,
+// they would connect on the client's behalf unchecked
+func (s *FileService) newFetchClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = s.dialFetch
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxFetchRedirects)
+			}
+			return s.checkFetchURL(req.URL)
+		},
+	}
+}
+
+// fetchLimitReader fails reads past limit bytes with a
+// MaxBytesError, so a remote file over FetchMaxSize (or
+// the upload size limit) is rejected like an upload over
+// MaxUploadSize
+type fetchLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *fetchLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n, &http.MaxBytesError{Limit: l.limit}
+	}
+	return n, err
+}
+
+// fetch stores a file the server downloads from a URL,
+// rather than one uploaded by the client
+// e.g. {"url":"https://example.com/a.txt","name":"a.txt"}
+func (s *FileService) fetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Please POST the URL to fetch"))
+		return
+	}
+	if len(s.FetchAllowedHosts) == 0 {
+		log.Info().Msg("Rejecting fetch, no hosts are allowed")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Fetching files is disabled on this server"))
+		return
+	}
+
+	var req fetchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, fetchRequestMaxSize)).Decode(&req); err != nil {
+		log.Error().Err(err).Msg("Unable to decode fetch request body")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Request body is not a valid fetch request"))
+		return
+	}
+	log.Info().
+		Str("url", req.URL).
+		Str("fileName", req.Name).
+		Msg("Processing fetch")
+
+	u, err := url.Parse(req.URL)
+	if err == nil {
+		err = s.checkFetchURL(u)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid fetch URL")
+		if errors.Is(err, errFetchHostNotAllowed) {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write([]byte(fmt.Sprintf("Invalid fetch URL (%v)", err)))
+		return
+	}
+
+	// The name defaults to the last segment of the URL path
+	fileName := req.Name
+	if fileName == "" {
+		fileName = path.Base(u.Path)
+	}
+	fileName = s.uploadName(r, fileName)
+	if fileName == "" || fileName == "." || fileName == "/" {
+		log.Error().Msg("Fetch is missing the file name")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a file name."))
+		return
+	}
+
+	ctx := r.Context()
+	if s.FetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.FetchTimeout)
+		defer cancel()
+	}
+	remoteReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to create fetch request")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid fetch URL (%v)", err)))
+		return
+	}
+	resp, err := s.fetchClient.Do(remoteReq)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to fetch file")
+		switch {
+		case errors.Is(err, errFetchHostNotAllowed), errors.Is(err, errFetchAddressNotAllowed):
+			w.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, context.DeadlineExceeded):
+			w.WriteHeader(http.StatusGatewayTimeout)
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		w.Write([]byte(fmt.Sprintf("Unable to fetch the file (%v)", err)))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error().Str("status", resp.Status).Msg("Remote server failed the fetch")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("Unable to fetch the file (remote server responded with %s)", resp.Status)))
+		return
+	}
+	if s.FetchMaxSize > 0 && resp.ContentLength > s.FetchMaxSize {
+		log.Error().
+			Int64("contentLength", resp.ContentLength).
+			Msg("Remote file exceeds the maximum fetch size")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Remote file exceeds the maximum fetch size of %d bytes", s.FetchMaxSize)))
+		return
+	}
+
+	// The transfer stops as soon as the remote file goes
+	// over the smaller of the fetch and upload size limits,
+	// rather than once it is all on disk
+	limit := s.FetchMaxSize
+	if maxUploadSize := s.maxUploadSize(fileName); maxUploadSize > 0 && (limit == 0 || maxUploadSize < limit) {
+		limit = maxUploadSize
+	}
+	var body io.Reader = resp.Body
+	if limit > 0 {
+		body = &fetchLimitReader{r: resp.Body, limit: limit}
+	}
+	stored, err := s.put(ctx, &fileUpload{
+		name:          fileName,
+		body:          body,
+		contentLength: resp.ContentLength,
+		clientIP:      s.clientIP(r),
+	})
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case err == nil:
+		s.writeCreated(w, stored.Name, false)
+	case errors.As(err, &maxBytesErr) && maxBytesErr.Limit == s.FetchMaxSize:
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Remote file exceeds the maximum fetch size of %d bytes", s.FetchMaxSize)))
+	case isAborted(err) && r.Context().Err() == nil:
+		// The remote server rather than the client failed the
+		// transfer, by being too slow or cutting it short
+		if ctx.Err() != nil {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			w.Write([]byte(fmt.Sprintf("Unable to fetch the file within %s", s.FetchTimeout)))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(fmt.Sprintf("Unable to fetch the file (%v)", err)))
+	default:
+		s.writeError(w, err)
+	}
+}
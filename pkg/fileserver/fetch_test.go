@@ -0,0 +1,64 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fetchFile asks the server to fetch rawURL as name,
+// returning the response and its body
+func fetchFile(t *testing.T, srv *httptest.Server, rawURL, name string) (*http.Response, string) {
+	t.Helper()
+	req, _ := json.Marshal(fetchRequest{URL: rawURL, Name: name})
+	return doRequest(t, http.MethodPost, srv.URL+"/fetch", strings.NewReader(string(req)), nil)
+}
+
+func TestFetchInternalAddresses(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+			return
+		}
+		w.Write([]byte("fetched"))
+	}))
+	defer origin.Close()
+
+	hosts := []string{"127.0.0.1", "localhost", "::1", "169.254.169.254", "10.0.0.1", "100.64.0.1"}
+	_, srv := newTestService(t, func(s *FileService) { s.FetchAllowedHosts = hosts })
+
+	// Allowing a host name doesn't allow the internal
+	// addresses it resolves to
+	tests := []string{
+		origin.URL + "/file.txt",
+		strings.Replace(origin.URL, "127.0.0.1", "localhost", 1) + "/file.txt",
+		"http://[::1]:1/file.txt",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.1/file.txt",
+		"http://100.64.0.1/file.txt",
+		origin.URL + "/redirect",
+	}
+	for _, rawURL := range tests {
+		resp, body := fetchFile(t, srv, rawURL, "fetched.txt")
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("fetching %s got %d (%s), want %d", rawURL, resp.StatusCode, body, http.StatusForbidden)
+		}
+	}
+
+	// Unless the network is allowed explicitly
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, srv = newTestService(t, func(s *FileService) {
+		s.FetchAllowedHosts = hosts
+		s.FetchAllowedNetworks = []*net.IPNet{loopback}
+	})
+	resp, body := fetchFile(t, srv, origin.URL+"/file.txt", "fetched.txt")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("fetching from an allowed network got %d (%s), want %d", resp.StatusCode, body, http.StatusCreated)
+	}
+	if _, body = doRequest(t, http.MethodGet, srv.URL+"/download/fetched.txt", nil, nil); body != "fetched" {
+		t.Errorf("fetched %q, want %q", body, "fetched")
+	}
+}
@@ -0,0 +1,44 @@
+package fileserver
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// syncer is a file (or dir) opened to flush it to disk
+type syncer interface {
+	Sync() error
+	Close() error
+}
+
+// openForSync opens the file or dir at path to flush it
+func openForSync(path string) (syncer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// syncFile flushes the content of the file at path to disk
+func (s *FileService) syncFile(path string) error {
+	f, err := s.openForSync(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// syncParentDir flushes the dir entries of the dir of path
+// to disk, so a file renamed into it survives a power loss
+// A failure is only logged, the file is already in place
+func (s *FileService) syncParentDir(path string) {
+	if err := s.syncFile(filepath.Dir(path)); err != nil {
+		log.Error().Err(err).
+			Str("filePath", path).
+			Msg("Unable to sync the dir of the file to disk")
+	}
+}
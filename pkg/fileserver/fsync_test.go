@@ -0,0 +1,108 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncRecorder records the paths synced and their size at
+// the time, dirs with a size of -1
+type syncRecorder struct {
+	mu     sync.Mutex
+	synced map[string]int64
+}
+
+func (r *syncRecorder) open(path string) (syncer, error) {
+	f, err := openForSync(path)
+	if err != nil {
+		return nil, err
+	}
+	return &recordedSyncer{syncer: f, path: path, recorder: r}, nil
+}
+
+func (r *syncRecorder) take() map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	synced := r.synced
+	r.synced = map[string]int64{}
+	return synced
+}
+
+type recordedSyncer struct {
+	syncer
+	path     string
+	recorder *syncRecorder
+}
+
+func (f *recordedSyncer) Sync() error {
+	size := int64(-1)
+	if info, err := os.Stat(f.path); err == nil && !info.IsDir() {
+		size = info.Size()
+	}
+	f.recorder.mu.Lock()
+	f.recorder.synced[f.path] = size
+	f.recorder.mu.Unlock()
+	return f.syncer.Sync()
+}
+
+func TestFsyncOnUpload(t *testing.T) {
+	for _, fsync := range []bool{true, false} {
+		recorder := &syncRecorder{synced: map[string]int64{}}
+		s, srv := newTestService(t, func(s *FileService) {
+			s.FsyncOnUpload = fsync
+			s.openForSync = recorder.open
+		})
+
+		content := "content"
+		tests := []struct {
+			desc   string
+			name   string
+			upload func(name string)
+		}{
+			{"upload", "sub/a.txt", func(name string) {
+				uploadFile(t, srv, name, content)
+			}},
+			{"chunked upload", "sub/b.txt", func(name string) {
+				doRequest(t, http.MethodPut, srv.URL+"/upload/"+name, chunked(strings.NewReader(content)), nil)
+			}},
+			{"range upload", "sub/c.txt", func(name string) {
+				header := http.Header{"Content-Range": {fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content))}}
+				doRequest(t, http.MethodPut, srv.URL+"/upload/"+name, strings.NewReader(content), header)
+			}},
+			{"session", "sub/d.txt", func(name string) {
+				id := startTestSession(t, srv, name)
+				doRequest(t, http.MethodPut, srv.URL+"/upload/"+id+"/part/0", strings.NewReader(content), nil)
+				doRequest(t, http.MethodPost, srv.URL+"/upload/"+id+"/commit", nil, nil)
+			}},
+		}
+		for _, tt := range tests {
+			tt.upload(tt.name)
+			synced := recorder.take()
+			fileObj, found := s.lookup(tt.name)
+			if !found {
+				t.Fatalf("%s: %s isn't stored", tt.desc, tt.name)
+			}
+
+			// The whole content is synced, then the dir of
+			// the file
+			var syncedContent bool
+			for _, size := range synced {
+				if size == int64(len(content)) {
+					syncedContent = true
+				}
+			}
+			_, syncedDir := synced[filepath.Dir(fileObj.Path)]
+			if fsync && (!syncedContent || !syncedDir) {
+				t.Errorf("%s: synced %v, want the content and %s", tt.desc, synced, filepath.Dir(fileObj.Path))
+			}
+			if !fsync && len(synced) > 0 {
+				t.Errorf("%s: synced %v without FsyncOnUpload", tt.desc, synced)
+			}
+		}
+	}
+}
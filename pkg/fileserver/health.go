@@ -0,0 +1,132 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Health statuses reported by the healthz endpoint
+const (
+	HealthOK       = "ok"
+	HealthDegraded = "degraded"
+)
+
+// Write modes reported by the healthz and stats endpoints
+const (
+	ModeReadWrite  = "read-write"
+	ModeReadOnly   = "read-only"
+	ModeAppendOnly = "append-only"
+)
+
+// mode returns the write mode of the service
+func (s *FileService) mode() string {
+	switch {
+	case s.ReadOnly:
+		return ModeReadOnly
+	case s.AppendOnly:
+		return ModeAppendOnly
+	default:
+		return ModeReadWrite
+	}
+}
+
+// Health is the JSON body returned by the healthz endpoint
+// The drift counts come from the last periodic comparison
+// of the DB with the storage dir
+type Health struct {
+	Status string `json:"status"`
+
+	// Mode is the write mode, e.g. ModeAppendOnly
+	Mode string `json:"mode"`
+
+	// MissingFiles counts DB entries without a file on disk
+	MissingFiles int `json:"missingFiles"`
+
+	// UntrackedFiles counts files on disk not in the DB
+	UntrackedFiles int `json:"untrackedFiles"`
+
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// driftCheck holds the result of the last drift check
+type driftCheck struct {
+	mu     sync.Mutex
+	health Health
+}
+
+// checkDrift compares the DB with the storage dir and
+// records how far apart they are, the storage dir is
+// read without holding the DB lock so requests aren't
+// blocked while it is walked
+func (s *FileService) checkDrift() {
+	files, err := s.scanStorage()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to list contents of local file storage dir")
+		return
+	}
+
+	health := Health{Status: HealthOK, CheckedAt: time.Now()}
+	s.DBMu.RLock()
+	for name := range s.DB {
+		if _, found := files[name]; !found {
+			health.MissingFiles++
+		}
+	}
+	for name := range files {
+		if _, found := s.DB[name]; !found {
+			health.UntrackedFiles++
+		}
+	}
+	s.DBMu.RUnlock()
+
+	if health.MissingFiles > 0 || health.UntrackedFiles > 0 {
+		health.Status = HealthDegraded
+		log.Warn().
+			Int("missingFiles", health.MissingFiles).
+			Int("untrackedFiles", health.UntrackedFiles).
+			Msg("DB has drifted from the local file storage dir")
+	}
+
+	s.drift.mu.Lock()
+	s.drift.health = health
+	s.drift.mu.Unlock()
+}
+
+// watchDrift calls checkDrift every interval until the
+// service is stopped
+func (s *FileService) watchDrift(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.checkDrift()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkDrift()
+		}
+	}
+}
+
+// healthz reports whether the service is healthy, with a
+// 503 once the DB has drifted from the storage dir
+func (s *FileService) healthz(w http.ResponseWriter, r *http.Request) {
+	s.drift.mu.Lock()
+	health := s.drift.health
+	s.drift.mu.Unlock()
+	if health.Status == "" {
+		health.Status = HealthOK
+	}
+	health.Mode = s.mode()
+
+	w.Header().Set("Content-Type", "application/json")
+	if health.Status != HealthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,24 @@
+package fileserver
+
+import (
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// configureHTTP2 applies the HTTP/2 settings to the server,
+// which negotiates HTTP/2 automatically when serving TLS
+// With H2C the handler also accepts HTTP/2 over plaintext
+// (prior knowledge or an h2c upgrade)
+func (s *FileService) configureHTTP2() error {
+	h2s := &http2.Server{
+		MaxConcurrentStreams: uint32(s.HTTP2MaxConcurrentStreams),
+	}
+	if err := http2.ConfigureServer(s.HTTPServer, h2s); err != nil {
+		return err
+	}
+
+	if s.H2C {
+		s.HTTPServer.Handler = h2c.NewHandler(s.HTTPServer.Handler, h2s)
+	}
+	return nil
+}
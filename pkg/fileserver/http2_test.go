@@ -0,0 +1,68 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestH2C(t *testing.T) {
+	// Prior knowledge HTTP/2 over plaintext
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+
+	tests := []struct {
+		desc string
+		h2c  bool
+		want bool
+	}{
+		{"h2c enabled", true, true},
+		{"h2c disabled", false, false},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) { s.H2C = tt.h2c })
+
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/upload/a.txt", strings.NewReader("content"))
+		resp, err := client.Do(req)
+		if !tt.want {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: HTTP/2 upload got %d, want it to fail", tt.desc, resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: HTTP/2 upload: %v", tt.desc, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || resp.ProtoMajor != 2 {
+			t.Errorf("%s: upload got %d over %s, want %d over HTTP/2", tt.desc, resp.StatusCode, resp.Proto, http.StatusCreated)
+		}
+
+		resp, err = client.Get(srv.URL + "/download/a.txt")
+		if err != nil {
+			t.Fatalf("%s: HTTP/2 download: %v", tt.desc, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "content" {
+			t.Errorf("%s: download got %q over %s, want %q over HTTP/2", tt.desc, body, resp.Proto, "content")
+		}
+
+		// HTTP/1.1 clients are still served
+		if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/download/a.txt", nil, nil); resp.ProtoMajor != 1 || resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: HTTP/1.1 download got %d over %s", tt.desc, resp.StatusCode, resp.Proto)
+		}
+	}
+}
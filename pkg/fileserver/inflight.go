@@ -0,0 +1,87 @@
+package fileserver
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// checkContentLength rejects an upload without a
+// Content-Length (e.g. chunked) with a 411 when
+// RequireContentLength is set, reporting whether it may
+// go on
+func (s *FileService) checkContentLength(w http.ResponseWriter, r *http.Request) bool {
+	if !s.RequireContentLength || r.ContentLength >= 0 {
+		return true
+	}
+	log.Error().Msg("Upload without a Content-Length. Skipping.")
+	w.WriteHeader(http.StatusLengthRequired)
+	w.Write([]byte("Please upload with a Content-Length, chunked uploads aren't accepted"))
+	return false
+}
+
+// errTooManyInFlight is returned for an upload that would
+// take the uploads in flight over MaxInFlightUploadBytes
+var errTooManyInFlight = errors.New("too many upload bytes in flight")
+
+// reserveInFlight reserves the size bytes of an upload in
+// the uploads in flight, returning the reader to read its
+// body through and the func that releases them once it
+// completes or fails. An upload of unknown size (e.g.
+// chunked) reserves its bytes as they are read, failing
+// with errTooManyInFlight once they go over the limit
+func (s *FileService) reserveInFlight(body io.Reader, size int64) (io.Reader, func(), error) {
+	if s.MaxInFlightUploadBytes <= 0 {
+		return body, func() {}, nil
+	}
+	if size < 0 {
+		counted := &inFlightReader{s: s, r: body}
+		return counted, func() { s.inFlightUploadBytes.Add(-counted.reserved) }, nil
+	}
+	if !s.addInFlight(0, size) {
+		return nil, nil, errTooManyInFlight
+	}
+	return body, func() { s.inFlightUploadBytes.Add(-size) }, nil
+}
+
+// addInFlight adds size bytes to the uploads in flight,
+// reporting whether they fit. held are the bytes already
+// reserved by the same upload, an upload larger than the
+// limit is accepted when no other is in flight, or it
+// never could be
+func (s *FileService) addInFlight(held, size int64) bool {
+	for {
+		inFlight := s.inFlightUploadBytes.Load()
+		if inFlight > held && inFlight+size > s.MaxInFlightUploadBytes {
+			log.Error().
+				Int64("inFlightBytes", inFlight).
+				Int64("size", size).
+				Msg("Too many upload bytes in flight. Skipping.")
+			return false
+		}
+		if s.inFlightUploadBytes.CompareAndSwap(inFlight, inFlight+size) {
+			return true
+		}
+	}
+}
+
+// inFlightReader reserves the bytes of an upload of
+// unknown size in the uploads in flight as they are read
+type inFlightReader struct {
+	s        *FileService
+	r        io.Reader
+	reserved int64
+}
+
+func (r *inFlightReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if !r.s.addInFlight(r.reserved, int64(n)) {
+			return 0, errTooManyInFlight
+		}
+		r.reserved += int64(n)
+	}
+	return n, err
+}
@@ -0,0 +1,131 @@
+package fileserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunked hides the length of r, so it is sent chunked
+func chunked(r io.Reader) io.Reader {
+	return io.MultiReader(r)
+}
+
+func TestMaxInFlightUploadBytes(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.MaxInFlightUploadBytes = 1 << 20 })
+	id := startTestSession(t, srv, "session.bin")
+
+	// A first upload holds 800KB until its body is closed
+	held := 800 << 10
+	body, bodyWriter := io.Pipe()
+	first := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/upload/held.bin", body)
+		req.ContentLength = int64(held)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			first <- 0
+			return
+		}
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	bodyWriter.Write([]byte("x"))
+	for s.inFlightUploadBytes.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	large := strings.Repeat("l", 500<<10)
+	small := strings.Repeat("s", 100<<10)
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		body   io.Reader
+		header http.Header
+		want   int
+	}{
+		{"large upload", http.MethodPut, "/upload/a.bin", strings.NewReader(large), nil, http.StatusServiceUnavailable},
+		{"large chunked upload", http.MethodPut, "/upload/b.bin", chunked(strings.NewReader(large)), nil, http.StatusServiceUnavailable},
+		{"large chunked session part", http.MethodPut, "/upload/" + id + "/part/0", chunked(strings.NewReader(large)), nil, http.StatusServiceUnavailable},
+		{"large range part", http.MethodPut, "/upload/c.bin", strings.NewReader(large), http.Header{"Content-Range": {fmt.Sprintf("bytes 0-%d/%d", len(large)-1, len(large))}}, http.StatusServiceUnavailable},
+		{"small upload", http.MethodPut, "/upload/d.bin", strings.NewReader(small), nil, http.StatusCreated},
+		{"small chunked upload", http.MethodPut, "/upload/e.bin", chunked(strings.NewReader(small)), nil, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, tt.body, tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	bodyWriter.Write([]byte(strings.Repeat("x", held-1)))
+	bodyWriter.Close()
+	if got := <-first; got != http.StatusCreated {
+		t.Errorf("held upload got %d, want %d", got, http.StatusCreated)
+	}
+
+	// Concurrent large chunked uploads can't all be in
+	// flight, the ones going over the limit fail
+	var wg sync.WaitGroup
+	statuses := make(chan int, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, _ := doRequest(t, http.MethodPut, fmt.Sprintf("%s/upload/concurrent-%d.bin", srv.URL, i), chunked(strings.NewReader(strings.Repeat("c", 2<<20))), nil)
+			statuses <- resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusCreated && status != http.StatusServiceUnavailable {
+			t.Errorf("concurrent upload got %d", status)
+		}
+	}
+	if inFlight := s.inFlightUploadBytes.Load(); inFlight != 0 {
+		t.Errorf("%d bytes are still in flight after the uploads", inFlight)
+	}
+
+	// An upload over the limit is accepted on its own
+	resp, respBody := doRequest(t, http.MethodPut, srv.URL+"/upload/alone.bin", chunked(strings.NewReader(strings.Repeat("a", 2<<20))), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("upload over the limit on its own got %d (%s), want %d", resp.StatusCode, respBody, http.StatusCreated)
+	}
+}
+
+func TestRequireContentLength(t *testing.T) {
+	for _, require := range []bool{true, false} {
+		s, srv := newTestService(t, func(s *FileService) { s.RequireContentLength = require })
+		id := startTestSession(t, srv, "session.bin")
+
+		tests := []struct {
+			path     string
+			accepted int
+		}{
+			{"/upload/chunked.txt", http.StatusCreated},
+			{"/upload/" + id + "/part/0", http.StatusOK},
+		}
+		for _, tt := range tests {
+			want := tt.accepted
+			if require {
+				want = http.StatusLengthRequired
+			}
+			resp, body := doRequest(t, http.MethodPut, srv.URL+tt.path, chunked(strings.NewReader("content")), nil)
+			if resp.StatusCode != want {
+				t.Errorf("require %v: chunked PUT %s got %d (%s), want %d", require, tt.path, resp.StatusCode, body, want)
+			}
+		}
+		if _, found := s.lookup("chunked.txt"); found == require {
+			t.Errorf("require %v: chunked upload stored %v", require, found)
+		}
+
+		// Uploads with a Content-Length are always accepted
+		uploadFile(t, srv, "sized.txt", "content")
+	}
+}
@@ -0,0 +1,97 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Storage layouts selectable with FILESERVER_STORAGE_LAYOUT
+const (
+	StorageLayoutFlat    = "flat"
+	StorageLayoutSharded = "sharded"
+	StorageLayoutDate    = "date"
+)
+
+// dateDirLayout is the layout of the sub dirs of the date
+// storage layout, e.g. "2024/03/15"
+const dateDirLayout = "2006/01/02"
+
+// KeyFunc maps a file name to its storage key, the slash
+// separated path of the file within the storage dir
+type KeyFunc func(name string) string
+
+// NameFunc maps a storage key back to the name of the
+// file, it returns "" for keys that can't be reversed
+// (i.e. files not stored by the matching KeyFunc)
+type NameFunc func(key string) string
+
+// Option customizes the FileService created by
+// NewFileService
+type Option func(*FileService)
+
+// WithKeyFunc stores files under the keys keyFunc maps
+// their names to, nameFunc must reverse it so the files
+// already on disk are found when scanning the storage dir
+func WithKeyFunc(keyFunc KeyFunc, nameFunc NameFunc) Option {
+	return func(s *FileService) {
+		s.KeyFunc = keyFunc
+		s.NameFunc = nameFunc
+	}
+}
+
+// FlatKey stores a file under its own name
+func FlatKey(name string) string {
+	return name
+}
+
+// FlatName reverses FlatKey
+func FlatName(key string) string {
+	return key
+}
+
+// ShardedKey spreads files across two levels of sub dirs
+// named after the start of the hash of their name, to
+// avoid huge flat dirs, e.g. "report.pdf" is stored as
+// "ab/cd/report.pdf"
+func ShardedKey(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	prefix := hex.EncodeToString(sum[:2])
+	return prefix[:2] + "/" + prefix[2:] + "/" + name
+}
+
+// ShardedName reverses ShardedKey
+func ShardedName(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 || ShardedKey(parts[2]) != key {
+		return ""
+	}
+	return parts[2]
+}
+
+// DateKeys stores files in sub dirs named after the day
+// they are first uploaded on (as now returns it in loc),
+// e.g. "report.pdf" is stored as "2024/03/15/report.pdf"
+// Names are unchanged, a file replaced on a later day
+// stays in the sub dir of the day it was first uploaded
+func DateKeys(loc *time.Location, now func() time.Time) (KeyFunc, NameFunc) {
+	dateKey := func(name string) string {
+		return now().In(loc).Format(dateDirLayout) + "/" + name
+	}
+	dateName := func(key string) string {
+		parts := strings.SplitN(key, "/", 4)
+		if len(parts) != 4 || !isDateDir(strings.Join(parts[:3], "/")) {
+			return ""
+		}
+		return parts[3]
+	}
+	return dateKey, dateName
+}
+
+// isDateDir reports whether dir is a sub dir of the date
+// storage layout, e.g. "2024/03/15"
+func isDateDir(dir string) bool {
+	day, err := time.Parse(dateDirLayout, dir)
+	return err == nil && day.Format(dateDirLayout) == dir
+}
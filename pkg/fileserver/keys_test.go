@@ -0,0 +1,81 @@
+package fileserver
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDateKeys(t *testing.T) {
+	// A second before midnight in loc, where it is already
+	// the next day in UTC
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	var clock atomic.Int64
+	clock.Store(time.Date(2024, 3, 15, 23, 59, 59, 0, loc).UnixNano())
+	now := func() time.Time { return time.Unix(0, clock.Load()) }
+	withDateKeys := WithKeyFunc(DateKeys(loc, now))
+
+	s, srv := newTestService(t, withDateKeys)
+
+	// The steps run in order
+	tests := []struct {
+		advance  time.Duration
+		name     string
+		content  string
+		wantPath string
+	}{
+		{0, "a.txt", "first", "2024/03/15/a.txt"},
+		{0, "nested/b.txt", "first", "2024/03/15/nested/b.txt"},
+		{2 * time.Second, "c.txt", "next day", "2024/03/16/c.txt"},
+		// A file replaced on a later day stays where it is
+		{0, "a.txt", "replaced", "2024/03/15/a.txt"},
+	}
+	for _, tt := range tests {
+		clock.Add(int64(tt.advance))
+		uploadFile(t, srv, tt.name, tt.content)
+		content, err := os.ReadFile(filepath.Join(s.StoragePath, filepath.FromSlash(tt.wantPath)))
+		if err != nil || string(content) != tt.content {
+			t.Errorf("%s: %s has %q (%v), want %q", tt.name, tt.wantPath, content, err, tt.content)
+		}
+		if resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, nil); resp.StatusCode != http.StatusOK || body != tt.content {
+			t.Errorf("%s: download got %d %q, want %d %q", tt.name, resp.StatusCode, body, http.StatusOK, tt.content)
+		}
+	}
+
+	// Names don't have the date dirs in them, also once
+	// they are read back from the storage dir
+	const wantList = "a.txt\nc.txt\nnested/b.txt"
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil); body != wantList {
+		t.Errorf("list got %q, want %q", body, wantList)
+	}
+	restarted, err := NewFileService(withDateKeys)
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	if got := restarted.fileList().names; len(got) != 3 || got[0] != "a.txt" || got[1] != "c.txt" || got[2] != "nested/b.txt" {
+		t.Errorf("restarted service lists %q, want %q", got, wantList)
+	}
+}
+
+func TestDateName(t *testing.T) {
+	_, dateName := DateKeys(time.UTC, time.Now)
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"2024/03/15/a.txt", "a.txt"},
+		{"2024/03/15/nested/a.txt", "nested/a.txt"},
+		{"2024/02/30/a.txt", ""},
+		{"2024/3/15/a.txt", ""},
+		{"2024/03/a.txt", ""},
+		{"a.txt", ""},
+	}
+	for _, tt := range tests {
+		if got := dateName(tt.key); got != tt.want {
+			t.Errorf("dateName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
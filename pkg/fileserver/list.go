@@ -0,0 +1,359 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// wantsJSON reports whether the client asked for a JSON
+// response, either with ?format=json or the Accept header
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Accept"))
+	return err == nil && mediaType == "application/json"
+}
+
+// listFields are the ?fields= of the list besides the
+// checksum algorithms
+var listFields = []string{"name", "size", "uploadedAt"}
+
+// parseListFields returns the fields of the ?fields=
+// selector (e.g. "name,size,sha256"), nil without one
+func parseListFields(r *http.Request) ([]string, error) {
+	if !r.URL.Query().Has("fields") {
+		return nil, nil
+	}
+	var fields []string
+	for _, field := range strings.Split(r.URL.Query().Get("fields"), ",") {
+		field = strings.TrimSpace(field)
+		if _, found := checksumAlgorithms[field]; !found && !slices.Contains(listFields, field) {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// listEntries returns the fields of the files
+// Checksums missing for a file (e.g. found on disk rather
+// than uploaded) are computed before responding, until ctx
+// is done (half the list timeout). The ones left are then
+// computed in the background for a later listing, their
+// fields are left out of this one
+func (s *FileService) listEntries(ctx context.Context, names, fields []string) []map[string]any {
+	var algorithms []string
+	for _, field := range fields {
+		if _, found := checksumAlgorithms[field]; found {
+			algorithms = append(algorithms, field)
+		}
+	}
+
+	entries := make([]map[string]any, 0, len(names))
+	for _, name := range names {
+		// Skip files deleted since the list was built
+		fileObj, found := s.lookup(name)
+		if !found {
+			continue
+		}
+		var checksums map[string]string
+		if len(algorithms) > 0 {
+			checksums = fileObj.copyChecksums()
+			var missing []string
+			for _, algorithm := range algorithms {
+				if _, found := checksums[algorithm]; !found {
+					missing = append(missing, algorithm)
+				}
+			}
+			if len(missing) > 0 {
+				computed, err := s.fileChecksums(ctx, fileObj, algorithms)
+				switch {
+				case err == nil:
+					checksums = computed
+				case ctx.Err() != nil:
+					s.queueChecksums(name, fileObj, missing)
+				default:
+					log.Error().Err(err).Str("fileName", name).Msg("Unable to checksum file")
+				}
+			}
+		}
+
+		fileObj.attrMu.RLock()
+		entry := make(map[string]any, len(fields))
+		for _, field := range fields {
+			switch field {
+			case "name":
+				entry[field] = name
+			case "size":
+				entry[field] = fileObj.Size
+			case "uploadedAt":
+				entry[field] = fileObj.UploadedAt
+			default:
+				if sum, found := checksums[field]; found {
+					entry[field] = sum
+				}
+			}
+		}
+		fileObj.attrMu.RUnlock()
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// listCache holds the sorted file names and the ETag of
+// the DB state between DB changes, it is guarded by DBMu
+type listCache struct {
+	valid bool
+	names []string
+	etag  string
+
+	// bytes is the total size of the files listed
+	bytes int64
+
+	// expiresAt is when the first of the files listed
+	// expires, the list is rebuilt without it from then on
+	expiresAt time.Time
+}
+
+// current reports whether the cached list is still valid
+func (c *listCache) current(now time.Time) bool {
+	return c.valid && (c.expiresAt.IsZero() || now.Before(c.expiresAt))
+}
+
+// fileList returns the sorted file names and the ETag of
+// the DB state, from the cache
+// when enabled and still valid
+func (s *FileService) fileList() listCache {
+	if !s.ListCache {
+		s.DBMu.RLock()
+		defer s.DBMu.RUnlock()
+		return s.buildFileList()
+	}
+
+	s.DBMu.RLock()
+	cache := s.listCache
+	s.DBMu.RUnlock()
+	if cache.current(time.Now()) {
+		return cache
+	}
+
+	s.DBMu.Lock()
+	defer s.DBMu.Unlock()
+	if !s.listCache.current(time.Now()) {
+		s.listCache = s.buildFileList()
+	}
+	return s.listCache
+}
+
+// buildFileList lists the files in the DB, the caller
+// must hold DBMu
+// The ETag is a hash of the names, sizes and upload times
+// of the files, so it changes with any upload or delete
+// Expired files are left out, even before they are swept
+func (s *FileService) buildFileList() listCache {
+	now := time.Now()
+	var firstExpiry time.Time
+	names := s.DB.GetFileList()
+	if names == nil {
+		names = []string{}
+	}
+	names = slices.DeleteFunc(names, func(name string) bool {
+		if !strings.HasPrefix(name, s.RequiredNamePrefix) {
+			return true
+		}
+		expiresAt, found := s.DB[name].expiresAt()
+		if !found {
+			return false
+		}
+		if !now.Before(expiresAt) {
+			return true
+		}
+		if firstExpiry.IsZero() || expiresAt.Before(firstExpiry) {
+			firstExpiry = expiresAt
+		}
+		return false
+	})
+
+	h := sha256.New()
+	var bytes int64
+	for _, name := range names {
+		fileObj := s.DB[name]
+		fileObj.attrMu.RLock()
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", name, fileObj.Size, fileObj.UploadedAt.UnixNano())
+		bytes += fileObj.Size
+		fileObj.attrMu.RUnlock()
+	}
+
+	return listCache{
+		valid:     true,
+		names:     names,
+		etag:      fmt.Sprintf(`"%x"`, h.Sum(nil)[:16]),
+		bytes:     bytes,
+		expiresAt: firstExpiry,
+	}
+}
+
+// etagMatches reports whether the If-None-Match header
+// value matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSONNames writes names as a JSON array one name at
+// a time, so a large list isn't encoded in memory whole
+func writeJSONNames(w io.Writer, names []string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i, name := range names {
+		buf.Reset()
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := enc.Encode(name); err != nil {
+			return err
+		}
+		// Encode ends each value with a newline
+		if _, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// invalidateList drops the cached file names, it must be
+// called (with DBMu held) whenever the DB changes
+func (s *FileService) invalidateList() {
+	s.listCache = listCache{}
+}
+
+// list returns an array of strings containing
+// the names of the files currently uploaded
+// The names are sent newline separated or as a JSON
+// array, from the list cache when enabled
+func (s *FileService) list(w http.ResponseWriter, r *http.Request) {
+	log.Info().
+		Int("contentLength", int(r.ContentLength)).
+		Msg("Processing list")
+
+	// Without the scan at startup the DB only has the files
+	// looked up so far
+	if s.LazyLoad {
+		if _, err := s.Rescan(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception listing the local file storage dir"))
+			return
+		}
+	}
+
+	// HEAD only returns the counts, for monitoring without
+	// listing the files
+	if r.Method == http.MethodHead {
+		fileList := s.fileList()
+		w.Header().Set("X-File-Count", strconv.Itoa(len(fileList.names)))
+		w.Header().Set("X-Total-Bytes", strconv.FormatInt(fileList.bytes, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	fileList := s.fileList()
+
+	// ?fields= lists JSON objects with the fields asked for,
+	// e.g. ?fields=name,size,sha256 to verify a batch of files
+	fields, err := parseListFields(r)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid list fields")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid fields (%v)", err)))
+		return
+	}
+
+	// A field listing has the values of the fields in it,
+	// its ETag is a hash of the fields and the listing
+	etag := fileList.etag
+	var entries []byte
+	if fields != nil {
+		// Computing checksums may take up to half the list
+		// timeout, leaving the rest to send the listing
+		ctx := r.Context()
+		if s.ListTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, s.ListTimeout/2)
+			defer cancel()
+		}
+		entries, err = json.Marshal(s.listEntries(ctx, fileList.names, fields))
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to encode the list")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception encoding the list"))
+			return
+		}
+		h := sha256.New()
+		h.Write([]byte(strings.Join(fields, ",") + "\n"))
+		h.Write(entries)
+		etag = fmt.Sprintf(`"%x"`, h.Sum(nil)[:16])
+	}
+
+	// Polling clients send back the ETag to skip the list
+	// when nothing changed
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept")
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	// An empty store is either a 204 without a body, or a
+	// 200 with an empty body in text and [] in JSON, so it
+	// can't be mistaken for a file with an empty name
+	if len(fileList.names) == 0 && s.EmptyListNoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if fields != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(entries, '\n'))
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		writeJSONNames(bw, fileList.names)
+		return
+	}
+
+	//w.WriteHeader(http.StatusOK)
+	for i, name := range fileList.names {
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		bw.WriteString(name)
+	}
+}
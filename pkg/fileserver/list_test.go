@@ -0,0 +1,251 @@
+package fileserver
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	_, srv := newTestService(t)
+	for _, name := range []string{"b.txt", "A.txt", "c.txt"} {
+		uploadFile(t, srv, name, "content")
+	}
+
+	tests := []struct {
+		path   string
+		header http.Header
+		want   string
+	}{
+		{"/list/", nil, "A.txt\nb.txt\nc.txt"},
+		{"/list/?format=json", nil, `["A.txt","b.txt","c.txt"]`},
+		{"/list/", http.Header{"Accept": {"application/json"}}, `["A.txt","b.txt","c.txt"]`},
+		{"/list/?fields=name,size", nil, `[{"name":"A.txt","size":7},{"name":"b.txt","size":7},{"name":"c.txt","size":7}]` + "\n"},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+tt.path, nil, tt.header)
+		if resp.StatusCode != http.StatusOK || body != tt.want {
+			t.Errorf("GET %s (%v) got %d %q, want %q", tt.path, tt.header, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+// BenchmarkList lists a DB with a million files, without
+// the list cache so each listing sorts and encodes them all
+// (and without the list timeout, which would cut it off)
+func BenchmarkList(b *testing.B) {
+	s, srv := newTestService(b, func(s *FileService) {
+		s.ListCache = false
+		s.ListTimeout = 0
+	})
+	for i := 0; i < 1_000_000; i++ {
+		s.DB[fmt.Sprintf("file-%07d.txt", i)] = &FileObject{Size: 1024, UploadedAt: time.Now()}
+	}
+
+	for format, path := range map[string]string{"text": "/list/", "json": "/list/?format=json"} {
+		b.Run(format, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				resp, _ := doRequest(b, http.MethodGet, srv.URL+path, nil, nil)
+				if resp.StatusCode != http.StatusOK {
+					b.Fatalf("GET %s got %d", path, resp.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListCache lists a DB with many files with and
+// without the list cache, which skips sorting and hashing
+// the names between changes
+func BenchmarkListCache(b *testing.B) {
+	for _, cache := range []bool{true, false} {
+		s, _ := newTestService(b, func(s *FileService) {
+			s.ListCache = cache
+			s.ListTimeout = 0
+		})
+		for i := 0; i < 100_000; i++ {
+			s.DB[fmt.Sprintf("file-%06d.txt", i)] = &FileObject{Size: 1024, UploadedAt: time.Now()}
+		}
+		handler := s.HTTPServer.Handler
+
+		b.Run(fmt.Sprintf("cache=%v", cache), func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, "/list/", nil)
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					b.Fatalf("GET /list/ got %d", rec.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestListChecksums(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "files")
+	found := map[string]string{"found.txt": "found on disk", "sub/nested.txt": "nested on disk"}
+	for name, content := range found {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0774); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	DefaultStoragePath = dir
+	s, err := NewFileService()
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	srv := httptest.NewServer(s.HTTPServer.Handler)
+	defer srv.Close()
+
+	contents := map[string]string{"uploaded.txt": "uploaded content"}
+	uploadFile(t, srv, "uploaded.txt", contents["uploaded.txt"])
+	for name, content := range found {
+		contents[name] = content
+	}
+
+	// The last listing reads the sums cached by the first ones
+	tests := []string{"name,sha256", "name,md5,sha256", "name,sha256"}
+	for _, fields := range tests {
+		_, body := doRequest(t, http.MethodGet, srv.URL+"/list/?fields="+fields, nil, nil)
+		var entries []map[string]string
+		if err := json.Unmarshal([]byte(body), &entries); err != nil {
+			t.Fatalf("decoding the list with %s: %v", fields, err)
+		}
+		if len(entries) != len(contents) {
+			t.Fatalf("list with %s has %d entries, want %d", fields, len(entries), len(contents))
+		}
+		for _, entry := range entries {
+			content := []byte(contents[entry["name"]])
+			sha := sha256.Sum256(content)
+			if entry["sha256"] != hex.EncodeToString(sha[:]) {
+				t.Errorf("%s: sha256 %q, want %x", entry["name"], entry["sha256"], sha)
+			}
+			if strings.Contains(fields, "md5") {
+				if sum := md5.Sum(content); entry["md5"] != hex.EncodeToString(sum[:]) {
+					t.Errorf("%s: md5 %q, want %x", entry["name"], entry["md5"], sum)
+				}
+			}
+		}
+	}
+}
+
+func TestListETag(t *testing.T) {
+	_, srv := newTestService(t)
+	uploadFile(t, srv, "a.txt", "first")
+
+	etag := func(query string, header http.Header) (int, string) {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/list/"+query, nil, header)
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("list%s got %d (%s)", query, resp.StatusCode, body)
+		}
+		return resp.StatusCode, resp.Header.Get("ETag")
+	}
+
+	// Each listing has an ETag of its own
+	seen := map[string]string{}
+	for _, query := range []string{"", "?fields=name", "?fields=name,size", "?fields=size,name", "?fields=name,sha256"} {
+		_, tag := etag(query, nil)
+		if tag == "" {
+			t.Errorf("list%s has no ETag", query)
+		}
+		if other, found := seen[tag]; found {
+			t.Errorf("list%s has the ETag of list%s", query, other)
+		}
+		seen[tag] = query
+	}
+
+	_, sumTag := etag("?fields=name,sha256", nil)
+	if status, _ := etag("?fields=name,sha256", http.Header{"If-None-Match": {sumTag}}); status != http.StatusNotModified {
+		t.Errorf("unchanged field listing got %d, want %d", status, http.StatusNotModified)
+	}
+
+	// An overwrite with the same name and size changes the
+	// checksum values of the listing
+	uploadFile(t, srv, "a.txt", "other")
+	if status, _ := etag("?fields=name,sha256", http.Header{"If-None-Match": {sumTag}}); status != http.StatusOK {
+		t.Errorf("changed field listing got %d, want %d", status, http.StatusOK)
+	}
+}
+
+func TestListEmptyStore(t *testing.T) {
+	tests := []struct {
+		noContent bool
+		path      string
+		header    http.Header
+		want      int
+		wantBody  string
+	}{
+		{false, "/list/", nil, http.StatusOK, ""},
+		{false, "/list/?format=json", nil, http.StatusOK, "[]"},
+		{false, "/list/", http.Header{"Accept": {"application/json"}}, http.StatusOK, "[]"},
+		{false, "/list/?fields=name,size", nil, http.StatusOK, "[]\n"},
+		{true, "/list/", nil, http.StatusNoContent, ""},
+		{true, "/list/?format=json", nil, http.StatusNoContent, ""},
+		{true, "/list/?fields=name,size", nil, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) { s.EmptyListNoContent = tt.noContent })
+
+		resp, body := doRequest(t, http.MethodGet, srv.URL+tt.path, nil, tt.header)
+		if resp.StatusCode != tt.want || body != tt.wantBody {
+			t.Errorf("no content %v: GET %s (%v) got %d %q, want %d %q", tt.noContent, tt.path, tt.header, resp.StatusCode, body, tt.want, tt.wantBody)
+		}
+
+		// Once a file is stored it is listed either way
+		uploadFile(t, srv, "a.txt", "content")
+		if resp, _ := doRequest(t, http.MethodGet, srv.URL+tt.path, nil, tt.header); resp.StatusCode != http.StatusOK {
+			t.Errorf("no content %v: GET %s with a file got %d, want %d", tt.noContent, tt.path, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestListHead(t *testing.T) {
+	_, srv := newTestService(t)
+
+	tests := []struct {
+		upload    string
+		content   string
+		wantCount string
+		wantBytes string
+	}{
+		{"", "", "0", "0"},
+		{"a.txt", "hello", "1", "5"},
+		{"b.txt", "hello world", "2", "16"},
+		// An overwrite replaces the size of the file
+		{"a.txt", "hi", "2", "13"},
+	}
+	for _, tt := range tests {
+		if tt.upload != "" {
+			uploadFile(t, srv, tt.upload, tt.content)
+		}
+		resp, body := doRequest(t, http.MethodHead, srv.URL+"/list/", nil, nil)
+		if resp.StatusCode != http.StatusOK || body != "" {
+			t.Errorf("after %q: HEAD got %d with %d bytes, want %d with none", tt.upload, resp.StatusCode, len(body), http.StatusOK)
+		}
+		count, bytes := resp.Header.Get("X-File-Count"), resp.Header.Get("X-Total-Bytes")
+		if count != tt.wantCount || bytes != tt.wantBytes {
+			t.Errorf("after %q: X-File-Count %q, X-Total-Bytes %q, want %q, %q", tt.upload, count, bytes, tt.wantCount, tt.wantBytes)
+		}
+	}
+
+	// GET still lists the files, without the count headers
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil)
+	if resp.StatusCode != http.StatusOK || body != "a.txt\nb.txt" {
+		t.Errorf("GET got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "a.txt\nb.txt")
+	}
+	if resp.Header.Get("X-File-Count") != "" {
+		t.Errorf("GET has X-File-Count %q", resp.Header.Get("X-File-Count"))
+	}
+}
@@ -0,0 +1,64 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// logLevelRequestMaxSize is the largest accepted log level
+// request body
+const logLevelRequestMaxSize = 4 << 10
+
+// logLevel is the body of log level requests and responses
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// logLevelEndpoint returns the log level (GET), or changes
+// it at runtime (POST), e.g. {"level":"debug"} to debug an
+// incident without restarting the server
+func (s *FileService) logLevelEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		var req logLevel
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, logLevelRequestMaxSize)).Decode(&req); err != nil {
+			log.Error().Err(err).Msg("Unable to decode log level request body")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Request body is not a valid log level request"))
+			return
+		}
+		level, err := zerolog.ParseLevel(req.Level)
+		if err == nil && level == zerolog.NoLevel {
+			err = errors.New("empty level")
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid log level")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Please provide one of the levels trace, debug, info, warn, error, fatal, panic or disabled (%v)", err)))
+			return
+		}
+
+		// Logged at the level it is changed from, so the
+		// change is logged unless that is above info
+		log.Info().
+			Str("from", zerolog.GlobalLevel().String()).
+			Str("to", level.String()).
+			Str("clientIP", s.clientIP(r)).
+			Msg("Changing log level")
+		zerolog.SetGlobalLevel(level)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Please GET the log level or POST to change it"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevel{Level: zerolog.GlobalLevel().String()})
+}
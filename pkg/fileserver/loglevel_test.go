@@ -0,0 +1,67 @@
+package fileserver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestLogLevel(t *testing.T) {
+	// The endpoint changes the global level
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	log.Logger = zerolog.New(io.Discard)
+
+	secret := []byte("test-secret")
+	_, srv := newTestService(t, func(s *FileService) {
+		s.AuthMode = AuthModeJWT
+		s.JWTSecret = secret
+	})
+	admin := signHS256(t, secret, jwtClaims{Subject: "admin", Scope: ScopeAdmin})
+	readOnly := signHS256(t, secret, jwtClaims{Subject: "ro", Scope: ScopeRead})
+
+	// The steps run in order
+	tests := []struct {
+		desc      string
+		token     string
+		method    string
+		body      string
+		want      int
+		wantLevel zerolog.Level
+	}{
+		{"without a token", "", http.MethodPost, `{"level":"debug"}`, http.StatusUnauthorized, zerolog.InfoLevel},
+		{"without the admin scope", readOnly, http.MethodPost, `{"level":"debug"}`, http.StatusForbidden, zerolog.InfoLevel},
+		{"debug", admin, http.MethodPost, `{"level":"debug"}`, http.StatusOK, zerolog.DebugLevel},
+		{"get", admin, http.MethodGet, "", http.StatusOK, zerolog.DebugLevel},
+		{"unknown level", admin, http.MethodPost, `{"level":"verbose"}`, http.StatusBadRequest, zerolog.DebugLevel},
+		{"empty level", admin, http.MethodPost, `{"level":""}`, http.StatusBadRequest, zerolog.DebugLevel},
+		{"not JSON", admin, http.MethodPost, "warn", http.StatusBadRequest, zerolog.DebugLevel},
+		{"other method", admin, http.MethodPut, `{"level":"warn"}`, http.StatusMethodNotAllowed, zerolog.DebugLevel},
+		{"warn", admin, http.MethodPost, `{"level":"WARN"}`, http.StatusOK, zerolog.WarnLevel},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.token != "" {
+			header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, body := doRequest(t, tt.method, srv.URL+"/admin/loglevel", strings.NewReader(tt.body), header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+		if got := zerolog.GlobalLevel(); got != tt.wantLevel {
+			t.Errorf("%s: level is %s, want %s", tt.desc, got, tt.wantLevel)
+		}
+		// The effective level is returned
+		if want := `{"level":"` + tt.wantLevel.String() + `"}` + "\n"; resp.StatusCode == http.StatusOK && body != want {
+			t.Errorf("%s: got %q, want %q", tt.desc, body, want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package fileserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// logStreamBuffer is how many log lines are buffered for
+// each /logs/stream client, a client falling further
+// behind is disconnected
+const logStreamBuffer = 256
+
+// logStreamKeepAlive is how often an idle /logs/stream
+// connection is sent a comment, so proxies don't close it
+const logStreamKeepAlive = 30 * time.Second
+
+// logBroadcaster is an io.Writer the logger writes to,
+// which fans the log lines out to the /logs/stream clients
+type logBroadcaster struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{subscribers: map[chan []byte]struct{}{}}
+}
+
+// Write sends the log line to every client without
+// blocking, a client whose buffer is full is dropped so a
+// slow client can't hold up logging
+func (b *logBroadcaster) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subscribers) == 0 {
+		return len(p), nil
+	}
+
+	// The logger reuses its buffer once Write returns
+	line := append([]byte(nil), p...)
+	for ch := range b.subscribers {
+		select {
+		case ch <- line:
+		default:
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+	return len(p), nil
+}
+
+// subscribe returns the channel receiving the log lines,
+// which is closed when the client is dropped, and the func
+// unsubscribing it
+func (b *logBroadcaster) subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, logStreamBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, found := b.subscribers[ch]; found {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// logStream streams the server's log lines to the client
+// as server-sent events as they are logged
+func (s *FileService) logStream(w http.ResponseWriter, r *http.Request) {
+	log.Info().
+		Str("clientIP", s.clientIP(r)).
+		Msg("Processing log stream")
+
+	lines, unsubscribe := s.logs.subscribe()
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Error().Err(err).Msg("Unable to stream logs, the response can't be flushed")
+		return
+	}
+
+	keepAlive := time.NewTicker(logStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.done:
+			return
+		case line, ok := <-lines:
+			if !ok {
+				// Logged once the client is gone from the
+				// broadcaster, it can't be sent to the client
+				log.Warn().
+					Str("clientIP", s.clientIP(r)).
+					Msg("Dropped log stream client that fell behind")
+				return
+			}
+			// Each zerolog line is one JSON document ending in
+			// a newline
+			_, err = w.Write([]byte("data: "))
+			if err == nil {
+				_, err = w.Write(line)
+			}
+			if err == nil {
+				_, err = w.Write([]byte("\n"))
+			}
+		case <-keepAlive.C:
+			_, err = w.Write([]byte(": keep-alive\n\n"))
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package fileserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestLogStream(t *testing.T) {
+	// The stream is fed by the global logger
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	t.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	log.Logger = zerolog.New(io.Discard)
+
+	s, srv := newTestService(t, func(s *FileService) { s.LogStream = true })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/logs/stream", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /logs/stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("/logs/stream got %d with Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	// Logged once the stream is subscribed
+	for subscribed := false; !subscribed; {
+		s.logs.mu.Lock()
+		subscribed = len(s.logs.subscribers) > 0
+		s.logs.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	uploadFile(t, srv, "streamed.txt", "content")
+
+	// Each event is a JSON log line
+	scanner := bufio.NewScanner(resp.Body)
+	found := false
+	for !found && scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var line map[string]any
+		if err := json.Unmarshal([]byte(data), &line); err != nil {
+			t.Fatalf("event %q isn't a JSON log line: %v", data, err)
+		}
+		found = line["fileName"] == "streamed.txt"
+	}
+	if !found {
+		t.Fatalf("the upload wasn't logged to the stream: %v", scanner.Err())
+	}
+
+	// Stopping the service ends the stream
+	s.Stop(context.Background())
+	for scanner.Scan() {
+	}
+	if err := scanner.Err(); err != nil {
+		t.Errorf("stream didn't end with the service: %v", err)
+	}
+}
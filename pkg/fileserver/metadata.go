@@ -0,0 +1,113 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// maxMetadataEntries is the most custom metadata
+	// headers a single file can carry
+	maxMetadataEntries = 32
+
+	// maxMetadataSize is the most bytes (keys and values)
+	// of custom metadata a single file can carry
+	maxMetadataSize = 8 << 10
+
+	// maxMetadataValueSize is the most bytes of a single
+	// custom metadata header value
+	maxMetadataValueSize = 2 << 10
+
+	// metadataHeaderPrefix is the prefix metadata is
+	// replayed with on download
+	metadataHeaderPrefix = "X-Meta-"
+)
+
+// metadataHeaderPrefixes are the (canonical) header prefixes
+// captured as custom metadata on upload, X-Amz-Meta- lets S3
+// clients set it the way they are used to
+var metadataHeaderPrefixes = []string{"X-Amz-Meta-", metadataHeaderPrefix}
+
+// errMetadataTooLarge is returned by parseMetadata for
+// metadata headers over the size limits
+var errMetadataTooLarge = errors.New("metadata headers too large")
+
+// parseMetadata returns the custom metadata carried in the
+// request headers, keyed by the lowercased header name
+// without its prefix
+func parseMetadata(h http.Header) (map[string]string, error) {
+	var metadata map[string]string
+	size := 0
+
+	for header, values := range h {
+		for _, prefix := range metadataHeaderPrefixes {
+			if !strings.HasPrefix(header, prefix) || len(header) == len(prefix) {
+				continue
+			}
+			if metadata == nil {
+				metadata = map[string]string{}
+			}
+			key := strings.ToLower(strings.TrimPrefix(header, prefix))
+			value := strings.Join(values, ",")
+			if len(value) > maxMetadataValueSize {
+				return nil, fmt.Errorf("%w: %s is %d bytes, max %d", errMetadataTooLarge, header, len(value), maxMetadataValueSize)
+			}
+			metadata[key] = value
+			size += len(key) + len(value)
+			break
+		}
+	}
+
+	if len(metadata) > maxMetadataEntries {
+		return nil, fmt.Errorf("too many metadata headers (%d, max %d)", len(metadata), maxMetadataEntries)
+	}
+	if size > maxMetadataSize {
+		return nil, fmt.Errorf("%w: %d bytes, max %d", errMetadataTooLarge, size, maxMetadataSize)
+	}
+	return metadata, nil
+}
+
+// setMetadataHeaders replays the custom metadata of a file
+// as X-Meta- response headers
+func setMetadataHeaders(h http.Header, metadata map[string]string) {
+	for key, value := range metadata {
+		h.Set(metadataHeaderPrefix+key, value)
+	}
+}
+
+// copyMetadata returns a copy of the file's custom metadata
+// safe to use without holding its lock
+func (f *FileObject) copyMetadata() map[string]string {
+	f.attrMu.RLock()
+	defer f.attrMu.RUnlock()
+	return copyStringMap(f.Metadata)
+}
+
+// copyChecksums returns a copy of the file's checksums
+// safe to use without holding its lock
+func (f *FileObject) copyChecksums() map[string]string {
+	f.attrMu.RLock()
+	defer f.attrMu.RUnlock()
+	return copyStringMap(f.Checksums)
+}
+
+// size returns the size of the file in bytes
+func (f *FileObject) size() int64 {
+	f.attrMu.RLock()
+	defer f.attrMu.RUnlock()
+	return f.Size
+}
+
+// copyStringMap returns a copy of m
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
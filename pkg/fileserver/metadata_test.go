@@ -0,0 +1,59 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetadataLimits(t *testing.T) {
+	_, srv := newTestService(t)
+
+	manyHeaders := func(count, size int) http.Header {
+		header := http.Header{}
+		for i := 0; i < count; i++ {
+			header.Set(fmt.Sprintf("X-Meta-Key%d", i), strings.Repeat("v", size))
+		}
+		return header
+	}
+	tests := []struct {
+		desc   string
+		header http.Header
+		want   int
+	}{
+		{"within the limits", manyHeaders(4, 1000), http.StatusCreated},
+		{"oversized value", manyHeaders(1, maxMetadataValueSize+1), http.StatusRequestHeaderFieldsTooLarge},
+		{"oversized total", manyHeaders(5, maxMetadataValueSize), http.StatusRequestHeaderFieldsTooLarge},
+		{"too many headers", manyHeaders(maxMetadataEntries+1, 1), http.StatusBadRequest},
+	}
+	for i, tt := range tests {
+		resp, body := doRequest(t, http.MethodPut, fmt.Sprintf("%s/upload/%d.txt", srv.URL, i), strings.NewReader("content"), tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	DefaultStoragePath = filepath.Join(t.TempDir(), "files")
+	s, err := NewFileService(func(s *FileService) { s.MaxHeaderBytes = 1 << 10 })
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(s.HTTPServer.Handler)
+	srv.Config.MaxHeaderBytes = s.HTTPServer.MaxHeaderBytes
+	srv.Start()
+	defer srv.Close()
+
+	// net/http allows 4KB over the limit
+	header := http.Header{"X-Padding": {strings.Repeat("p", 8<<10)}}
+	if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, header); resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("oversized headers got %d, want %d", resp.StatusCode, http.StatusRequestHeaderFieldsTooLarge)
+	}
+	if resp, _ := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("small headers got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
@@ -0,0 +1,194 @@
+package fileserver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// mirrorQueueSize is the most uploads waiting to be
+// mirrored, uploads past it are not mirrored
+const mirrorQueueSize = 1024
+
+// MirrorStats describes the health of the upload mirror,
+// it is part of the stats endpoint's JSON body
+type MirrorStats struct {
+	// Pending is the number of uploads not mirrored yet
+	Pending int `json:"pending"`
+
+	// Failures counts the uploads that couldn't be mirrored
+	Failures int64 `json:"failures"`
+
+	LastError      string    `json:"lastError,omitempty"`
+	LastMirroredAt time.Time `json:"lastMirroredAt"`
+}
+
+// mirror copies uploaded files to a secondary dir in
+// the background, one at a time
+type mirror struct {
+	path  string
+	queue chan string
+
+	mu    sync.Mutex
+	stats MirrorStats
+}
+
+// newMirror creates the mirror dir and returns a mirror
+// copying files into it, the dir must not be within the
+// storage dir (the copies would be scanned as uploads)
+func (s *FileService) newMirror() (*mirror, error) {
+	absPath, err := filepath.Abs(s.MirrorPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkOutsideStorage(absPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(absPath, 0774); err != nil {
+		return nil, err
+	}
+
+	// Check again with symlinks resolved
+	path, err := resolveStoragePath(absPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkOutsideStorage(path); err != nil {
+		return nil, err
+	}
+	if err := checkStorageDir(path); err != nil {
+		return nil, err
+	}
+	return &mirror{
+		path:  path,
+		queue: make(chan string, mirrorQueueSize),
+	}, nil
+}
+
+// checkOutsideStorage verifies the mirror dir path is
+// not the storage dir or within it
+func (s *FileService) checkOutsideStorage(path string) error {
+	if path == s.StoragePath || strings.HasPrefix(path, s.StoragePath+string(filepath.Separator)) {
+		return fmt.Errorf("mirror dir %q is within the storage dir", path)
+	}
+	return nil
+}
+
+// mirrorUpload queues the file name to be copied to the
+// mirror dir (if configured) without blocking the upload
+func (s *FileService) mirrorUpload(name string) {
+	if s.mirror == nil {
+		return
+	}
+
+	m := s.mirror
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case m.queue <- name:
+		m.stats.Pending++
+	default:
+		log.Error().
+			Str("fileName", name).
+			Msg("Mirror queue is full, not mirroring upload")
+		m.stats.Failures++
+		m.stats.LastError = "mirror queue is full"
+	}
+}
+
+// runMirror copies the queued uploads to the mirror dir
+// until the service is stopped
+func (s *FileService) runMirror() {
+	m := s.mirror
+	for {
+		select {
+		case <-s.done:
+			return
+		case name := <-m.queue:
+			err := s.mirrorFile(name)
+
+			m.mu.Lock()
+			m.stats.Pending--
+			if err != nil {
+				m.stats.Failures++
+				m.stats.LastError = err.Error()
+			} else {
+				m.stats.LastMirroredAt = time.Now()
+			}
+			m.mu.Unlock()
+
+			if err != nil {
+				log.Error().Err(err).
+					Str("fileName", name).
+					Msg("Unable to mirror upload")
+			}
+		}
+	}
+}
+
+// mirrorFile copies the current version of the file to
+// the mirror dir, writing a temp file first so the mirror
+// never holds a partial copy
+func (s *FileService) mirrorFile(name string) error {
+	fileObj, found := s.lookup(name)
+	if !found {
+		// Removed before it could be mirrored
+		return nil
+	}
+
+	fileObj.Mu.RLock()
+	defer fileObj.Mu.RUnlock()
+
+	src, err := os.Open(fileObj.Path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Mirrored where it is stored, the key of a name can
+	// change (e.g. with the date layout)
+	key, err := filepath.Rel(s.StoragePath, fileObj.Path)
+	if err != nil {
+		return err
+	}
+	dstPath := filepath.Join(s.mirror.path, key)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0774); err != nil {
+		return err
+	}
+	dst, err := os.CreateTemp(filepath.Dir(dstPath), ".mirror-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	if err := os.Rename(dst.Name(), dstPath); err != nil {
+		os.Remove(dst.Name())
+		return err
+	}
+	return nil
+}
+
+// mirrorStats returns the health of the upload mirror,
+// nil when no mirror is configured
+func (s *FileService) mirrorStats() *MirrorStats {
+	if s.mirror == nil {
+		return nil
+	}
+	s.mirror.mu.Lock()
+	defer s.mirror.mu.Unlock()
+	stats := s.mirror.stats
+	return &stats
+}
@@ -0,0 +1,263 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// internalDir is the dir within the storage dir where the
+// server keeps its own state (e.g. partial uploads), it is
+// not visible to or writable by clients
+const internalDir = ".fileserver"
+
+// generatedExtRegex matches the extensions accepted for
+// generated file names
+var generatedExtRegex = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+
+// slugUnsafeRegex matches the runs of characters that
+// are replaced by a single "-" when slugifying a name
+var slugUnsafeRegex = regexp.MustCompile(`[^a-z0-9._]+`)
+
+// slugify normalizes a file name into a filesystem friendly
+// one, e.g. "My Report (Final).PDF" becomes "my-report-final.pdf"
+func slugify(name string) string {
+	slug := slugUnsafeRegex.ReplaceAllString(strings.ToLower(name), "-")
+	slug = strings.ReplaceAll(slug, "-.", ".")
+	return strings.Trim(slug, "-.")
+}
+
+// generateName returns a random name not used by any
+// stored file, ending in ext (if given), e.g.
+// "3f9c2a7be41d0c68.txt"
+func (s *FileService) generateName(ext string) (string, error) {
+	ext = strings.TrimPrefix(ext, ".")
+	if ext != "" && !generatedExtRegex.MatchString(ext) {
+		return "", fmt.Errorf("invalid extension %q", ext)
+	}
+
+	for {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		name := s.RequiredNamePrefix + hex.EncodeToString(random)
+		if ext != "" {
+			name += "." + ext
+		}
+		if _, found := s.lookup(name); !found {
+			return name, nil
+		}
+	}
+}
+
+// resolveStoragePath returns the absolute path of dir with
+// any symlinks evaluated, so a symlinked storage dir is
+// read consistently and containment checks compare
+// against its real location on disk
+func resolveStoragePath(dir string) (string, error) {
+	absPath, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(absPath)
+}
+
+// checkStorageDir verifies dir is a directory the server
+// can create files in, so a misconfigured storage dir
+// (e.g. a regular file, or a read-only mount) fails at
+// startup rather than on the first upload
+func checkStorageDir(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("unable to stat storage dir %q: %w", dir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("storage dir %q is not a directory", dir)
+	}
+
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("storage dir %q is not writable: %w", dir, err)
+	}
+	probe.Close()
+	if err := os.Remove(probe.Name()); err != nil {
+		return fmt.Errorf("unable to remove write probe from storage dir %q: %w", dir, err)
+	}
+	return nil
+}
+
+// localPath returns the on-disk path for the file name,
+// ensuring it stays within the storage dir (e.g. a name
+// like "../../etc/passwd" is rejected) and out of the
+// server's internal dir
+// The name is checked on its own as well as its storage
+// key, so it can't escape the sub dir the key puts it in
+// Names that aren't clean (e.g. "./a.txt", "a//a.txt" or
+// "a.txt/") are rejected, or they would be separate DB
+// entries of the same file on disk
+func (s *FileService) localPath(name string) (string, error) {
+	if path.Clean(name) != name {
+		return "", fmt.Errorf("%w: %q is not a clean path", ErrInvalidName, name)
+	}
+	if err := s.checkNameDepth(name); err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(name, s.RequiredNamePrefix) {
+		return "", fmt.Errorf("%w (%q)", errMissingNamePrefix, name)
+	}
+	if _, err := s.keyPath(name, name); err != nil {
+		return "", err
+	}
+	return s.keyPath(name, s.KeyFunc(name))
+}
+
+// errMissingNamePrefix is returned for a file name not
+// starting with RequiredNamePrefix
+var errMissingNamePrefix = fmt.Errorf("%w: name is missing the required prefix", ErrInvalidName)
+
+// checkNameDepth returns an error if the file name is
+// nested deeper than MaxNameDepth dirs or has a segment
+// longer than MaxNameSegmentLength, so clients can't have
+// pathologically deep trees created in the storage dir
+func (s *FileService) checkNameDepth(name string) error {
+	depth := 0
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" {
+			continue
+		}
+		depth++
+		if s.MaxNameSegmentLength > 0 && int64(len(segment)) > s.MaxNameSegmentLength {
+			return fmt.Errorf("file name %q has a segment longer than %d bytes", name, s.MaxNameSegmentLength)
+		}
+	}
+	if s.MaxNameDepth > 0 && int64(depth) > s.MaxNameDepth {
+		return fmt.Errorf("file name %q is nested deeper than %d levels", name, s.MaxNameDepth)
+	}
+	return nil
+}
+
+// keyPath returns the on-disk path of the storage key of
+// the file name, if it is a valid location for the file
+func (s *FileService) keyPath(name, key string) (string, error) {
+	filePath := filepath.Join(s.StoragePath, filepath.FromSlash(key))
+	if !strings.HasPrefix(filePath, s.StoragePath+string(filepath.Separator)) {
+		return "", fmt.Errorf("file name %q is outside the storage dir", name)
+	}
+	reserved := filepath.Join(s.StoragePath, internalDir)
+	if filePath == reserved || strings.HasPrefix(filePath, reserved+string(filepath.Separator)) {
+		return "", fmt.Errorf("file name %q is reserved", name)
+	}
+	return filePath, nil
+}
+
+// errDotDotSegment is returned for a path with a ".."
+// segment, which is never resolved against the storage dir
+var errDotDotSegment = errors.New(`path has a ".." segment`)
+
+// normalizePath collapses the duplicate slashes and drops
+// the "." segments of the URL path p, keeping a trailing
+// slash (e.g. "/download//a/./b.txt" is "/download/a/b.txt")
+func normalizePath(p string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(p, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			return "", errDotDotSegment
+		default:
+			segments = append(segments, segment)
+		}
+	}
+	normalized := "/" + strings.Join(segments, "/")
+	if len(segments) > 0 && strings.HasSuffix(p, "/") {
+		normalized += "/"
+	}
+	return normalized, nil
+}
+
+// normalizePaths normalizes the request path before it is
+// routed, so every handler looks up the same name for a
+// sloppily built URL, instead of the mux redirecting it
+// (which clients don't follow for uploads)
+func (s *FileService) normalizePaths(next http.Handler) http.Handler {
+	if !s.NormalizePaths {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		normalized, err := normalizePath(r.URL.Path)
+		if err != nil {
+			log.Info().
+				Str("path", r.URL.Path).
+				Msg("Rejecting path with a dot-dot segment")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Please provide a valid file name."))
+			return
+		}
+		if normalized != r.URL.Path {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = normalized
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isCanonicalHost reports whether host (a Host header) is
+// the canonical one, ignoring the port unless canonical
+// has one
+func isCanonicalHost(host, canonical string) bool {
+	if _, _, err := net.SplitHostPort(canonical); err != nil {
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+	}
+	return strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(canonical, "."))
+}
+
+// redirectToCanonicalHost redirects requests for any other
+// host than CanonicalHost to the same path and query on
+// it, except the ones to ignoredPaths (e.g. health probes
+// sent to the pod IP)
+func (s *FileService) redirectToCanonicalHost(next http.Handler) http.Handler {
+	if s.CanonicalHost == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(r.URL.Path, "/")
+		if isCanonicalHost(r.Host, s.CanonicalHost) || slices.Contains(ignoredPaths, path[1]) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		target := scheme + "://" + s.CanonicalHost + r.URL.RequestURI()
+		log.Debug().
+			Str("host", r.Host).
+			Str("location", target).
+			Msg("Redirecting to the canonical host")
+
+		// Other methods than GET and HEAD keep their method
+		// and body on a 308, clients turn a 301 into a GET
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, status)
+	})
+}
@@ -0,0 +1,301 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSymlinkedStorageDir(t *testing.T) {
+	root := t.TempDir()
+	realDir := filepath.Join(root, "data")
+	if err := os.Mkdir(realDir, 0774); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(realDir, "existing.txt"), []byte("hello"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	DefaultStoragePath = filepath.Join(root, "files")
+	if err := os.Symlink(realDir, DefaultStoragePath); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFileService()
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	srv := httptest.NewServer(s.HTTPServer.Handler)
+	defer srv.Close()
+
+	resolved, err := filepath.EvalSymlinks(realDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.StoragePath != resolved {
+		t.Errorf("StoragePath = %q, want the resolved %q", s.StoragePath, resolved)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/download/existing.txt", http.StatusOK},
+		{http.MethodPut, "/upload/new.txt", http.StatusCreated},
+		{http.MethodGet, "/download/new.txt", http.StatusOK},
+		{http.MethodPut, "/upload/?name=" + url.QueryEscape("../escape.txt"), http.StatusBadRequest},
+		{http.MethodPut, "/upload/?name=" + url.QueryEscape("a/../../escape.txt"), http.StatusBadRequest},
+		{http.MethodPut, "/upload/?name=" + url.QueryEscape(".fileserver/x"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader("content"), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s got %d (%s), want %d", tt.method, tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(realDir, "new.txt")); err != nil {
+		t.Errorf("upload isn't in the real storage dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape.txt")); err == nil {
+		t.Errorf("upload escaped the storage dir")
+	}
+}
+
+func TestStorageDirValidation(t *testing.T) {
+	tests := []struct {
+		desc    string
+		prepare func(path string) error
+		wantErr string
+	}{
+		{"missing dir is created", func(string) error { return nil }, ""},
+		{"existing dir", func(path string) error { return os.Mkdir(path, 0774) }, ""},
+		{"regular file", func(path string) error { return os.WriteFile(path, []byte("not a dir"), 0664) }, "is not a directory"},
+		{"dangling symlink", func(path string) error { return os.Symlink(filepath.Join(filepath.Dir(path), "missing"), path) }, "no such file"},
+	}
+	for _, tt := range tests {
+		DefaultStoragePath = filepath.Join(t.TempDir(), "files")
+		if err := tt.prepare(DefaultStoragePath); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := NewFileService()
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: NewFileService: %v", tt.desc, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: NewFileService returned %v, want an error containing %q", tt.desc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGeneratedNames(t *testing.T) {
+	_, srv := newTestService(t)
+
+	tests := []struct {
+		desc    string
+		path    string
+		wantExt string
+		want    int
+	}{
+		{"empty name", "/upload/", "", http.StatusCreated},
+		{"empty name again", "/upload/", "", http.StatusCreated},
+		{"generate flag", "/upload/ignored.txt?generate=true", "", http.StatusCreated},
+		{"extension", "/upload/?ext=png", ".png", http.StatusCreated},
+		{"extension with a dot", "/upload/?ext=.png", ".png", http.StatusCreated},
+		{"invalid extension", "/upload/?ext=../x", "", http.StatusBadRequest},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPut, srv.URL+tt.path, strings.NewReader("content of "+tt.desc), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+			continue
+		}
+		if tt.want != http.StatusCreated {
+			continue
+		}
+
+		location := resp.Header.Get("Location")
+		name, err := url.PathUnescape(strings.TrimPrefix(location, "/download/"))
+		if err != nil || name == "" || name == "ignored.txt" || filepath.Ext(name) != tt.wantExt {
+			t.Errorf("%s: stored at %q, want a generated name with the extension %q", tt.desc, location, tt.wantExt)
+		}
+		if !strings.Contains(body, name) || !strings.Contains(body, location) {
+			t.Errorf("%s: body %q doesn't have the name and download URL", tt.desc, body)
+		}
+		if seen[name] {
+			t.Errorf("%s: generated %s twice", tt.desc, name)
+		}
+		seen[name] = true
+
+		if _, got := doRequest(t, http.MethodGet, srv.URL+location, nil, nil); got != "content of "+tt.desc {
+			t.Errorf("%s: downloading %s got %q", tt.desc, location, got)
+		}
+	}
+}
+
+func TestNormalizePaths(t *testing.T) {
+	_, srv := newTestService(t)
+	uploadFile(t, srv, "foo.txt", "foo")
+	uploadFile(t, srv, "dir/bar.txt", "bar")
+
+	tests := []struct {
+		path     string
+		want     int
+		wantBody string
+	}{
+		{"/download/foo.txt", http.StatusOK, "foo"},
+		{"/download//foo.txt", http.StatusOK, "foo"},
+		{"/download/./foo.txt", http.StatusOK, "foo"},
+		{"//download/foo.txt", http.StatusOK, "foo"},
+		{"/download/.//./foo.txt", http.StatusOK, "foo"},
+		{"/download/dir//bar.txt", http.StatusOK, "bar"},
+		{"/download/dir/./bar.txt", http.StatusOK, "bar"},
+		{"/download//dir///bar.txt", http.StatusOK, "bar"},
+		{"/download/../foo.txt", http.StatusBadRequest, ""},
+		{"/download/dir/../foo.txt", http.StatusBadRequest, ""},
+		{"/download/%2E%2E/foo.txt", http.StatusBadRequest, ""},
+		// The query form isn't normalized, names that aren't
+		// clean don't match a stored file
+		{"/download?name=" + url.QueryEscape("./foo.txt"), http.StatusNotFound, ""},
+		{"/download?name=" + url.QueryEscape("dir//bar.txt"), http.StatusNotFound, ""},
+		{"/download?name=" + url.QueryEscape("foo.txt/"), http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+tt.path, nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s got %d (%s), want %d", tt.path, resp.StatusCode, body, tt.want)
+		}
+		if tt.wantBody != "" && body != tt.wantBody {
+			t.Errorf("GET %s got %q, want %q", tt.path, body, tt.wantBody)
+		}
+	}
+
+	// ...and aren't stored as another entry of the file
+	for _, name := range []string{"./foo.txt", "dir//bar.txt", "foo.txt/"} {
+		if resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload?name="+url.QueryEscape(name), strings.NewReader("again"), nil); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("upload of %q got %d (%s), want %d", name, resp.StatusCode, body, http.StatusBadRequest)
+		}
+	}
+
+	// Uploads to sloppy URLs are stored under the clean name
+	uploadFile(t, srv, "dir//./baz.txt", "baz")
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil); body != "dir/bar.txt\ndir/baz.txt\nfoo.txt" {
+		t.Errorf("list got %q, want the clean names", body)
+	}
+}
+
+func TestMaxNameDepth(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) {
+		s.MaxNameDepth = 3
+		s.MaxNameSegmentLength = 16
+	})
+
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"a/b/c.txt", http.StatusCreated},
+		{"a/b/c/d.txt", http.StatusBadRequest},
+		{strings.Repeat("a/", 100) + "z.txt", http.StatusBadRequest},
+		{strings.Repeat("x", 16), http.StatusCreated},
+		{strings.Repeat("x", 17), http.StatusBadRequest},
+		{"a/" + strings.Repeat("x", 17) + "/c.txt", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/"+tt.name, strings.NewReader("content"), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("upload %q got %d (%s), want %d", tt.name, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	// A rejected name leaves no dirs behind
+	if _, err := os.Stat(filepath.Join(s.StoragePath, "a", "b", "c")); !os.IsNotExist(err) {
+		t.Errorf("the dirs of a name nested too deep were created: %v", err)
+	}
+}
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		canonical    string
+		method       string
+		host         string
+		path         string
+		want         int
+		wantLocation string
+	}{
+		{"files.example.com", http.MethodGet, "files.example.com", "/download/a.txt", http.StatusOK, ""},
+		{"files.example.com", http.MethodGet, "FILES.example.com.:8080", "/download/a.txt", http.StatusOK, ""},
+		{"files.example.com", http.MethodGet, "10.0.0.1:8080", "/download/a.txt?offset=1&length=2", http.StatusMovedPermanently, "http://files.example.com/download/a.txt?offset=1&length=2"},
+		{"files.example.com", http.MethodPut, "other.example.com", "/upload/b.txt", http.StatusPermanentRedirect, "http://files.example.com/upload/b.txt"},
+		{"files.example.com:8443", http.MethodGet, "files.example.com:8080", "/list/", http.StatusMovedPermanently, "http://files.example.com:8443/list/"},
+		// Probes are never redirected
+		{"files.example.com", http.MethodGet, "10.0.0.1:8080", "/healthz", http.StatusOK, ""},
+		// Unconfigured, any host is served
+		{"", http.MethodGet, "10.0.0.1:8080", "/download/a.txt", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		s, _ := newTestService(t, func(s *FileService) { s.CanonicalHost = tt.canonical })
+		upload := httptest.NewRequest(http.MethodPut, "/upload/a.txt", strings.NewReader("hello"))
+		upload.Host = tt.canonical
+		rec := httptest.NewRecorder()
+		s.HTTPServer.Handler.ServeHTTP(rec, upload)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("canonical %q: upload got %d, want %d", tt.canonical, rec.Code, http.StatusCreated)
+		}
+
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader("content"))
+		req.Host = tt.host
+		rec = httptest.NewRecorder()
+		s.HTTPServer.Handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want || rec.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("canonical %q: %s %s%s got %d to %q, want %d to %q", tt.canonical, tt.method, tt.host, tt.path, rec.Code, rec.Header().Get("Location"), tt.want, tt.wantLocation)
+		}
+	}
+}
+
+func TestRequiredNamePrefix(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.RequiredNamePrefix = "team-a/" })
+
+	tests := []struct {
+		desc         string
+		path         string
+		want         int
+		wantLocation string
+	}{
+		{"compliant", "/upload/team-a/a.txt", http.StatusCreated, "/download/team-a%2Fa.txt"},
+		{"non-compliant", "/upload/b.txt", http.StatusBadRequest, ""},
+		{"other namespace", "/upload/team-b/b.txt", http.StatusBadRequest, ""},
+		{"prefix without its slash", "/upload/team-ab.txt", http.StatusBadRequest, ""},
+		{"auto-prefixed", "/upload/c.txt?autoprefix=true", http.StatusCreated, "/download/team-a%2Fc.txt"},
+		{"auto-prefixed compliant", "/upload/team-a/d.txt?autoprefix=true", http.StatusCreated, "/download/team-a%2Fd.txt"},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPut, srv.URL+tt.path, strings.NewReader("content"), nil)
+		if resp.StatusCode != tt.want || resp.Header.Get("Location") != tt.wantLocation {
+			t.Errorf("%s: got %d (%s) to %q, want %d to %q", tt.desc, resp.StatusCode, body, resp.Header.Get("Location"), tt.want, tt.wantLocation)
+		}
+	}
+
+	// A file put in the storage dir out of band outside the
+	// namespace isn't listed
+	if err := os.WriteFile(filepath.Join(s.StoragePath, "other.txt"), []byte("content"), 0o664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	_, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil)
+	if want := "team-a/a.txt\nteam-a/c.txt\nteam-a/d.txt"; body != want {
+		t.Errorf("list got %q, want %q", body, want)
+	}
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/team-a/c.txt", nil, nil)
+	if resp.StatusCode != http.StatusOK || body != "content" {
+		t.Errorf("downloading the auto-prefixed file got %d %q", resp.StatusCode, body)
+	}
+}
@@ -0,0 +1,164 @@
+package fileserver
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// quotaEntry is a number of bytes uploaded at a time
+type quotaEntry struct {
+	at    time.Time
+	bytes int64
+}
+
+// uploadQuota tracks the bytes uploaded by each client IP
+// within a rolling window, so a single source can't
+// monopolize the storage
+type uploadQuota struct {
+	mu     sync.Mutex
+	limit  int64
+	window time.Duration
+	usage  map[string][]quotaEntry
+
+	// reserved are the bytes of the uploads of each IP
+	// still in progress
+	reserved map[string]int64
+}
+
+// newUploadQuota returns a quota of limit bytes per window
+func newUploadQuota(limit int64, window time.Duration) *uploadQuota {
+	return &uploadQuota{
+		limit:    limit,
+		window:   window,
+		usage:    map[string][]quotaEntry{},
+		reserved: map[string]int64{},
+	}
+}
+
+// used returns the bytes ip uploaded within the window,
+// the caller must hold the lock
+func (q *uploadQuota) used(ip string, now time.Time) int64 {
+	entries := q.usage[ip]
+
+	// Entries are appended in time order, drop the
+	// ones that fell out of the window
+	expired := 0
+	for expired < len(entries) && now.Sub(entries[expired].at) >= q.window {
+		expired++
+	}
+	entries = entries[expired:]
+	if len(entries) == 0 {
+		delete(q.usage, ip)
+		return 0
+	}
+	q.usage[ip] = entries
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.bytes
+	}
+	return total
+}
+
+// reserve reserves size bytes of ip's quota for an upload
+// in progress, reporting whether they fit along with the
+// bytes used and reserved by its other uploads
+func (q *uploadQuota) reserve(ip string, size int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.used(ip, time.Now())+q.reserved[ip]+size > q.limit {
+		return false
+	}
+	q.reserved[ip] += size
+	return true
+}
+
+// settle ends the reservation of reserved bytes by an
+// upload of ip, adding the written ones to its usage
+func (q *uploadQuota) settle(ip string, reserved, written int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.reserved[ip] -= reserved; q.reserved[ip] <= 0 {
+		delete(q.reserved, ip)
+	}
+	if written > 0 {
+		q.usage[ip] = append(q.usage[ip], quotaEntry{at: time.Now(), bytes: written})
+	}
+}
+
+// quotaReader reserves the bytes of an upload of unknown
+// size in its client's quota as they are read
+type quotaReader struct {
+	q        *uploadQuota
+	ip       string
+	r        io.Reader
+	reserved int64
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if !r.q.reserve(r.ip, int64(n)) {
+			return 0, ErrQuotaExceeded
+		}
+		r.reserved += int64(n)
+	}
+	return n, err
+}
+
+// reserveQuota reserves the size bytes of an upload by ip
+// in its quota, returning the reader to read its body
+// through and the func that settles the quota with the
+// bytes written once it completes or fails. An upload of
+// unknown size (e.g. chunked) reserves its bytes as they
+// are read, failing with ErrQuotaExceeded once over the
+// quota. Uploads through the API (without a client IP)
+// aren't accounted
+func (s *FileService) reserveQuota(ip string, body io.Reader, size int64) (io.Reader, func(written int64), error) {
+	if s.quota == nil || ip == "" {
+		return body, func(int64) {}, nil
+	}
+	if size < 0 {
+		counted := &quotaReader{q: s.quota, ip: ip, r: body}
+		return counted, func(written int64) { s.quota.settle(ip, counted.reserved, written) }, nil
+	}
+	if !s.quota.reserve(ip, size) {
+		log.Error().
+			Str("clientIP", ip).
+			Msg("Client exceeded its upload quota. Skipping.")
+		return nil, nil, ErrQuotaExceeded
+	}
+	return body, func(written int64) { s.quota.settle(ip, size, written) }, nil
+}
+
+// evict forgets the IPs with no uploads in the window
+func (q *uploadQuota) evict() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	for ip := range q.usage {
+		q.used(ip, now)
+	}
+}
+
+// evictQuota periodically evicts idle IPs from the upload
+// quota until the service is stopped
+func (s *FileService) evictQuota() {
+	ticker := time.NewTicker(s.quota.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.quota.evict()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package fileserver
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadQuotaPerClient(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, srv := newTestService(t, func(s *FileService) {
+		s.UploadQuota = 10
+		s.TrustedProxies = []*net.IPNet{loopback}
+	})
+
+	// The steps share the quota, in order
+	tests := []struct {
+		clientIP string
+		name     string
+		content  string
+		want     int
+	}{
+		{"203.0.113.1", "a1.txt", "12345678", http.StatusCreated},
+		{"203.0.113.1", "a2.txt", "12345678", http.StatusTooManyRequests},
+		{"203.0.113.2", "b1.txt", "12345678", http.StatusCreated},
+		{"203.0.113.2", "b2.txt", "12", http.StatusCreated},
+		{"203.0.113.2", "b3.txt", "1", http.StatusTooManyRequests},
+		{"203.0.113.1", "a3.txt", "12", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		header := http.Header{"X-Forwarded-For": {tt.clientIP}}
+		resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/"+tt.name, strings.NewReader(tt.content), header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s uploading %s got %d (%s), want %d", tt.clientIP, tt.name, resp.StatusCode, body, tt.want)
+		}
+	}
+}
+
+func TestUploadQuotaConcurrent(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.UploadQuota = 1 << 20 })
+
+	// An upload in progress holds its bytes of the quota
+	body, bodyWriter := io.Pipe()
+	first := make(chan int)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+"/upload/held.bin", body)
+		req.ContentLength = 800 << 10
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			first <- 0
+			return
+		}
+		resp.Body.Close()
+		first <- resp.StatusCode
+	}()
+	bodyWriter.Write([]byte("x"))
+	for {
+		s.quota.mu.Lock()
+		reserved := s.quota.reserved["127.0.0.1"]
+		s.quota.mu.Unlock()
+		if reserved > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	tests := []struct {
+		desc string
+		body io.Reader
+		want int
+	}{
+		{"upload over the rest of the quota", strings.NewReader(strings.Repeat("a", 300<<10)), http.StatusTooManyRequests},
+		{"chunked upload over the rest of the quota", chunked(strings.NewReader(strings.Repeat("b", 300<<10))), http.StatusTooManyRequests},
+		{"upload within the rest of the quota", strings.NewReader(strings.Repeat("c", 100<<10)), http.StatusCreated},
+		{"chunked upload within the rest of the quota", chunked(strings.NewReader(strings.Repeat("d", 100<<10))), http.StatusCreated},
+	}
+	for i, tt := range tests {
+		resp, respBody := doRequest(t, http.MethodPut, fmt.Sprintf("%s/upload/%d.bin", srv.URL, i), tt.body, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, respBody, tt.want)
+		}
+	}
+
+	bodyWriter.Write([]byte(strings.Repeat("x", 800<<10-1)))
+	bodyWriter.Close()
+	if got := <-first; got != http.StatusCreated {
+		t.Errorf("held upload got %d, want %d", got, http.StatusCreated)
+	}
+
+	// The quota is now used up by the stored files
+	resp, respBody := doRequest(t, http.MethodPut, srv.URL+"/upload/more.bin", strings.NewReader(strings.Repeat("e", 100<<10)), nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("upload after the quota is used got %d (%s), want %d", resp.StatusCode, respBody, http.StatusTooManyRequests)
+	}
+}
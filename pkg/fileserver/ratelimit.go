@@ -0,0 +1,122 @@
+package fileserver
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// requestLimiterIdle is how long a client IP is kept by a
+// request limiter after its last request
+const requestLimiterIdle = 10 * time.Minute
+
+// requestLimiterClient is the limiter of a client IP
+type requestLimiterClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// requestLimiter limits the rate of requests each client
+// IP makes to a group of routes (e.g. the enumerating
+// ones), apart from the other groups
+type requestLimiter struct {
+	mu      sync.Mutex
+	group   string
+	limit   rate.Limit
+	burst   int
+	clients map[string]*requestLimiterClient
+}
+
+// newRequestLimiter returns a limiter of perMinute requests
+// per client IP to the group of routes, allowing bursts of
+// up to burst requests
+func newRequestLimiter(group string, perMinute, burst int64) *requestLimiter {
+	return &requestLimiter{
+		group:   group,
+		limit:   rate.Limit(float64(perMinute) / 60),
+		burst:   int(burst),
+		clients: map[string]*requestLimiterClient{},
+	}
+}
+
+// reserve takes a request of ip from its limiter, returning
+// how long it has to wait for one when none is left
+func (l *requestLimiter) reserve(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	client, found := l.clients[ip]
+	if !found {
+		client = &requestLimiterClient{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+
+	reservation := client.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// Rejected requests don't count against the limit
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// evict forgets the client IPs idle for requestLimiterIdle
+func (l *requestLimiter) evict() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, client := range l.clients {
+		if time.Since(client.lastSeen) >= requestLimiterIdle {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// rateLimited wraps the handlers of a group of routes so
+// client IPs over the group's rate get a 429, nil limiter
+// means the group isn't limited
+func (s *FileService) rateLimited(l *requestLimiter, h http.Handler) http.Handler {
+	if l == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := s.clientIP(r)
+		if delay := l.reserve(ip); delay > 0 {
+			log.Info().
+				Str("clientIP", ip).
+				Str("group", l.group).
+				Msg("Client exceeded its request rate. Skipping.")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(fmt.Sprintf("Too many %s requests, please try again later", l.group)))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// evictRequestLimiters periodically evicts idle client IPs
+// from the request limiters until the service is stopped
+func (s *FileService) evictRequestLimiters(limiters ...*requestLimiter) {
+	ticker := time.NewTicker(requestLimiterIdle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			for _, l := range limiters {
+				l.evict()
+			}
+		}
+	}
+}
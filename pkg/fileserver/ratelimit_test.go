@@ -0,0 +1,48 @@
+package fileserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestListRateLimit(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) {
+		s.ListRateLimit = 60
+		s.ListRateBurst = 2
+	})
+	uploadFile(t, srv, "a.txt", "content")
+	handler := s.HTTPServer.Handler
+
+	// The steps run in order, the client's burst is used up
+	// by the first two
+	tests := []struct {
+		remoteAddr string
+		path       string
+		want       int
+	}{
+		{"192.0.2.1:1234", "/list/", http.StatusOK},
+		{"192.0.2.1:1234", "/stats", http.StatusOK},
+		{"192.0.2.1:1234", "/list/", http.StatusTooManyRequests},
+		{"192.0.2.1:5678", "/feed", http.StatusTooManyRequests},
+		// Downloads aren't limited with the listings
+		{"192.0.2.1:1234", "/download/a.txt", http.StatusOK},
+		{"192.0.2.1:1234", "/download/a.txt", http.StatusOK},
+		{"192.0.2.1:1234", "/stat/a.txt", http.StatusOK},
+		// Nor are other clients
+		{"192.0.2.2:1234", "/list/", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.RemoteAddr = tt.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s from %s got %d (%s), want %d", tt.path, tt.remoteAddr, rec.Code, rec.Body, tt.want)
+			continue
+		}
+		if retryAfter := rec.Header().Get("Retry-After"); tt.want == http.StatusTooManyRequests && retryAfter != "1" {
+			t.Errorf("%s from %s: Retry-After %q, want %q", tt.path, tt.remoteAddr, retryAfter, "1")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package fileserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/zerolog/log"
+)
+
+// requestIDHeader carries the ID of a request, set by the
+// client or a proxy in front of the server
+const requestIDHeader = "X-Request-Id"
+
+// requestID returns the ID of the request, a random one
+// when the client didn't send any
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	rawID := make([]byte, 8)
+	if _, err := rand.Read(rawID); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(rawID)
+}
+
+// recoverWriter records whether the response was started
+type recoverWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *recoverWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recoverWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap returns the ResponseWriter, for
+// http.ResponseController
+func (w *recoverWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recoverPanics wraps the mux so a panic in a handler is
+// logged with its stack and gets the client a 500, rather
+// than only the connection being dropped
+// A response already started can't be turned into a 500,
+// it is aborted so it isn't mistaken for a complete one
+func (s *FileService) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoverWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// Handlers abort responses on purpose with it
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			id := requestID(r)
+			log.Error().
+				Str("requestID", id).
+				Str("method", r.Method).
+				Str("path", r.URL.Path).
+				Interface("panic", v).
+				Str("stack", string(debug.Stack())).
+				Msg("Recovered from a panic in a handler")
+			if rw.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set(requestIDHeader, id)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception processing the request"))
+		}()
+		h.ServeHTTP(rw, r)
+	})
+}
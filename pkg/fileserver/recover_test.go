@@ -0,0 +1,66 @@
+package fileserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	s := &FileService{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("handler bug")
+	})
+	mux.HandleFunc("/partial", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		panic("handler bug")
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	srv := httptest.NewServer(s.recoverPanics(mux))
+	defer srv.Close()
+
+	tests := []struct {
+		path      string
+		requestID string
+		want      int
+	}{
+		{"/panic", "", http.StatusInternalServerError},
+		{"/ok", "", http.StatusOK},
+		{"/panic", "req-1", http.StatusInternalServerError},
+		{"/ok", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.requestID != "" {
+			header.Set(requestIDHeader, tt.requestID)
+		}
+		resp, _ := doRequest(t, http.MethodGet, srv.URL+tt.path, nil, header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("GET %s got %d, want %d", tt.path, resp.StatusCode, tt.want)
+		}
+		if tt.requestID != "" && resp.Header.Get(requestIDHeader) != tt.requestID {
+			t.Errorf("GET %s: request ID %q, want %q", tt.path, resp.Header.Get(requestIDHeader), tt.requestID)
+		}
+		if tt.want == http.StatusInternalServerError && resp.Header.Get(requestIDHeader) == "" {
+			t.Errorf("GET %s: 500 without a request ID", tt.path)
+		}
+	}
+
+	// A response already started is aborted rather than
+	// completed, and the server keeps serving
+	resp, err := http.Get(srv.URL + "/partial")
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("GET /partial completed, want it aborted")
+	}
+	if resp, body := doRequest(t, http.MethodGet, srv.URL+"/ok", nil, nil); resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Errorf("GET /ok after an aborted response got %d %q", resp.StatusCode, body)
+	}
+}
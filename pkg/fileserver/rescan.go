@@ -0,0 +1,253 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RescanResult summarises the changes Rescan made to the DB
+type RescanResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// readDirBatchSize is how many entries of a dir are read
+// at a time while scanning the storage dir, so a dir with
+// millions of files isn't held in memory all at once
+const readDirBatchSize = 1024
+
+// walkStorage calls fn with the name and a new FileObject
+// of every file in the storage dir (and its sub dirs), in
+// no particular order. Dirs are read readDirBatchSize
+// entries at a time, only the paths of the sub dirs left
+// to read are kept
+func (s *FileService) walkStorage(fn func(name string, fileObj *FileObject) error) error {
+	dirs := []string{s.StoragePath}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+
+		subDirs, err := s.walkStorageDir(dir, fn)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, subDirs...)
+	}
+	return nil
+}
+
+// walkStorageDir calls fn for the files of dir, returning
+// the paths of its sub dirs
+func (s *FileService) walkStorageDir(dir string, fn func(name string, fileObj *FileObject) error) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var subDirs []string
+	for {
+		entries, err := f.ReadDir(readDirBatchSize)
+		for _, d := range entries {
+			filePath := filepath.Join(dir, d.Name())
+			if d.IsDir() {
+				if d.Name() != internalDir || dir != s.StoragePath {
+					subDirs = append(subDirs, filePath)
+				}
+				continue
+			}
+
+			// Precompressed variants are served in place of the
+			// file they are next to, they aren't files of their own
+			if s.GzipSidecars && isGzipSidecar(filePath) {
+				continue
+			}
+
+			// Nor are the uploads still being written (a new
+			// file, or the -temp file replacing a stored one)
+			if s.isWriting(filePath) {
+				continue
+			}
+
+			key, err := filepath.Rel(s.StoragePath, filePath)
+			if err != nil {
+				return nil, err
+			}
+			name := s.NameFunc(filepath.ToSlash(key))
+			if name == "" {
+				log.Debug().
+					Str("key", key).
+					Msg("Skipping file not stored under a known key")
+				continue
+			}
+
+			fi, err := d.Info()
+			if err != nil {
+				return nil, err
+			}
+			err = fn(name, &FileObject{
+				Path:       filePath,
+				Mu:         sync.RWMutex{},
+				UploadedAt: fi.ModTime(),
+				Size:       s.plainSize(fi.Size()),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			return subDirs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// startWriting records an upload being written to path,
+// returning the func to call once it is done
+func (s *FileService) startWriting(path string) func() {
+	s.writingMu.Lock()
+	s.writing[path]++
+	s.writingMu.Unlock()
+	return func() {
+		s.writingMu.Lock()
+		defer s.writingMu.Unlock()
+		if s.writing[path]--; s.writing[path] == 0 {
+			delete(s.writing, path)
+		}
+	}
+}
+
+// isWriting reports whether an upload is being written to
+// path
+func (s *FileService) isWriting(path string) bool {
+	s.writingMu.Lock()
+	defer s.writingMu.Unlock()
+	return s.writing[path] > 0
+}
+
+// scanStorage lists the files currently in the storage dir
+// (and its sub dirs), returning a map of file name to a
+// new FileObject for it
+func (s *FileService) scanStorage() (map[string]*FileObject, error) {
+	files := map[string]*FileObject{}
+	err := s.walkStorage(func(name string, fileObj *FileObject) error {
+		files[name] = fileObj
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Rescan re-reads the storage dir and reconciles the DB
+// with it, adding files that appeared on disk and removing
+// entries whose files vanished (e.g. changed out of band
+// by another service sharing the storage path)
+func (s *FileService) Rescan() (RescanResult, error) {
+	result := RescanResult{Added: []string{}, Removed: []string{}}
+
+	files, err := s.scanStorage()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to list contents of local file storage dir")
+		return result, err
+	}
+
+	s.DBMu.Lock()
+	defer s.DBMu.Unlock()
+
+	for name, fileObj := range files {
+		if _, found := s.DB[name]; found {
+			continue
+		}
+		// Deleted since the storage dir was read
+		if _, err := os.Stat(fileObj.Path); err != nil {
+			continue
+		}
+		fileObj.Metadata = s.readExpiry(name)
+		s.DB[name] = fileObj
+		s.indexName(name)
+		s.totalBytes += fileObj.Size
+		result.Added = append(result.Added, name)
+	}
+
+	for name, fileObj := range s.DB {
+		if _, found := files[name]; found {
+			continue
+		}
+		// Stored since the storage dir was read
+		if _, err := os.Stat(fileObj.Path); err == nil {
+			continue
+		}
+		delete(s.DB, name)
+		s.unindexName(name)
+		s.dropRevisions(name)
+		s.saveExpiry(name, nil)
+		s.invalidateCache(name)
+		s.totalBytes -= fileObj.size()
+		result.Removed = append(result.Removed, name)
+	}
+
+	if len(result.Added) > 0 || len(result.Removed) > 0 {
+		s.invalidateList()
+	}
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	if len(result.Added) > 0 || len(result.Removed) > 0 {
+		log.Info().
+			Strs("added", result.Added).
+			Strs("removed", result.Removed).
+			Msg("Reconciled DB with local file storage dir")
+	}
+	return result, nil
+}
+
+// rescan reloads the DB from the storage dir and returns
+// a JSON summary of the files added and removed (unless
+// listing is disabled)
+func (s *FileService) rescan(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msg("Processing rescan")
+
+	result, err := s.Rescan()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception listing the local file storage dir"))
+		return
+	}
+
+	// The summary would enumerate file names
+	if s.DisableList {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// reconcile calls Rescan every interval until the
+// service is stopped
+func (s *FileService) reconcile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.Rescan()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fillStorageDir creates count files in each of the sub
+// dirs of dir ("" for dir itself)
+func fillStorageDir(t testing.TB, dir string, subDirs []string, count int) {
+	t.Helper()
+	for _, subDir := range subDirs {
+		if err := os.MkdirAll(filepath.Join(dir, subDir), 0774); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			if err := os.WriteFile(filepath.Join(dir, subDir, fmt.Sprintf("file-%06d.txt", i)), []byte("content"), 0664); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestStartupScan(t *testing.T) {
+	tests := []struct {
+		desc    string
+		subDirs []string
+		count   int
+	}{
+		{"empty", []string{""}, 0},
+		{"a single batch", []string{""}, readDirBatchSize - 1},
+		{"several batches", []string{""}, 2*readDirBatchSize + 1},
+		{"nested dirs", []string{"", "a", "a/b", "c"}, readDirBatchSize + 1},
+		{"internal dir skipped", []string{"", internalDir}, 10},
+	}
+	for _, tt := range tests {
+		DefaultStoragePath = filepath.Join(t.TempDir(), "files")
+		fillStorageDir(t, DefaultStoragePath, tt.subDirs, tt.count)
+
+		s, err := NewFileService()
+		if err != nil {
+			t.Fatalf("%s: NewFileService: %v", tt.desc, err)
+		}
+		want := 0
+		for _, subDir := range tt.subDirs {
+			if subDir == internalDir {
+				continue
+			}
+			want += tt.count
+			if tt.count > 0 {
+				name := filepath.ToSlash(filepath.Join(subDir, fmt.Sprintf("file-%06d.txt", tt.count-1)))
+				if fileObj, found := s.DB[name]; !found || fileObj.Size != int64(len("content")) {
+					t.Errorf("%s: %s isn't in the DB with its size", tt.desc, name)
+				}
+			}
+		}
+		if len(s.DB) != want {
+			t.Errorf("%s: DB has %d files, want %d", tt.desc, len(s.DB), want)
+		}
+	}
+}
+
+// BenchmarkStartupScan builds the DB from a storage dir
+// with many files
+func BenchmarkStartupScan(b *testing.B) {
+	dir := filepath.Join(b.TempDir(), "files")
+	fillStorageDir(b, dir, []string{"", "sub"}, 25_000)
+	DefaultStoragePath = dir
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s, err := NewFileService()
+		if err != nil {
+			b.Fatalf("NewFileService: %v", err)
+		}
+		if len(s.DB) != 50_000 {
+			b.Fatalf("DB has %d files, want %d", len(s.DB), 50_000)
+		}
+	}
+}
+
+func TestRescan(t *testing.T) {
+	s, srv := newTestService(t)
+	uploadFile(t, srv, "kept.txt", "content")
+	uploadFile(t, srv, "removed.txt", "content")
+	if err := os.WriteFile(filepath.Join(s.StoragePath, "added.txt"), []byte("content"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(s.StoragePath, "removed.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Rescan()
+	if err != nil {
+		t.Fatalf("Rescan: %v", err)
+	}
+	if fmt.Sprint(result.Added) != "[added.txt]" || fmt.Sprint(result.Removed) != "[removed.txt]" {
+		t.Errorf("Rescan added %v and removed %v, want [added.txt] and [removed.txt]", result.Added, result.Removed)
+	}
+
+	// A file deleted while the dir is read isn't added
+	if err := os.WriteFile(filepath.Join(s.StoragePath, "deleted.txt"), []byte("content"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	s.DBMu.Lock()
+	done := make(chan RescanResult)
+	go func() {
+		result, _ := s.Rescan()
+		done <- result
+	}()
+	// Let the scan read the dir, it then waits for the DB
+	time.Sleep(100 * time.Millisecond)
+	if err := os.Remove(filepath.Join(s.StoragePath, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	s.DBMu.Unlock()
+	if result := <-done; len(result.Added) != 0 {
+		t.Errorf("Rescan added %v, a file deleted while scanning", result.Added)
+	}
+	if _, found := s.lookup("deleted.txt"); found {
+		t.Errorf("a file deleted while scanning is in the DB")
+	}
+}
+
+func TestLazyLoad(t *testing.T) {
+	DefaultStoragePath = filepath.Join(t.TempDir(), "files")
+	fillStorageDir(t, DefaultStoragePath, []string{"", "sub"}, 2)
+
+	s, err := NewFileService(func(s *FileService) { s.LazyLoad = true })
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	if len(s.DB) != 0 {
+		t.Fatalf("DB has %d files at startup, want none", len(s.DB))
+	}
+	srv := httptest.NewServer(s.HTTPServer.Handler)
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		want int
+	}{
+		{"file-000000.txt", http.StatusOK},
+		{"sub/file-000001.txt", http.StatusOK},
+		// Looked up again, from the DB
+		{"file-000000.txt", http.StatusOK},
+		{"missing.txt", http.StatusNotFound},
+		{"sub", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("download %s got %d (%s), want %d", tt.name, resp.StatusCode, body, tt.want)
+		}
+		if tt.want == http.StatusOK && body != "content" {
+			t.Errorf("download %s got %q, want %q", tt.name, body, "content")
+		}
+	}
+	if len(s.DB) != 2 {
+		t.Errorf("DB has %d files after the downloads, want the 2 downloaded", len(s.DB))
+	}
+
+	// Listing scans the storage dir
+	_, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil)
+	if want := "file-000000.txt\nfile-000001.txt\nsub/file-000000.txt\nsub/file-000001.txt"; body != want {
+		t.Errorf("list got %q, want %q", body, want)
+	}
+}
@@ -0,0 +1,406 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// contentRangeRegex matches a Content-Range header of the
+// form "bytes <start>-<end>/<total>"
+var contentRangeRegex = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+
+// errRangeMismatch is returned when an uploaded range
+// doesn't continue exactly where the previous one ended
+var errRangeMismatch = errors.New("range does not continue the upload")
+
+// rangeUpload is the state of a resumable upload
+// being assembled from Content-Range requests
+type rangeUpload struct {
+	mu       sync.Mutex
+	path     string
+	total    int64
+	received int64
+	metadata map[string]string
+
+	// lastActive is when the upload last received a part,
+	// expired is set once it was discarded for being idle
+	// longer than RangeUploadTTL
+	lastActive time.Time
+	expired    bool
+}
+
+// partialDir returns the dir the partial files of the
+// range uploads are assembled in
+func (s *FileService) partialDir() string {
+	return filepath.Join(s.StoragePath, internalDir, "partial")
+}
+
+// setReceivedRange tells the client the bytes of the
+// upload received so far, nothing when none was
+func setReceivedRange(w http.ResponseWriter, received int64) {
+	if received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+}
+
+// parseContentRange returns the start, end (inclusive)
+// and total of a Content-Range header
+func parseContentRange(header string) (start, end, total int64, err error) {
+	matches := contentRangeRegex.FindStringSubmatch(header)
+	if matches == nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %q", header)
+	}
+	start, _ = strconv.ParseInt(matches[1], 10, 64)
+	end, _ = strconv.ParseInt(matches[2], 10, 64)
+	total, _ = strconv.ParseInt(matches[3], 10, 64)
+	if start > end || end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return start, end, total, nil
+}
+
+// rangeUploadFor returns the in-progress upload of fileName,
+// starting a new one (with the custom metadata of its first
+// part) if start is 0 and none is in progress
+func (s *FileService) rangeUploadFor(fileName string, start, total int64, metadata map[string]string) (*rangeUpload, error) {
+	s.rangeUploadsMu.Lock()
+	defer s.rangeUploadsMu.Unlock()
+
+	upload, found := s.rangeUploads[fileName]
+	if found {
+		if upload.total != total {
+			return nil, fmt.Errorf("declared total %d does not match the upload in progress (%d)", total, upload.total)
+		}
+		return upload, nil
+	}
+	if start != 0 {
+		return nil, errRangeMismatch
+	}
+
+	partialDir := s.partialDir()
+	if err := os.MkdirAll(partialDir, 0774); err != nil {
+		return nil, err
+	}
+	upload = &rangeUpload{
+		path:       filepath.Join(partialDir, url.QueryEscape(fileName)),
+		total:      total,
+		metadata:   metadata,
+		lastActive: time.Now(),
+	}
+	s.rangeUploads[fileName] = upload
+	return upload, nil
+}
+
+// uploadRange processes one part of a resumable upload, the
+// part's position is given by its Content-Range header
+// Parts must be sent in order without gaps or overlaps, the
+// file is committed once all of the declared total is received
+// curl -T part -H "Content-Range: bytes 0-1023/4096" http://127.0.0.1:37899/upload/filename
+func (s *FileService) uploadRange(w http.ResponseWriter, r *http.Request, fileName string, metadata map[string]string) {
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to parse Content-Range")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a valid Content-Range (bytes <start>-<end>/<total>)"))
+		return
+	}
+	partLength := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != partLength {
+		log.Error().Msg("Content-Length does not match the Content-Range")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Content-Length does not match the Content-Range"))
+		return
+	}
+	if maxUploadSize := s.maxUploadSize(fileName); maxUploadSize > 0 && total > maxUploadSize {
+		log.Error().
+			Int64("maxUploadSize", maxUploadSize).
+			Msg("Upload exceeds the maximum upload size. Skipping.")
+		s.writeTooLarge(w, fileName)
+		return
+	}
+	if _, err := s.localPath(fileName); err != nil {
+		log.Error().Err(err).Msg("Invalid file name. Skipping.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a valid file name."))
+		return
+	}
+	if err := s.checkNameConflict(fileName); err != nil {
+		log.Error().Err(err).Msg("File name conflicts with a stored file. Skipping.")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(fmt.Sprintf("Upload rejected, file names are case-insensitive (%v)", err)))
+		return
+	}
+
+	// The bytes received are counted in the quota even when
+	// the part fails, they are kept for the upload to resume
+	body, settle, err := s.reserveQuota(s.clientIP(r), io.LimitReader(r.Body, partLength), partLength)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	var receivedBytes int64
+	defer func() { settle(receivedBytes) }()
+
+	body, release, err := s.reserveInFlight(body, partLength)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer release()
+
+	upload, err := s.rangeUploadFor(fileName, start, total, metadata)
+	if err != nil {
+		log.Error().Err(err).Msg("Rejecting range upload")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte(fmt.Sprintf("Range upload rejected (%v)", err)))
+		return
+	}
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.expired {
+		log.Error().Msg("Range upload expired")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte("Range upload expired, please start it again from byte 0"))
+		return
+	}
+	upload.lastActive = time.Now()
+
+	// Gaps (start beyond what was received) and overlaps
+	// (start before it) would corrupt the file
+	if start != upload.received {
+		log.Error().
+			Int64("start", start).
+			Int64("received", upload.received).
+			Msg("Range does not continue the upload")
+		setReceivedRange(w, upload.received)
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte(fmt.Sprintf("Expected a range starting at byte %d", upload.received)))
+		return
+	}
+
+	partialFile, err := os.OpenFile(upload.path, os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to open partial file on the server.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Server encountered an exception creating the file locally (%v)", err)))
+		return
+	}
+	defer partialFile.Close()
+
+	if _, err := partialFile.Seek(start, io.SeekStart); err != nil {
+		log.Error().Err(err).Msg("Unable to seek in partial file")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception in processing the upload"))
+		return
+	}
+
+	writtenBytes, err := copyWithContext(r.Context(), partialFile, body)
+	upload.received += writtenBytes
+	receivedBytes = writtenBytes
+	if isAborted(err) || errors.Is(err, io.ErrUnexpectedEOF) {
+		log.Info().
+			Err(err).
+			Int64("writtenBytes", writtenBytes).
+			Msg("Range upload aborted by the client")
+		return
+	}
+	// The received part of the range is kept, so the client
+	// can resume once space has been freed
+	if isDiskFull(err) {
+		log.Warn().
+			Err(err).
+			Int64("writtenBytes", writtenBytes).
+			Msg("Storage is full, range upload paused")
+		setReceivedRange(w, upload.received)
+		w.WriteHeader(http.StatusInsufficientStorage)
+		w.Write([]byte("Server is out of storage space, please resume the upload later"))
+		return
+	}
+	if err != nil || writtenBytes != partLength {
+		log.Error().Err(err).
+			Int64("writtenBytes", writtenBytes).
+			Msg("Unable to write the whole range to disk")
+		setReceivedRange(w, upload.received)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server could not write all the data in the range"))
+		return
+	}
+
+	log.Info().
+		Str("fileName", fileName).
+		Int64("received", upload.received).
+		Int64("total", upload.total).
+		Msg("Wrote range to partial file")
+
+	if upload.received < upload.total {
+		setReceivedRange(w, upload.received)
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(fmt.Sprintf("Received %d of %d bytes", upload.received, upload.total)))
+		return
+	}
+
+	partialFile.Close()
+	s.rangeUploadsMu.Lock()
+	delete(s.rangeUploads, fileName)
+	s.rangeUploadsMu.Unlock()
+
+	if err := s.commitFile(fileName, upload.path, upload.total, upload.metadata); err != nil {
+		os.Remove(upload.path)
+		if errors.Is(err, ErrConflict) {
+			log.Error().Err(err).Msg("File name conflicts with a stored file. Skipping.")
+			s.writeError(w, err)
+			return
+		}
+		if errors.Is(err, ErrContentMismatch) {
+			s.writeError(w, err)
+			return
+		}
+		if errors.Is(err, ErrInfected) {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(fmt.Sprintf("Upload rejected (%v)", err)))
+			return
+		}
+		if isDiskFull(err) {
+			log.Warn().Err(err).Msg("Storage is full, discarded the assembled file")
+			w.WriteHeader(http.StatusInsufficientStorage)
+			w.Write([]byte("Server is out of storage space, please try again later"))
+			return
+		}
+		log.Error().Err(err).Msg("Unable to commit the assembled file")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception while comitting data to local file"))
+		return
+	}
+
+	s.writeCreated(w, fileName, false)
+	s.uploadCommitted(fileName, upload.total)
+}
+
+// uploadCommitted mirrors and notifies the upload of a
+// file assembled from parts once it is committed
+func (s *FileService) uploadCommitted(fileName string, size int64) {
+	fileObj, _ := s.lookup(fileName)
+	checksums := fileObj.copyChecksums()
+	s.mirrorUpload(fileName)
+	s.notifyUpload(UploadEvent{
+		Name:       fileName,
+		Size:       size,
+		Checksum:   checksums[ChecksumSHA256],
+		UploadedAt: time.Now(),
+	})
+}
+
+// commitFile moves the fully written file (of size bytes)
+// at srcPath into place as fileName, overwriting any
+// existing file, and adds it to the DB with its custom
+// metadata and checksums
+func (s *FileService) commitFile(fileName, srcPath string, size int64, metadata map[string]string) error {
+	fileObj, found := s.lookup(fileName)
+	if !found {
+		filePath, err := s.localPath(fileName)
+		if err != nil {
+			return err
+		}
+		fileObj = &FileObject{
+			Path: filePath,
+			Mu:   sync.RWMutex{},
+		}
+	}
+
+	// The assembled file is checked and scanned as
+	// uploaded, before it is encrypted
+	if err := s.checkContentFile(fileName, srcPath); err != nil {
+		return err
+	}
+	if err := s.scanFile(context.Background(), fileName, srcPath); err != nil {
+		return err
+	}
+
+	fileObj.Mu.Lock()
+	defer fileObj.Mu.Unlock()
+
+	checksums, err := checksumFile(srcPath, s.Checksums)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fileObj.Path), 0774); err != nil {
+		return err
+	}
+
+	// The parts are assembled as uploaded, the encrypted
+	// copy is what gets moved into place
+	if s.encryption != nil {
+		encryptedPath, err := s.encryptFile(srcPath)
+		if err != nil {
+			return err
+		}
+		os.Remove(srcPath)
+		srcPath = encryptedPath
+	}
+	if s.FsyncOnUpload {
+		if err := s.syncFile(srcPath); err != nil {
+			os.Remove(srcPath)
+			return err
+		}
+	}
+
+	err = s.putFile(fileName, fileObj, srcPath, fileAttrs{
+		size:       size,
+		metadata:   metadata,
+		checksums:  checksums,
+		uploadedAt: time.Now(),
+	})
+	if err != nil {
+		os.Remove(srcPath)
+		return err
+	}
+	if s.FsyncOnUpload {
+		s.syncParentDir(fileObj.Path)
+	}
+	return nil
+}
+
+// expireRangeUploads periodically discards the range
+// uploads without a part for RangeUploadTTL, along with
+// their partial files, until the service is stopped
+func (s *FileService) expireRangeUploads() {
+	ticker := time.NewTicker(s.RangeUploadTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.rangeUploadsMu.Lock()
+			for fileName, upload := range s.rangeUploads {
+				// A part being written keeps it locked
+				if !upload.mu.TryLock() {
+					continue
+				}
+				if time.Since(upload.lastActive) > s.RangeUploadTTL {
+					upload.expired = true
+					delete(s.rangeUploads, fileName)
+					os.Remove(upload.path)
+					log.Info().Str("fileName", fileName).Msg("Range upload expired")
+				}
+				upload.mu.Unlock()
+			}
+			s.rangeUploadsMu.Unlock()
+		}
+	}
+}
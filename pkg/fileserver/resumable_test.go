@@ -0,0 +1,45 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUploadRange(t *testing.T) {
+	_, srv := newTestService(t)
+	content := "0123456789abcdefghij"
+
+	// The parts are sent in order, each step sees the state
+	// left by the previous ones
+	tests := []struct {
+		desc      string
+		start     int
+		end       int
+		want      int
+		wantRange string
+	}{
+		{"gap before any byte", 5, 9, http.StatusRequestedRangeNotSatisfiable, ""},
+		{"first part", 0, 4, http.StatusAccepted, "bytes=0-4"},
+		{"overlap", 3, 7, http.StatusRequestedRangeNotSatisfiable, "bytes=0-4"},
+		{"gap", 10, 14, http.StatusRequestedRangeNotSatisfiable, "bytes=0-4"},
+		{"next part", 5, 9, http.StatusAccepted, "bytes=0-9"},
+		{"last part", 10, 19, http.StatusCreated, ""},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", tt.start, tt.end, len(content))}}
+		resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/parts.txt", strings.NewReader(content[tt.start:tt.end+1]), header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+		if got := resp.Header.Get("Range"); got != tt.wantRange {
+			t.Errorf("%s: Range %q, want %q", tt.desc, got, tt.wantRange)
+		}
+	}
+
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/parts.txt", nil, nil)
+	if resp.StatusCode != http.StatusOK || body != content {
+		t.Errorf("download got %d %q, want %q", resp.StatusCode, body, content)
+	}
+}
@@ -0,0 +1,132 @@
+package fileserver
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// clamdChunkSize is the size of the chunks files are
+// streamed to clamd in, well under its StreamMaxLength
+const clamdChunkSize = 64 << 10
+
+// clamdScanner scans files with a ClamAV daemon, over its
+// INSTREAM command
+type clamdScanner struct {
+	// network and address are those of clamd's socket,
+	// "unix" for a path or "tcp" for a host:port
+	network string
+	address string
+	timeout time.Duration
+}
+
+// newClamdScanner returns a scanner for the clamd at
+// address, a unix socket path (e.g.
+// /run/clamav/clamd.ctl) or a host:port
+func newClamdScanner(address string, timeout time.Duration) *clamdScanner {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return &clamdScanner{network: network, address: address, timeout: timeout}
+}
+
+// scan streams content to clamd, returning the name of the
+// signature it matched or "" when it is clean
+func (c *clamdScanner) scan(ctx context.Context, content io.Reader) (string, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Each chunk is sent after its big endian length, a
+	// zero length one ends the stream
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, readErr := io.ReadFull(content, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	// e.g. "stream: OK" or "stream: Eicar-Signature FOUND"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+	result, found := strings.CutPrefix(reply, "stream: ")
+	switch {
+	case found && result == "OK":
+		return "", nil
+	case found && strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd replied %q", reply)
+	}
+}
+
+// scanFile scans the file written to path, before it is
+// stored, returning ErrInfected if it matched a signature
+// Scanning is skipped when no scanner is configured
+func (s *FileService) scanFile(ctx context.Context, fileName, path string) error {
+	if s.scanner == nil {
+		return nil
+	}
+	content, _, err := s.openFile(path)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	start := time.Now()
+	signature, err := s.scanner.scan(ctx, content)
+	if err != nil {
+		log.Error().Err(err).Str("fileName", fileName).Msg("Unable to scan the upload")
+		return newServerError("Server was unable to scan the upload for viruses", err)
+	}
+	if signature != "" {
+		log.Warn().
+			Str("fileName", fileName).
+			Str("signature", signature).
+			Msg("Upload is infected. Skipping.")
+		return fmt.Errorf("%w: %s", ErrInfected, signature)
+	}
+	log.Debug().
+		Str("fileName", fileName).
+		Dur("elapsed", time.Since(start)).
+		Msg("Scanned upload")
+	return nil
+}
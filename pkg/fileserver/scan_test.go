@@ -0,0 +1,113 @@
+package fileserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// eicar is the EICAR anti-virus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startMockClamd starts a clamd speaking INSTREAM on a free
+// port, which flags the streams with the EICAR test string
+// in them, returning its address
+func startMockClamd(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				var stream bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+						return
+					}
+				}
+				reply := "stream: OK\x00"
+				if bytes.Contains(stream.Bytes(), []byte(eicar)) {
+					reply = "stream: Eicar-Test-Signature FOUND\x00"
+				}
+				conn.Write([]byte(reply))
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestScanUploads(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.ClamdAddress = startMockClamd(t) })
+	uploadFile(t, srv, "existing.txt", "clean")
+
+	tests := []struct {
+		name     string
+		content  string
+		want     int
+		wantBody string
+		wantFile string
+	}{
+		{"clean.txt", "clean", http.StatusCreated, "", "clean"},
+		{"eicar.com", eicar, http.StatusUnprocessableEntity, "Upload rejected (file is infected: Eicar-Test-Signature)", ""},
+		// Past the first chunk streamed to clamd
+		{"large.bin", strings.Repeat("x", 100<<10) + eicar, http.StatusUnprocessableEntity, "Upload rejected (file is infected: Eicar-Test-Signature)", ""},
+		// An infected overwrite keeps the stored file
+		{"existing.txt", eicar, http.StatusUnprocessableEntity, "Upload rejected (file is infected: Eicar-Test-Signature)", "clean"},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/"+tt.name, strings.NewReader(tt.content), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.name, resp.StatusCode, body, tt.want)
+		}
+		if tt.wantBody != "" && body != tt.wantBody {
+			t.Errorf("%s: got %q, want %q", tt.name, body, tt.wantBody)
+		}
+
+		fileObj, found := s.lookup(tt.name)
+		if found != (tt.wantFile != "") {
+			t.Errorf("%s: stored %v, want %v", tt.name, found, tt.wantFile != "")
+		}
+		if !found {
+			filePath, _ := s.localPath(tt.name)
+			if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+				t.Errorf("%s: infected file was left on disk: %v", tt.name, err)
+			}
+			continue
+		}
+		if content, _ := os.ReadFile(fileObj.Path); string(content) != tt.wantFile {
+			t.Errorf("%s: stored %q, want %q", tt.name, content, tt.wantFile)
+		}
+	}
+
+	// Uploads aren't stored unscanned when clamd is down
+	_, down := newTestService(t, func(s *FileService) { s.ClamdAddress = "127.0.0.1:1" })
+	if resp, body := doRequest(t, http.MethodPut, down.URL+"/upload/a.txt", strings.NewReader("clean"), nil); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("upload with clamd down got %d (%s), want %d", resp.StatusCode, body, http.StatusInternalServerError)
+	}
+}
@@ -1,31 +1,71 @@
 package fileserver
 
 import (
+	"bufio"
 	"context"
+	"crypto/cipher"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/netutil"
 )
 
 var (
 	DefaultStoragePath = "files"
-	ignoredPaths       = []string{}
+	ignoredPaths       = []string{"healthz", "capabilities"}
 )
 
+// BackendLocal is the storage backend keeping
+// files in a dir on the local filesystem
+const BackendLocal = "local"
+
 // FileObject is a unique reference to a
 // file on disk.
 // It adds a mutex to avoid concurrent writes.
 type FileObject struct {
 	Mu   sync.RWMutex
 	Path string
+
+	// attrMu guards the attributes below, it is only held
+	// briefly so reading them doesn't wait on an upload
+	attrMu sync.RWMutex
+
+	// Metadata is the custom metadata set by the
+	// uploader with X-Meta- (or X-Amz-Meta-) headers
+	Metadata map[string]string
+
+	// Checksums are the hex encoded digests of the
+	// file computed on upload, keyed by algorithm
+	Checksums map[string]string
+
+	// UploadedAt is when the file was last uploaded
+	// (its modification time for files found on disk)
+	UploadedAt time.Time
+
+	// Size is the size of the file in bytes
+	Size int64
+
+	// downloads holds a slot per download of the file in
+	// progress, when MaxDownloadsPerFile is set
+	downloads     chan struct{}
+	downloadsOnce sync.Once
 }
 
 // FileDB is the in-memory DB used
@@ -100,94 +140,940 @@ func (f *FileDB) GetFileList() (fileList []string) {
 // over http
 type FileService struct {
 	DB          FileDB
+	DBMu        sync.RWMutex
 	HTTPServer  *http.Server
 	Port        string
 	StoragePath string
+
+	// Backend is the storage backend files are kept in
+	Backend string
+
+	// KeyFunc maps file names to where they are stored in
+	// the storage dir and NameFunc maps them back
+	KeyFunc  KeyFunc
+	NameFunc NameFunc
+
+	// DateLayoutLocation is the time zone the date dirs of
+	// the date storage layout are in
+	DateLayoutLocation *time.Location
+
+	// DateLayoutNames prefixes the names of uploaded files
+	// with their date dir (e.g. "2024/03/15/report.pdf")
+	// rather than keeping them as uploaded
+	DateLayoutNames bool
+
+	// CaseInsensitiveNames makes names that only differ in
+	// case refer to the same file (as on macOS or Windows
+	// filesystems), a file keeps the case it was first
+	// uploaded with and uploads of a case variant get a 409
+	CaseInsensitiveNames bool
+
+	// TypeDirs maps file extensions or content types (e.g.
+	// "jpg" or "image/*") to the sub dir files of that type
+	// are stored in, set with FILESERVER_TYPE_DIRS
+	TypeDirs map[string]string
+
+	// FailFastWrites rejects uploads of a file that another
+	// request is transferring with a 409, rather than waiting
+	// for it to finish
+	FailFastWrites bool
+
+	// FsyncOnUpload flushes uploaded files (and the dir they
+	// are renamed into) to disk before the upload succeeds,
+	// so they survive a power loss, at the cost of throughput
+	FsyncOnUpload bool
+
+	// DownloadCacheEntries is how many small files are kept
+	// in memory to serve downloads from, 0 disables the cache
+	// DownloadCacheMaxFileSize is the largest file cached
+	DownloadCacheEntries     int64
+	DownloadCacheMaxFileSize int64
+
+	// DownloadBufferSize is the largest file read into
+	// memory whole and sent in one write, larger files are
+	// streamed. 0 streams every file
+	DownloadBufferSize int64
+
+	// Thumbnails enables ?thumbnail=WxH downloads, which
+	// send JPEG, PNG and GIF images scaled down to fit
+	// within the size. Off by default, as decoding and
+	// scaling images takes a lot of CPU
+	Thumbnails bool
+
+	// ThumbnailMaxSize is the largest width and height of a
+	// thumbnail
+	ThumbnailMaxSize int64
+
+	// ThumbnailCacheEntries is how many thumbnails are kept
+	// in memory, 0 makes them again for every request
+	ThumbnailCacheEntries int64
+
+	// MaxDownloadsPerFile is the most downloads of the same
+	// file served at once, 0 means unlimited
+	MaxDownloadsPerFile int64
+
+	// DownloadQueueTimeout is how long a download over
+	// MaxDownloadsPerFile waits for another one to finish
+	// before getting a 503, 0 rejects it right away
+	DownloadQueueTimeout time.Duration
+
+	// DataURLMaxSize is the largest file (in bytes) sent as
+	// a data URI with ?encoding=dataurl, 0 disables them
+	DataURLMaxSize int64
+
+	// GzipSidecars sends the precompressed variant of a
+	// file stored next to it (e.g. app.js.gz for app.js) to
+	// clients accepting gzip, the variants aren't listed
+	GzipSidecars bool
+
+	// DownloadRateLimit is the most bytes per second sent
+	// to each download, 0 means unlimited
+	DownloadRateLimit int64
+
+	// AllowEmpty stores empty uploads (e.g. .keep markers)
+	// rather than rejecting them
+	AllowEmpty bool
+
+	// MaxUploadSize is the largest file (in bytes) the
+	// server accepts, 0 means unlimited
+	MaxUploadSize int64
+
+	// ExtensionMaxUploadSizes overrides MaxUploadSize for
+	// file extensions, keyed by extension (e.g. ".txt"), 0
+	// means unlimited
+	ExtensionMaxUploadSizes map[string]int64
+
+	// Checksums are the algorithms (sha256, md5, crc32)
+	// computed over every upload
+	Checksums []string
+
+	// UploadWebhookURL is POSTed an UploadEvent after every
+	// successful upload, no webhook is sent when empty
+	UploadWebhookURL string
+
+	// UploadWebhookAttempts is how many times the upload
+	// webhook is tried before it is given up on
+	UploadWebhookAttempts int64
+
+	// H2C enables HTTP/2 without TLS (h2c) for clients
+	// that multiplex many small downloads
+	H2C bool
+
+	// HTTP2MaxConcurrentStreams is the most streams a
+	// single HTTP/2 connection may have open at once
+	HTTP2MaxConcurrentStreams int64
+
+	// NormalizePaths collapses duplicate slashes and drops
+	// "." segments of request paths (rejecting ".." ones)
+	// before they are routed, so "/download//a.txt" serves
+	// "a.txt" rather than redirecting
+	NormalizePaths bool
+
+	// CanonicalHost is the host requests for any other host
+	// are redirected to, e.g. "files.example.com", no
+	// request is redirected when it is empty
+	CanonicalHost string
+
+	// SlugifyNames normalizes uploaded file names (lowercase,
+	// special characters replaced), off by default so files
+	// are stored under the exact name given
+	SlugifyNames bool
+
+	// AuthMode is the authentication required from clients,
+	// empty for none or AuthModeJWT
+	AuthMode string
+
+	// JWTSecret is the HS256 key JWTs are verified with
+	JWTSecret []byte
+
+	// JWTPublicKey is the RS256 key JWTs are verified with
+	JWTPublicKey *rsa.PublicKey
+
+	// DefaultContentType is served for files whose type can't
+	// be determined (rather than application/octet-stream)
+	DefaultContentType string
+
+	// ContentTypes overrides the content type served for
+	// file extensions, keyed by extension (e.g. ".log")
+	ContentTypes map[string]string
+
+	// UntrustedContent serves every download with headers
+	// stopping browsers from rendering it (so uploaded HTML
+	// or SVG can't run scripts), rather than only the files
+	// with one of the UntrustedExtensions
+	UntrustedContent bool
+
+	// UntrustedExtensions are the extensions (e.g. ".html")
+	// of files always served as untrusted content
+	UntrustedExtensions []string
+
+	// ContentCheck compares the sniffed type of uploads to
+	// their extension (ContentCheckOff, ContentCheckWarn or
+	// ContentCheckReject with a 415)
+	ContentCheck string
+
+	// KeepAlives enables HTTP keep-alives, IdleTimeout is
+	// how long an idle keep-alive connection is kept open
+	// (0 means no limit)
+	KeepAlives  bool
+	IdleTimeout time.Duration
+
+	// MaxConnections bounds how many connections are served
+	// at once, further clients wait to be accepted, 0 means
+	// unlimited
+	MaxConnections int64
+
+	// MaxHeaderBytes is the most bytes of request headers
+	// read, larger requests get a 431
+	MaxHeaderBytes int64
+
+	// VerifyConcurrency is the most files read at a time
+	// when verifying checksums, VerifyTimeout bounds how
+	// long verifying may take (0 means no limit)
+	VerifyConcurrency int64
+	VerifyTimeout     time.Duration
+
+	// DriftCheckInterval is how often the DB is compared
+	// with the storage dir for the healthz endpoint, 0
+	// disables the check
+	DriftCheckInterval time.Duration
+
+	// TrustedProxies are the networks of the reverse proxies
+	// whose X-Forwarded-For headers are trusted for the
+	// client IP
+	TrustedProxies []*net.IPNet
+
+	// encryption seals files at rest with AES-GCM, nil
+	// when encryption at rest is disabled
+	encryption cipher.AEAD
+
+	// MirrorPath is a secondary dir every upload is copied
+	// to in the background, for simple redundancy
+	MirrorPath string
+
+	// UploadQuota is the most bytes a client IP may upload
+	// within UploadQuotaWindow, 0 disables the quota
+	UploadQuota       int64
+	UploadQuotaWindow time.Duration
+
+	// RequireContentLength rejects uploads that don't
+	// declare their size up front (e.g. chunked ones), so
+	// the size limits apply before any byte is written
+	RequireContentLength bool
+
+	// MaxInFlightUploadBytes bounds the total size of the
+	// uploads being written at once, uploads that would go
+	// over it get a 503. 0 means unlimited
+	MaxInFlightUploadBytes int64
+
+	// ListRateLimit is the most requests per minute a client
+	// IP may make to the enumerating endpoints (/list/,
+	// /feed, /stats and /stat-batch), apart from uploads and
+	// downloads, 0 means unlimited
+	ListRateLimit int64
+
+	// ListRateBurst is how many of those requests a client
+	// IP may make at once
+	ListRateBurst int64
+
+	// ReadOnly rejects every request that would modify
+	// the stored files, while downloads and lists still work
+	ReadOnly bool
+
+	// AppendOnly lets new files be uploaded but rejects
+	// every request that would overwrite, modify or delete
+	// a stored one
+	AppendOnly bool
+
+	// ExpirySweepInterval is how often the files past the
+	// expiry they were uploaded with are deleted, 0 means
+	// they are kept (downloads of them still get a 410)
+	ExpirySweepInterval time.Duration
+
+	// StorageClasses are the storage classes (e.g. "hot"
+	// and "cold") uploads may hint with X-Storage-Class
+	StorageClasses []string
+
+	// DisableList hides the names of stored files, the list
+	// endpoint returns 404 so names act as secret capabilities
+	DisableList bool
+
+	// ListCache keeps the sorted file list between DB
+	// changes instead of sorting it on every list request
+	ListCache bool
+
+	// EmptyListNoContent makes the list endpoint return 204
+	// with no body when no files are stored, rather than 200
+	// with an empty body (or [] in JSON)
+	EmptyListNoContent bool
+
+	// ErrorTemplates is an HTML template file (or a dir of
+	// them, e.g. 404.html and error.html) error responses
+	// are rendered with for clients asking for HTML
+	ErrorTemplates string
+
+	// FeedEntries is how many of the most recently uploaded
+	// files the /feed Atom feed lists
+	FeedEntries int64
+
+	// RequestTimeout bounds how long any request may run,
+	// 0 means no limit
+	RequestTimeout time.Duration
+
+	// RequestTimeoutExempt are the path prefixes of the
+	// streaming endpoints RequestTimeout doesn't apply to
+	RequestTimeoutExempt []string
+
+	// ListTimeout bounds how long the list and stat handlers
+	// may run (e.g. on a wedged filesystem), 0 means no limit
+	ListTimeout time.Duration
+
+	// UploadSessionTTL is how long an upload session is
+	// kept without receiving parts, 0 keeps it until it is
+	// committed or aborted
+	UploadSessionTTL time.Duration
+
+	// RangeUploadTTL is how long a resumable (Content-Range)
+	// upload is kept without receiving parts, 0 keeps it
+	// until it is complete
+	RangeUploadTTL time.Duration
+
+	// OverwriteBackupRetention is how long the previous
+	// content of an overwritten file is kept for /rollback/,
+	// 0 discards it right away
+	OverwriteBackupRetention time.Duration
+
+	// MinUploadRate is the average rate (in bytes per
+	// second) uploads must keep up once MinUploadRateGrace
+	// passed, slower ones are aborted with a 408. 0 means no
+	// minimum
+	MinUploadRate      int64
+	MinUploadRateGrace time.Duration
+
+	// FetchAllowedHosts are the hosts /fetch/ may download
+	// files from (e.g. "files.example.com" or
+	// "*.example.com"), fetching is disabled without any
+	FetchAllowedHosts []string
+
+	// FetchAllowedNetworks are the networks /fetch/ may
+	// connect to, without any only public addresses are
+	// allowed (not loopback, private or link-local ones)
+	FetchAllowedNetworks []*net.IPNet
+
+	// FetchTimeout bounds how long fetching a file may take,
+	// 0 means no limit
+	FetchTimeout time.Duration
+
+	// FetchMaxSize is the largest file /fetch/ stores, 0
+	// means only MaxUploadSize applies
+	FetchMaxSize int64
+
+	// RequiredNamePrefix is the prefix (e.g. "team-a/")
+	// every uploaded file name must start with, only the
+	// names with it are listed
+	RequiredNamePrefix string
+
+	// MaxNameDepth is the most segments (dirs and the file)
+	// an uploaded file name may have, 0 means no limit
+	MaxNameDepth int64
+
+	// MaxNameSegmentLength is the longest segment (in bytes)
+	// an uploaded file name may have, 0 means no limit
+	MaxNameSegmentLength int64
+
+	// AuditLog is the file upload, download and delete
+	// requests are recorded in as JSON lines (who, what,
+	// outcome), "-" records them to stderr. No audit log is
+	// kept when it is empty
+	AuditLog string
+
+	// ClamdAddress is the ClamAV daemon every upload is
+	// scanned with before it is stored, a unix socket path
+	// or a host:port. Uploads aren't scanned when it is empty
+	ClamdAddress string
+
+	// ClamdTimeout bounds how long scanning an upload may
+	// take, 0 means no limit
+	ClamdTimeout time.Duration
+
+	// AccessLog logs a line for every request received
+	// (but the ones to ignoredPaths)
+	AccessLog bool
+
+	// AccessLogSampleRate logs only 1 in this many requests
+	// when AccessLog is enabled, to cut its cost under load
+	AccessLogSampleRate int64
+
+	// LogStream enables /logs/stream, which streams the
+	// server's log lines to (admin) clients as they are
+	// logged
+	LogStream bool
+
+	// MaxRevisions is how many previous revisions of each
+	// file are kept, listed and downloadable through
+	// /revisions/, 0 disables versioning
+	MaxRevisions int64
+
+	// LazyLoad skips scanning the storage dir at startup,
+	// files are added to the DB as they are looked up and
+	// the storage dir is rescanned for every list instead
+	LazyLoad bool
+
+	// RescanInterval is how often the DB is reconciled with
+	// the storage dir, 0 disables the periodic rescan
+	RescanInterval time.Duration
+
+	// rangeUploads are the resumable uploads in progress,
+	// keyed by file name
+	rangeUploads   map[string]*rangeUpload
+	rangeUploadsMu sync.Mutex
+
+	// sessions are the open upload sessions, keyed by ID
+	sessions   map[string]*uploadSession
+	sessionsMu sync.Mutex
+
+	// backups are the previous contents of overwritten
+	// files, oldest first, keyed by file name. They are
+	// guarded by DBMu
+	backups map[string][]backup
+
+	// revisions are the previous revisions of files, keyed
+	// by file name. They are guarded by DBMu
+	revisions map[string]*revisionHistory
+
+	// audit records the audited requests, nil without
+	// AuditLog
+	audit *auditLogger
+
+	// scanner scans the uploads, nil without ClamdAddress
+	scanner *clamdScanner
+
+	// listLimiter limits the rate of enumerating requests,
+	// nil without ListRateLimit
+	listLimiter *requestLimiter
+
+	// thumbnails caches the thumbnails made, keyed by file
+	// name and size, nil without ThumbnailCacheEntries
+	thumbnails *downloadCache
+
+	// davHandlers serve the WebDAV methods
+	davHandlers davHandlers
+
+	// revisionsHandlers serve the methods of /revisions/
+	revisionsHandlers revisionsHandlers
+
+	// openForSync opens the files and dirs flushed to disk
+	// with FsyncOnUpload
+	openForSync func(path string) (syncer, error)
+
+	// errorPages render the error responses for browsers,
+	// nil without ErrorTemplates
+	errorPages *errorPages
+
+	// accessLogCount counts the requests the access log
+	// samples from
+	accessLogCount atomic.Uint64
+
+	// inFlightUploadBytes is the total size of the uploads
+	// being written, bounded by MaxInFlightUploadBytes
+	inFlightUploadBytes atomic.Int64
+
+	// logs fans the log lines out to the /logs/stream
+	// clients, nil when LogStream is disabled
+	logs *logBroadcaster
+
+	// fetchClient downloads the files of /fetch/
+	fetchClient *http.Client
+
+	// mirror copies uploads to MirrorPath, nil when there
+	// is no mirror dir
+	mirror *mirror
+
+	// writing counts the uploads being written to each path
+	// in the storage dir, so scans don't take the files
+	// for stored ones before they are complete
+	writing   map[string]int
+	writingMu sync.Mutex
+
+	// checksumJobs are the files whose checksums are
+	// computed in the background, checksumPending the ones
+	// queued, guarded by checksumMu
+	checksumJobs    chan checksumJob
+	checksumPending map[*FileObject]bool
+	checksumMu      sync.Mutex
+
+	// drift is the result of the last drift check
+	drift driftCheck
+
+	// listCache caches the file list between DB changes
+	listCache listCache
+
+	// totalBytes is the size of all the files in the DB,
+	// it is guarded by DBMu
+	totalBytes int64
+
+	// foldedNames maps the lowercase names of the files in
+	// the DB to their names while CaseInsensitiveNames is
+	// set, it is guarded by DBMu
+	foldedNames map[string]string
+
+	// cache keeps small files in memory for downloads, nil
+	// when the download cache is disabled
+	cache *downloadCache
+
+	// quota tracks the bytes uploaded per client IP, nil
+	// when there is no upload quota
+	quota *uploadQuota
+
+	// conns tracks the open connections for shutdown stats
+	conns *connTracker
+
+	// done is closed when the service is stopped
+	done chan struct{}
 }
 
 // NewFileService returns a fileserver to handle requests
-func NewFileService() (*FileService, error) {
-	if err := os.Mkdir(DefaultStoragePath, 0774); err != nil && err.Error() != "mkdir files: file exists" {
+func NewFileService(opts ...Option) (*FileService, error) {
+	if err := os.Mkdir(DefaultStoragePath, 0774); err != nil && !errors.Is(err, fs.ErrExist) {
 		log.Error().Err(err).Msg("Unable to create local file storage dir. Exiting..")
 		return nil, err
 	}
 
+	// The storage dir may be a symlink (e.g. to a mounted volume),
+	// all paths are based on where it really lives
+	storagePath, err := resolveStoragePath(DefaultStoragePath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to resolve local file storage dir. Exiting..")
+		return nil, err
+	}
+	if err := checkStorageDir(storagePath); err != nil {
+		log.Error().Err(err).Msg("Invalid local file storage dir. Exiting..")
+		return nil, err
+	}
+
 	mux := http.NewServeMux()
 	p := FileService{
 		DB:          NewFileDB(),
 		HTTPServer:  &http.Server{},
 		Port:        "37899",
-		StoragePath: DefaultStoragePath,
+		StoragePath: storagePath,
+
+		// Defaults, overridden by the FILESERVER_* env vars
+		Backend:                   BackendLocal,
+		KeyFunc:                   FlatKey,
+		NameFunc:                  FlatName,
+		DateLayoutLocation:        time.UTC,
+		StorageClasses:            []string{"hot", "cold"},
+		ExpirySweepInterval:       time.Minute,
+		ListTimeout:               5 * time.Second,
+		RequestTimeoutExempt:      []string{"/upload", "/download", "/fetch", davPrefix, "/admin/verify", "/logs/stream"},
+		ListCache:                 true,
+		Checksums:                 []string{ChecksumSHA256},
+		ContentCheck:              ContentCheckOff,
+		UntrustedExtensions:       []string{".html", ".htm", ".xhtml", ".svg", ".xml", ".js", ".mjs"},
+		UploadWebhookAttempts:     3,
+		UploadQuotaWindow:         time.Hour,
+		MaxHeaderBytes:            64 << 10,
+		KeepAlives:                true,
+		NormalizePaths:            true,
+		DriftCheckInterval:        time.Minute,
+		VerifyConcurrency:         4,
+		VerifyTimeout:             5 * time.Minute,
+		UploadSessionTTL:          24 * time.Hour,
+		RangeUploadTTL:            24 * time.Hour,
+		FetchTimeout:              time.Minute,
+		MinUploadRateGrace:        10 * time.Second,
+		FeedEntries:               20,
+		AccessLog:                 true,
+		MaxNameDepth:              32,
+		MaxNameSegmentLength:      255,
+		AccessLogSampleRate:       1,
+		DownloadCacheMaxFileSize:  64 << 10,
+		DownloadBufferSize:        16 << 10,
+		ThumbnailMaxSize:          1024,
+		ThumbnailCacheEntries:     256,
+		DataURLMaxSize:            32 << 10,
+		HTTP2MaxConcurrentStreams: 250,
+		ClamdTimeout:              time.Minute,
+		ListRateBurst:             10,
+
+		conns:        newConnTracker(),
+		done:         make(chan struct{}),
+		openForSync:  openForSync,
+		rangeUploads: map[string]*rangeUpload{},
+		sessions:     map[string]*uploadSession{},
+		backups:      map[string][]backup{},
+		revisions:    map[string]*revisionHistory{},
+		foldedNames:  map[string]string{},
+		writing:      map[string]int{},
+
+		checksumJobs:    make(chan checksumJob, checksumQueueSize),
+		checksumPending: map[*FileObject]bool{},
+	}
+	if err := p.loadConfig(); err != nil {
+		log.Error().Err(err).Msg("Invalid configuration. Exiting..")
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(&p)
+	}
+	if p.MirrorPath != "" {
+		if p.mirror, err = p.newMirror(); err != nil {
+			log.Error().Err(err).Msg("Invalid mirror dir. Exiting..")
+			return nil, err
+		}
+	}
+	if p.UploadQuota > 0 {
+		p.quota = newUploadQuota(p.UploadQuota, p.UploadQuotaWindow)
+	}
+	if p.ListRateLimit > 0 {
+		p.listLimiter = newRequestLimiter("list", p.ListRateLimit, p.ListRateBurst)
+	}
+	if p.DownloadCacheEntries > 0 {
+		p.cache = newDownloadCache(int(p.DownloadCacheEntries), p.DownloadCacheMaxFileSize)
+	}
+	if p.AuditLog != "" {
+		if p.audit, err = newAuditLogger(p.AuditLog); err != nil {
+			log.Error().Err(err).Msg("Unable to open the audit log. Exiting..")
+			return nil, err
+		}
+	}
+	if p.ClamdAddress != "" {
+		p.scanner = newClamdScanner(p.ClamdAddress, p.ClamdTimeout)
+	}
+	if p.Thumbnails && p.ThumbnailCacheEntries > 0 {
+		p.thumbnails = newDownloadCache(int(p.ThumbnailCacheEntries), thumbnailCacheMaxSize)
+	}
+	if p.ErrorTemplates != "" {
+		if p.errorPages, err = loadErrorPages(p.ErrorTemplates); err != nil {
+			log.Error().Err(err).Msg("Invalid error page templates. Exiting..")
+			return nil, err
+		}
+	}
+	p.fetchClient = p.newFetchClient()
+	if p.LogStream {
+		// The log lines are still written to stderr, as
+		// without the stream
+		p.logs = newLogBroadcaster()
+		log.Logger = log.Output(zerolog.MultiLevelWriter(os.Stderr, p.logs))
+		mux.Handle("/logs/stream", p.requireScope(ScopeAdmin, http.HandlerFunc(p.logStream)))
 	}
 
-	mux.HandleFunc("/upload/", p.upload)
-	mux.HandleFunc("/download/", p.download)
-	mux.HandleFunc("/list/", p.list)
+	// WebDAV methods are served by the same handlers as
+	// the regular endpoints, along with their wrappers
+	p.davHandlers = davHandlers{
+		propfind: p.rateLimited(p.listLimiter, p.requireScope(ScopeRead, p.withListTimeout(p.davPropfind))),
+		download: p.audited("download", "/download/", p.requireScope(ScopeRead, http.HandlerFunc(p.download))),
+		upload:   p.audited("upload", "/upload/", p.requireScope(ScopeWrite, p.mutating(p.upload))),
+		delete:   p.audited("delete", "/delete/", p.requireScope(ScopeDelete, p.modifying(p.deleteFile))),
+	}
+	mux.Handle("/upload/", p.davHandlers.upload)
+	mux.Handle("/upload", p.davHandlers.upload)
+	mux.Handle("/upload/start", p.audited("upload", "/upload/", p.requireScope(ScopeWrite, p.mutating(p.startSession))))
+	mux.Handle("/download/", p.davHandlers.download)
+	mux.Handle("/download", p.davHandlers.download)
+	mux.Handle("/delete/", p.davHandlers.delete)
+	mux.Handle("/delete", p.davHandlers.delete)
+	mux.Handle("/list/", p.rateLimited(p.listLimiter, p.requireScope(ScopeRead, p.withListTimeout(p.enumerating(p.list)))))
+	mux.Handle("/fetch/", p.audited("fetch", "/fetch/", p.requireScope(ScopeWrite, p.mutating(p.fetch))))
+	mux.Handle("/fetch", p.audited("fetch", "/fetch", p.requireScope(ScopeWrite, p.mutating(p.fetch))))
+	mux.Handle("/feed", p.rateLimited(p.listLimiter, p.requireScope(ScopeRead, p.withListTimeout(p.enumerating(p.feed)))))
+	mux.Handle("/rollback/", p.audited("rollback", "/rollback/", p.requireScope(ScopeWrite, p.modifying(p.rollback))))
+	p.revisionsHandlers = revisionsHandlers{
+		list:    p.rateLimited(p.listLimiter, p.requireScope(ScopeRead, p.withListTimeout(p.enumerating(p.listRevisions)))),
+		promote: p.audited("promote", "/revisions/", p.requireScope(ScopeWrite, p.modifying(p.promoteRevision))),
+	}
+	mux.HandleFunc("/revisions/", p.revisionsEndpoint)
+	mux.Handle("/swap/", p.audited("swap", "/swap/", p.requireScope(ScopeWrite, p.modifying(p.swap))))
+	mux.Handle("/stat/", p.requireScope(ScopeRead, p.withListTimeout(p.stat)))
+	mux.Handle("/stat-batch", p.rateLimited(p.listLimiter, p.requireScope(ScopeRead, p.withListTimeout(p.statBatch))))
+	mux.Handle("/rescan/", p.requireScope(ScopeAdmin, http.HandlerFunc(p.rescan)))
+	mux.Handle("/admin/verify", p.requireScope(ScopeAdmin, http.HandlerFunc(p.verify)))
+	mux.Handle("/admin/loglevel", p.requireScope(ScopeAdmin, http.HandlerFunc(p.logLevelEndpoint)))
+	mux.Handle("/stats", p.rateLimited(p.listLimiter, p.requireScope(ScopeRead, p.withListTimeout(p.stats))))
+	mux.HandleFunc(davPrefix, p.dav)
+	mux.HandleFunc("/healthz", p.healthz)
+	mux.HandleFunc("/capabilities", p.capabilities)
 
-	muxWithLogger := httpRequestLoggerWrapper(mux)
+	muxWithLogger := p.httpRequestLoggerWrapper(p.recoverPanics(p.redirectToCanonicalHost(p.withErrorPages(p.withRequestTimeout(p.normalizePaths(mux))))))
 
 	p.HTTPServer.Addr = ":" + p.Port
+	p.HTTPServer.MaxHeaderBytes = int(p.MaxHeaderBytes)
+	p.HTTPServer.IdleTimeout = p.IdleTimeout
+	p.HTTPServer.SetKeepAlivesEnabled(p.KeepAlives)
 	p.HTTPServer.Handler = muxWithLogger
+	p.HTTPServer.ConnState = p.conns.track
 
-	f, err := os.Open(p.StoragePath)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to open local file storage dir. Exiting..")
+	if err := p.configureHTTP2(); err != nil {
+		log.Error().Err(err).Msg("Unable to configure HTTP/2. Exiting..")
 		return nil, err
 	}
-	defer f.Close()
 
-	fileInfo, err := f.Readdir(-1)
-	if err != nil && err.Error() != "EOF" {
-		log.Error().Err(err).Msg("Unable to list contents of local file storage dir. Exiting..")
-		return nil, err
+	// Lazily loaded files are added to the DB as they are
+	// looked up or listed. Otherwise the DB is built as the
+	// storage dir is read, without listing it all first
+	if !p.LazyLoad {
+		err := p.walkStorage(func(name string, NewFObj *FileObject) error {
+			p.DB[name] = NewFObj
+			p.totalBytes += NewFObj.Size
+			p.indexName(name)
+			return nil
+		})
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to list contents of local file storage dir. Exiting..")
+			return nil, err
+		}
 	}
+	p.restoreExpiries()
 
-	for _, files := range fileInfo {
-		NewFObj := &FileObject{
-			Path: p.StoragePath + "/" + files.Name(),
-			Mu:   sync.RWMutex{},
-		}
-		p.DB[files.Name()] = NewFObj
+	// Upload sessions only live in memory, the parts left
+	// by a previous run can't be committed anymore
+	if err := os.RemoveAll(p.sessionsDir()); err != nil {
+		log.Warn().Err(err).Msg("Unable to remove the parts of previous upload sessions")
 	}
-	return &p, nil
-}
 
-// list returns an array of strings containing
-// the names of the files currently uploaded
-func (s *FileService) list(w http.ResponseWriter, r *http.Request) {
-	log.Info().
-		Int("contentLength", int(r.ContentLength)).
-		Msg("Processing list")
+	// Nor can range uploads be resumed
+	if err := os.RemoveAll(p.partialDir()); err != nil {
+		log.Warn().Err(err).Msg("Unable to remove the partial files of previous range uploads")
+	}
 
-	//w.WriteHeader(http.StatusOK)
-	w.Write([]byte(strings.Join(s.DB.GetFileList(), "\n")))
+	// Neither are backups and revisions, the attributes
+	// they are restored with are gone
+	if err := os.RemoveAll(p.backupsDir()); err != nil {
+		log.Warn().Err(err).Msg("Unable to remove the backups of the previous run")
+	}
+	if err := os.RemoveAll(p.revisionsDir()); err != nil {
+		log.Warn().Err(err).Msg("Unable to remove the revisions of the previous run")
+	}
+	return &p, nil
 }
 
 // upload processes the user file upload for a PUT request
 func (s *FileService) upload(w http.ResponseWriter, r *http.Request) {
+	// Parts, commits and aborts of upload sessions
+	if s.uploadSessionRequest(w, r) {
+		return
+	}
+
+	metadata, err := s.uploadMetadata(r.Header)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid metadata headers. Skipping.")
+		if errors.Is(err, errMetadataTooLarge) {
+			w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+			w.Write([]byte(fmt.Sprintf("Invalid metadata headers (%v)", err)))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid metadata headers (%v)", err)))
+		return
+	}
+	if !s.checkContentLength(w, r) {
+		return
+	}
+
+	// Clients that can only send JSON POST the file name
+	// and base64 encoded content in the body instead
+	if r.Method == http.MethodPost && isJSONRequest(r) {
+		s.uploadJSON(w, r, metadata)
+		return
+	}
+
 	// Parse filename from the upload URL
 	// curl -T filename.extension http://127.0.0.1:37899/upload/
 	// makes curl append filename.extension at the end of the URL
 	// Note, that is only possible because of the trailing "/"
-	fileName := strings.TrimPrefix(r.URL.Path, "/upload/")
+	fileName := s.uploadName(r, requestFileName(r, "/upload/"))
+
+	// Without a name (or with ?generate=true) the server
+	// picks one, e.g. for paste style uploads
+	generated := fileName == "" || r.URL.Query().Get("generate") == "true"
+	if generated {
+		if r.Header.Get("Content-Range") != "" {
+			log.Error().Msg("Resumable upload without a file name. Skipping.")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Please provide a file name for resumable uploads."))
+			return
+		}
+		if fileName, err = s.generateName(r.URL.Query().Get("ext")); err != nil {
+			log.Error().Err(err).Msg("Unable to generate a file name. Skipping.")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Unable to generate a file name (%v)", err)))
+			return
+		}
+	}
+
 	log.Info().
 		Str("fileName", fileName).
+		Bool("generated", generated).
 		Int("contentLength", int(r.ContentLength)).
 		Msg("Processing upload")
-	filePath := DefaultStoragePath + "/" + fileName
+
+	// Parts of a resumable upload carry their position
+	// in the file in a Content-Range header
+	if r.Header.Get("Content-Range") != "" {
+		s.uploadRange(w, r, fileName, metadata)
+		return
+	}
+
+	// Reject uploads that declare a size over the limit
+	// before reading any of the body
+	maxUploadSize := s.maxUploadSize(fileName)
+	if maxUploadSize > 0 && r.ContentLength > maxUploadSize {
+		log.Error().
+			Int64("maxUploadSize", maxUploadSize).
+			Msg("Upload exceeds the maximum upload size. Skipping.")
+		s.writeTooLarge(w, fileName)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if maxUploadSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	}
+	// Clients trickling the body just fast enough to not
+	// time out would hold a connection and temp file open
+	if s.MinUploadRate > 0 {
+		body = newMinRateReader(w, body, s.MinUploadRate, s.MinUploadRateGrace)
+	}
+	s.storeFile(r.Context(), w, &fileUpload{
+		name:          fileName,
+		body:          body,
+		contentLength: r.ContentLength,
+		metadata:      metadata,
+		contentMD5:    r.Header.Get("Content-MD5"),
+		clientIP:      s.clientIP(r),
+		generated:     generated,
+	})
+}
+
+// fileUpload is a file being stored by storeFile
+type fileUpload struct {
+	name string
+	body io.Reader
+
+	// contentLength is the size of the file, negative
+	// when not known up front (e.g. a chunked upload)
+	contentLength int64
+
+	// metadata is the custom metadata to store
+	metadata map[string]string
+
+	// contentMD5 is the base64 encoded MD5 digest sent
+	// by the client to validate the upload against
+	contentMD5 string
+
+	// clientIP is the IP the upload is accounted to
+	clientIP string
+
+	// inFlightReserved is set when the bytes of the upload
+	// are already reserved in the uploads in flight (e.g.
+	// along with the JSON body carrying it)
+	inFlightReserved bool
+
+	// generated is set when the server picked the name
+	generated bool
+}
+
+// StoredFile describes a stored file
+type StoredFile struct {
+	Name       string
+	Size       int64
+	Metadata   map[string]string
+	Checksums  map[string]string
+	UploadedAt time.Time
+}
+
+// Put stores the content read from body as the file name,
+// creating or overwriting it along with its custom metadata
+// It is what uploads do, without the HTTP request
+func (s *FileService) Put(ctx context.Context, name string, body io.Reader, metadata map[string]string) (StoredFile, error) {
+	// Reading one byte over the limit tells a file at the
+	// limit from one over it
+	if maxUploadSize := s.maxUploadSize(name); maxUploadSize > 0 {
+		body = io.LimitReader(body, maxUploadSize+1)
+	}
+	return s.put(ctx, &fileUpload{
+		name:          name,
+		body:          body,
+		contentLength: -1,
+		metadata:      metadata,
+	})
+}
+
+// storeFile writes the uploaded file to disk and writes the
+// outcome to the client
+func (s *FileService) storeFile(ctx context.Context, w http.ResponseWriter, upload *fileUpload) {
+	stored, err := s.put(ctx, upload)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	s.writeCreated(w, stored.Name, upload.generated)
+}
+
+// put writes the uploaded file to disk, creating or
+// overwriting it (along with its custom metadata and
+// checksums)
+func (s *FileService) put(ctx context.Context, upload *fileUpload) (StoredFile, error) {
+	fileName := upload.name
+	filePath, err := s.localPath(fileName)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid file name. Skipping.")
+		return StoredFile{}, withKind(ErrInvalidName, err)
+	}
+	if err := s.checkNameConflict(fileName); err != nil {
+		log.Error().Err(err).Msg("File name conflicts with a stored file. Skipping.")
+		return StoredFile{}, err
+	}
 
 	// Check for empty file uploads
-	if r.ContentLength == 0 {
+	if upload.contentLength == 0 && !s.AllowEmpty {
 		log.Error().Msg("Empty file being uploaded. Skipping.")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Please upload a non-empty file."))
-		return
+		return StoredFile{}, ErrEmptyFile
+	}
+
+	// Uploads that declare a size over the limit of their
+	// name are rejected before reading any of the body
+	if maxUploadSize := s.maxUploadSize(fileName); maxUploadSize > 0 && upload.contentLength > maxUploadSize {
+		log.Error().
+			Int64("maxUploadSize", maxUploadSize).
+			Msg("Upload exceeds the maximum upload size. Skipping.")
+		return StoredFile{}, s.uploadTooLarge(fileName, &http.MaxBytesError{Limit: maxUploadSize})
+	}
+
+	// Only the bytes of a stored file are counted in the
+	// quota once the upload is done
+	body, settle, err := s.reserveQuota(upload.clientIP, upload.body, upload.contentLength)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	var storedBytes int64
+	defer func() { settle(storedBytes) }()
+
+	if !upload.inFlightReserved {
+		var release func()
+		if body, release, err = s.reserveInFlight(body, upload.contentLength); err != nil {
+			return StoredFile{}, err
+		}
+		defer release()
+	}
+	upload.body = body
+
+	// Compare the magic bytes at the start of the upload
+	// to its extension, peeking doesn't consume them
+	if s.ContentCheck != ContentCheckOff {
+		content := bufio.NewReaderSize(upload.body, sniffLen)
+		head, _ := content.Peek(sniffLen)
+		upload.body = content
+
+		if err := s.checkContent(fileName, head); err != nil {
+			return StoredFile{}, err
+		}
 	}
 
 	// Check if file already exists
-	fileObj, found := s.DB[fileName]
+	fileObj, found := s.lookup(fileName)
 	var localFile *os.File
-	var err error
 
 	// If file exists, create a new file with "-temp" suffix
 	// once the upload is successful, rename it to the existing
@@ -203,49 +1089,158 @@ func (s *FileService) upload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	fileObj.Mu.Lock()
+	// Fail fast rather than waiting for another upload of
+	// the file (which can take long for big files) to finish
+	if s.FailFastWrites {
+		if !fileObj.Mu.TryLock() {
+			log.Error().Str("fileName", fileName).Msg("File is busy. Skipping.")
+			return StoredFile{}, errFileBusy
+		}
+	} else {
+		fileObj.Mu.Lock()
+	}
 	defer fileObj.Mu.Unlock()
 
+	// Until it is in the DB the file is only being written
+	defer s.startWriting(filePath)()
+
 	log.Info().
 		Str("filePath", filePath).
 		Msg("Opening file for writing")
-	localFile, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0664)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0774); err != nil {
+		log.Error().Err(err).Msg("Unable to create the dir of the file on the server.")
+		return StoredFile{}, newServerError(fmt.Sprintf("Server encountered an exception creating the file locally (%v)", err), err)
+	}
+	localFile, err = os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
 	if err != nil {
 		log.Error().Err(err).Msg("Unable to create new file object on the server.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Server encountered an exception creating the file locally (%v)", err)))
-		return
+		return StoredFile{}, newServerError(fmt.Sprintf("Server encountered an exception creating the file locally (%v)", err), err)
 	}
+	defer localFile.Close()
 
 	log.Debug().
 		Int("fd", int(localFile.Fd())).
 		Msg("File descriptor")
 
-	// io.Copy allocates a 32KB buffer by default
+	// The checksums are computed in the same pass as the write
+	algorithms := s.Checksums
+	if upload.contentMD5 != "" && !slices.Contains(algorithms, ChecksumMD5) {
+		algorithms = append(slices.Clip(algorithms), ChecksumMD5)
+	}
+	sums := newChecksummer(algorithms)
+
+	// Copies in 32KB chunks, like io.Copy
 	// https://cs.opensource.google/go/go/+/refs/tags/go1.21.6:src/io/io.go;l=419
-	writtenBytes, err := io.Copy(localFile, r.Body)
+	// but stops if the client goes away mid upload
+	// The content is encrypted at rest when enabled, the
+	// checksums are always of the content as uploaded
+	content, err := s.newFileWriter(localFile)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable error trying to read/write data to disk")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Server encountered an exception in processing the upload"))
-		localFile.Close()
+		log.Error().Err(err).Msg("Unable to set up encryption of the file.")
 		os.Remove(filePath)
-		return
+		return StoredFile{}, newServerError("Server encountered an exception in processing the upload", err)
+	}
+	writtenBytes, err := copyWithContext(ctx, io.MultiWriter(content, sums), upload.body)
+	if err == nil {
+		err = content.Close()
+	}
+	if err == nil && s.FsyncOnUpload {
+		err = s.syncFile(filePath)
+	}
+	if maxUploadSize := s.maxUploadSize(fileName); err == nil && maxUploadSize > 0 && writtenBytes > maxUploadSize {
+		err = &http.MaxBytesError{Limit: maxUploadSize}
 	}
+	if err != nil {
+		os.Remove(filePath)
 
-	log.Info().
-		Int64("writtenBytes", writtenBytes).
-		Msg("Wrote bytes to file")
+		// A body cut short also means the client went away
+		if isAborted(err) || errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Info().
+				Err(err).
+				Int64("writtenBytes", writtenBytes).
+				Msg("Upload aborted by the client")
+			return StoredFile{}, withKind(context.Canceled, err)
+		}
 
-	// Verify if all the bytes were written to disk
-	if writtenBytes != r.ContentLength {
-		log.Error().
-			Msg("Total written bytes is not same as contenlength")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Server could not validate all the data written to local file"))
-		localFile.Close()
-		os.Remove(filePath)
-		return
+		// Clients can retry once space has been freed
+		if isDiskFull(err) {
+			log.Warn().
+				Err(err).
+				Int64("writtenBytes", writtenBytes).
+				Msg("Storage is full, discarded the upload")
+			return StoredFile{}, withKind(ErrStorageFull, err)
+		}
+
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			log.Error().
+				Int64("maxUploadSize", maxBytesErr.Limit).
+				Msg("Upload exceeded the maximum upload size")
+			return StoredFile{}, s.uploadTooLarge(fileName, err)
+		}
+
+		if errors.Is(err, errUploadTooSlow) {
+			log.Error().
+				Int64("writtenBytes", writtenBytes).
+				Msg("Upload is slower than the minimum upload rate")
+			return StoredFile{}, err
+		}
+
+		if errors.Is(err, ErrQuotaExceeded) {
+			log.Error().
+				Str("clientIP", upload.clientIP).
+				Int64("writtenBytes", writtenBytes).
+				Msg("Client exceeded its upload quota. Skipping.")
+			return StoredFile{}, err
+		}
+
+		if errors.Is(err, errTooManyInFlight) {
+			log.Error().
+				Int64("writtenBytes", writtenBytes).
+				Msg("Upload took the uploads in flight over the limit")
+			return StoredFile{}, err
+		}
+
+		log.Error().Err(err).Msg("Unable error trying to read/write data to disk")
+		return StoredFile{}, newServerError("Server encountered an exception in processing the upload", err)
+	}
+
+	log.Info().
+		Int64("writtenBytes", writtenBytes).
+		Msg("Wrote bytes to file")
+
+	// Uploads without a Content-Length (e.g. chunked) are
+	// only found to be empty once read
+	if writtenBytes == 0 && !s.AllowEmpty {
+		log.Error().Msg("Empty file uploaded. Skipping.")
+		os.Remove(filePath)
+		return StoredFile{}, ErrEmptyFile
+	}
+
+	// Verify if all the bytes were written to disk
+	if upload.contentLength > 0 && writtenBytes != upload.contentLength {
+		log.Error().
+			Msg("Total written bytes is not same as contenlength")
+		os.Remove(filePath)
+		return StoredFile{}, newServerError("Server could not validate all the data written to local file", io.ErrShortWrite)
+	}
+
+	checksums := sums.sums()
+	if upload.contentMD5 != "" {
+		if err := verifyContentMD5(upload.contentMD5, checksums[ChecksumMD5]); err != nil {
+			log.Error().Err(err).Msg("Upload failed Content-MD5 validation")
+			os.Remove(filePath)
+			return StoredFile{}, withKind(ErrChecksumMismatch, err)
+		}
+		if !slices.Contains(s.Checksums, ChecksumMD5) {
+			delete(checksums, ChecksumMD5)
+		}
+	}
+
+	// Infected files never make it into the DB
+	if err := s.scanFile(ctx, fileName, filePath); err != nil {
+		os.Remove(filePath)
+		return StoredFile{}, err
 	}
 
 	// Rename the temp file to existing file, overwriting it
@@ -255,106 +1250,844 @@ func (s *FileService) upload(w http.ResponseWriter, r *http.Request) {
 	// If its a new file, create a new FileObj and add DB reference
 	// Note: Renaming does not change the MODIFIED timestamp of the
 	// file
-	if found {
-		err := os.Rename(filePath, DefaultStoragePath+"/"+fileName)
-		if err != nil {
-			log.Error().Err(err).Msg("Unable to rename temp file to final file")
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Server encountered an exception while comitting data to local file"))
-			localFile.Close()
-			os.Remove(filePath)
-			return
+	uploadedAt := time.Now()
+	err = s.putFile(fileName, fileObj, filePath, fileAttrs{
+		size:       writtenBytes,
+		metadata:   upload.metadata,
+		checksums:  checksums,
+		uploadedAt: uploadedAt,
+	})
+	if err != nil {
+		os.Remove(filePath)
+		if errors.Is(err, ErrConflict) {
+			log.Error().Err(err).Msg("File name conflicts with a stored file. Skipping.")
+			return StoredFile{}, err
 		}
-	} else {
-		s.DB[fileName] = fileObj
+		log.Error().Err(err).Msg("Unable to rename temp file to final file")
+		return StoredFile{}, newServerError("Server encountered an exception while comitting data to local file", err)
+	}
+	if s.FsyncOnUpload {
+		s.syncParentDir(fileObj.Path)
 	}
 
-	localFile.Close()
-	w.WriteHeader(http.StatusCreated)
-	w.Write([]byte("Upload successful"))
+	storedBytes = writtenBytes
+
+	s.mirrorUpload(fileName)
+	s.notifyUpload(UploadEvent{
+		Name:       fileName,
+		Size:       writtenBytes,
+		Checksum:   checksums[ChecksumSHA256],
+		UploadedAt: uploadedAt,
+	})
+	return StoredFile{
+		Name:       fileName,
+		Size:       writtenBytes,
+		Metadata:   upload.metadata,
+		Checksums:  checksums,
+		UploadedAt: uploadedAt,
+	}, nil
 }
 
+// download serves a file to the client
+// With ?consume=true the file is deleted once it has been
+// fully transferred, letting the server act as a simple
+// queue where each file is handed to a single consumer
 func (s *FileService) download(w http.ResponseWriter, r *http.Request) {
-	fileName := strings.TrimPrefix(r.URL.Path, "/download/")
+	fileName := s.resolveName(requestFileName(r, "/download/"))
+	consume := r.URL.Query().Get("consume") == "true"
 	log.Debug().
 		Str("fileName", fileName).
+		Bool("consume", consume).
 		Msg("Processing download")
 
-	fileObj, found := s.DB[fileName]
+	if consume && !s.hasScope(r, ScopeDelete) {
+		log.Info().Msg("Rejecting consume without the delete scope")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(fmt.Sprintf("Token is missing the %s scope", ScopeDelete)))
+		return
+	}
+	if consume && s.ReadOnly {
+		log.Info().Msg("Rejecting consume, server is in read-only mode")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Server is in read-only mode"))
+		return
+	}
+	if consume && s.AppendOnly {
+		log.Info().Msg("Rejecting consume, server is append-only")
+		s.writeError(w, errAppendOnly)
+		return
+	}
+
+	// ?revision= downloads a previous revision of the file
+	if r.URL.Query().Has("revision") && !consume {
+		s.downloadRevision(w, r, fileName)
+		return
+	}
+
+	// ?thumbnail=WxH downloads a scaled down image
+	if r.URL.Query().Has("thumbnail") && !consume {
+		s.downloadThumbnail(w, r, fileName)
+		return
+	}
+
+	// ?encoding=dataurl downloads a small file as a data URI
+	if encoding := r.URL.Query().Get("encoding"); encoding != "" && !consume {
+		if encoding != "dataurl" {
+			log.Error().Str("encoding", encoding).Msg("Unknown download encoding")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Unknown encoding %q, the only one supported is dataurl", encoding)))
+			return
+		}
+		s.downloadDataURL(w, r, fileName)
+		return
+	}
+
+	fileObj, found := s.lookup(fileName)
+	if found && consume {
+		// Consumers hold the write lock for the whole transfer,
+		// a consumer waiting on it must re-check the file is
+		// still there once the previous one is done
+		fileObj.Mu.Lock()
+		defer fileObj.Mu.Unlock()
+		current, stillFound := s.lookup(fileName)
+		found = stillFound && current == fileObj
+	}
 	if !found {
 		log.Debug().
 			Msg("No such file found")
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("No such file"))
+		s.writeError(w, ErrNotFound)
 		return
 	}
 
-	fi, err := os.Stat(fileObj.Path)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to validate file on disk")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Server encountered an exception in validating local file object"))
+	// Expired files are gone even before they are swept
+	if fileObj.expired(time.Now()) {
+		log.Debug().
+			Msg("File has expired")
+		s.writeError(w, ErrExpired)
 		return
 	}
 
-	w.Header().Add("Content-Length", fmt.Sprintf("%d", fi.Size()))
-	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	// A popular file is only read by so many downloads at
+	// once, so they can't saturate the disk
+	release, ok := s.acquireDownload(r.Context(), fileObj)
+	if !ok {
+		log.Info().
+			Str("fileName", fileName).
+			Msg("Too many downloads of the file. Skipping.")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("File is being downloaded by too many clients, please try again later"))
+		return
+	}
+	defer release()
+
+	// A precompressed variant is sent to clients accepting
+	// gzip, instead of the file
+	if s.GzipSidecars && !consume {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if s.serveGzipSidecar(w, r, fileName, fileObj) {
+			return
+		}
+	}
 
-	localFile, err := os.OpenFile(fileObj.Path, os.O_RDONLY, 0664)
+	localFile, err := s.open(fileName, fileObj)
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to open file object on the server for reading.")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("Server encountered an exception opening the file locally (%v)", err)))
+		s.writeError(w, err)
 		return
 	}
+	defer localFile.Close()
+	size := localFile.Size
 
-	bytes, err := io.Copy(w, localFile)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to read/write data from disk")
+	// Peeking doesn't consume the bytes, they are still
+	// copied to the response below
+	// A file that can't be read (e.g. failing to decrypt) is
+	// caught here, before any header is sent
+	content := bufio.NewReaderSize(localFile, sniffLen)
+	head, err := content.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		log.Error().Err(err).Msg("Unable to read file on the server.")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Server encountered an exception in processing the download"))
 		return
 	}
 
-	if bytes != fi.Size() {
-		log.Error().Err(err).Msg("Bytes written to response don't match with size on disk")
+	// Large downloads are throttled so they can't saturate
+	// the link for colocated services
+	if s.DownloadRateLimit > 0 {
+		w = newThrottledWriter(r.Context(), w, s.DownloadRateLimit)
+	}
+
+	// With ?decompress=true gzip files are sent decompressed
+	decompress := r.URL.Query().Get("decompress") == "true" && isGzip(head)
+
+	// With ?trailer=true the SHA-256 of the body is sent in
+	// a trailer computed while streaming, clients that
+	// can't get trailers get the checksum from upload in a
+	// header instead
+	var trailer *checksumTrailer
+	if r.URL.Query().Get("trailer") == "true" {
+		if canSendTrailers(r) {
+			trailer = newChecksumTrailer(w)
+			w = trailer
+		} else if sum, found := localFile.Checksums[ChecksumSHA256]; found && !decompress {
+			w.Header().Set(contentSHA256Header, sum)
+		}
+	}
+	contentName := fileName
+	if decompress {
+		contentName = decompressedName(fileName)
+	}
+	setMetadataHeaders(w.Header(), localFile.Metadata)
+
+	if !decompress {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", contentName))
+		w.Header().Set("Content-Type", s.contentType(contentName, head))
+		if s.untrustedContent(contentName) {
+			setUntrustedContentHeaders(w.Header())
+		}
+		setChecksumHeaders(w.Header(), localFile.Checksums)
+		w.Header().Set("ETag", localFile.etag())
+
+		// ServeContent serves Range requests, honoring If-Range
+		// so a client resuming a download of a file that has
+		// since changed gets all of the new file instead
+		// Several ranges are sent as a multipart/byteranges
+		// body, each part with the Content-Type set above
+		if _, err := localFile.Seek(0, io.SeekStart); err != nil {
+			log.Error().Err(err).Msg("Unable to seek in file")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception in processing the download"))
+			return
+		}
+
+		// ?offset= and ?length= serve a slice of the file to
+		// clients that can't send a Range header, a slice
+		// doesn't consume the file
+		offset, length, sliced, err := parseSlice(r.URL.Query(), size)
+		if err != nil {
+			log.Error().Err(err).Msg("Invalid download slice")
+			if errors.Is(err, errSliceOutOfRange) {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			w.Write([]byte(fmt.Sprintf("Invalid offset or length (%v)", err)))
+			return
+		}
+		if sliced {
+			s.serveSlice(w, r, localFile, offset, length)
+			return
+		}
+
+		served := &servedWriter{ResponseWriter: w}
+		http.ServeContent(served, r, contentName, localFile.UploadedAt, localFile)
+		if served.status != http.StatusOK || r.Method == http.MethodHead {
+			return
+		}
+		if served.written != size {
+			log.Info().
+				Int64("writtenBytes", served.written).
+				Msg("Download aborted by the client")
+			return
+		}
+		if trailer != nil {
+			trailer.finish()
+		}
+	} else {
+		decompressed, decompressedHead, err := newGzipReader(content)
+		if err != nil {
+			log.Error().Err(err).
+				Str("fileName", fileName).
+				Msg("Unable to decompress corrupt gzip file")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception decompressing the file, it is not valid gzip"))
+			return
+		}
+		defer decompressed.Close()
+
+		// The length of the decompressed content isn't known
+		// up front and the checksums are of the stored bytes,
+		// so neither is sent
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", contentName))
+		w.Header().Set("Content-Type", s.contentType(contentName, decompressedHead))
+		if s.untrustedContent(contentName) {
+			setUntrustedContentHeaders(w.Header())
+		}
+
+		// Failing to write the response also means the client
+		// went away, the context may just not be cancelled yet
+		bytes, err := copyWithContext(r.Context(), w, decompressed)
+		if isAborted(err) || isWriteError(err) {
+			log.Info().
+				Err(err).
+				Int64("writtenBytes", bytes).
+				Msg("Download aborted by the client")
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).
+				Str("fileName", fileName).
+				Msg("Unable to decompress corrupt gzip file")
+			// Once part of the body is sent the status can't
+			// change, aborting the response lets the client
+			// tell it is incomplete
+			if bytes > 0 {
+				panic(http.ErrAbortHandler)
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception in processing the download"))
+			return
+		}
+		if trailer != nil {
+			trailer.finish()
+		}
+	}
+
+	// Only a complete transfer consumes the file, after a
+	// failure it is kept for the next consumer
+	if consume {
+		localFile.Close()
+		if err := s.removeFile(fileName, fileObj); err != nil {
+			log.Error().Err(err).Msg("Unable to delete consumed file")
+			return
+		}
+		log.Info().
+			Str("fileName", fileName).
+			Msg("Consumed file")
+	}
+}
+
+// File is a stored file opened for reading
+type File struct {
+	io.ReadSeekCloser
+	StoredFile
+}
+
+// Open opens the stored file name for reading, the caller
+// must close it
+func (s *FileService) Open(name string) (*File, error) {
+	name = s.resolveName(name)
+	fileObj, found := s.lookup(name)
+	if !found {
+		return nil, ErrNotFound
+	}
+	if fileObj.expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return s.open(name, fileObj)
+}
+
+// open opens the file of fileObj for reading, encrypted
+// files are decrypted on the fly and the size is that of
+// the decrypted content
+func (s *FileService) open(name string, fileObj *FileObject) (*File, error) {
+	// The upload time is read first, content read after the
+	// file is replaced is then cached as stale
+	fileObj.attrMu.RLock()
+	uploadedAt := fileObj.UploadedAt
+	cacheable := s.cache != nil && fileObj.Size <= s.cache.maxFileSize
+	fileObj.attrMu.RUnlock()
+
+	var content io.ReadSeekCloser
+	var size int64
+	if cacheable {
+		if cached, found := s.cache.get(name, fileObj, uploadedAt); found {
+			content, size = cachedContent(cached), int64(len(cached))
+		}
+	}
+	if content == nil {
+		var err error
+		content, size, err = s.openFile(fileObj.Path)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to open file object on the server for reading.")
+			return nil, newServerError(fmt.Sprintf("Server encountered an exception opening the file locally (%v)", err), err)
+		}
+		if cacheable && size <= s.cache.maxFileSize {
+			data, err := io.ReadAll(content)
+			content.Close()
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to read file into the download cache")
+				return nil, newServerError("Server encountered an exception in processing the download", err)
+			}
+			s.cache.put(name, fileObj, uploadedAt, data)
+			content = cachedContent(data)
+		} else if size <= s.DownloadBufferSize {
+			// Small files are sent in one write rather than
+			// streamed in chunks
+			data, err := io.ReadAll(content)
+			content.Close()
+			if err != nil {
+				log.Error().Err(err).Msg("Unable to read file into memory")
+				return nil, newServerError("Server encountered an exception in processing the download", err)
+			}
+			content = cachedContent(data)
+		}
+	}
+
+	return &File{
+		ReadSeekCloser: content,
+		StoredFile: StoredFile{
+			Name:       name,
+			Size:       size,
+			Metadata:   fileObj.copyMetadata(),
+			Checksums:  fileObj.copyChecksums(),
+			UploadedAt: uploadedAt,
+		},
+	}, nil
+}
+
+// serveSlice sends length bytes of the file from offset
+func (s *FileService) serveSlice(w http.ResponseWriter, r *http.Request, file *File, offset, length int64) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.Error().Err(err).Msg("Unable to seek in file")
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Server encountered an exception in processing data for this request"))
+		w.Write([]byte("Server encountered an exception in processing the download"))
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	bytes, err := copyWithContext(r.Context(), w, io.LimitReader(file, length))
+	if err != nil || bytes != length {
+		log.Info().
+			Err(err).
+			Int64("writtenBytes", bytes).
+			Msg("Download aborted by the client")
+		return
+	}
+	if trailer, ok := w.(*checksumTrailer); ok {
+		trailer.finish()
+	}
+}
+
+// fileAttrs are the attributes of a file being stored
+type fileAttrs struct {
+	size       int64
+	metadata   map[string]string
+	checksums  map[string]string
+	uploadedAt time.Time
+}
+
+// putFile moves the file written at srcPath into place
+// (unless it was written in place) and adds fileObj to the
+// DB with its attributes, replacing any previous file
+// The DB lock is held throughout so the size totals always
+// match the DB, a failed rename changes neither
+// The caller must hold the file's write lock
+func (s *FileService) putFile(name string, fileObj *FileObject, srcPath string, attrs fileAttrs) error {
+	s.DBMu.Lock()
+	defer s.DBMu.Unlock()
+
+	// Checked again under the lock in case a case variant
+	// was stored since the upload started
+	if stored, found := s.conflictingName(name); found {
+		return fmt.Errorf("%w (%s)", errNameConflict, stored)
+	}
+	if _, found := s.DB[name]; found && s.AppendOnly {
+		return errAppendOnlyExists
+	}
+
+	// The previous content is kept to roll back to or as
+	// a revision
+	undo := func() {}
+	if previous, found := s.DB[name]; found && srcPath != fileObj.Path {
+		var err error
+		if undo, err = s.keepPrevious(name, previous, srcPath); err != nil {
+			return err
+		}
+	}
+
+	if srcPath != fileObj.Path {
+		if err := os.Rename(srcPath, fileObj.Path); err != nil {
+			undo()
+			return err
+		}
+	}
+	s.pruneRevisions(name)
+
+	if previous, found := s.DB[name]; found {
+		previous.attrMu.RLock()
+		s.totalBytes -= previous.Size
+		previous.attrMu.RUnlock()
+	}
+	fileObj.attrMu.Lock()
+	fileObj.Size = attrs.size
+	fileObj.Metadata = attrs.metadata
+	fileObj.Checksums = attrs.checksums
+	fileObj.UploadedAt = attrs.uploadedAt
+	fileObj.attrMu.Unlock()
+	s.totalBytes += attrs.size
+	s.DB[name] = fileObj
+	s.indexName(name)
+	s.saveExpiry(name, attrs.metadata)
+	s.invalidateList()
+	s.invalidateCache(name)
+	return nil
+}
+
+// removeFile deletes the file from disk and the DB, the
+// caller must hold the file's write lock
+func (s *FileService) removeFile(name string, fileObj *FileObject) error {
+	if err := os.Remove(fileObj.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if s.GzipSidecars {
+		os.Remove(fileObj.Path + gzipSidecarExt)
+	}
+
+	s.DBMu.Lock()
+	defer s.DBMu.Unlock()
+	if s.DB[name] == fileObj {
+		delete(s.DB, name)
+		s.unindexName(name)
+		s.dropRevisions(name)
+		s.saveExpiry(name, nil)
+		s.totalBytes -= fileObj.size()
+		s.invalidateList()
+		s.invalidateCache(name)
+	}
+	return nil
+}
+
+// requestFileName returns the file name the request is
+// for, either from the name query param (e.g.
+// /download?name=a%2Fb.txt) or the path after prefix
+// The query form avoids escaping issues with names
+// containing slashes or percent signs
+func requestFileName(r *http.Request, prefix string) string {
+	if r.URL.Query().Has("name") {
+		return r.URL.Query().Get("name")
+	}
+	return strings.TrimPrefix(r.URL.Path, prefix)
+}
+
+// deleteFile deletes a file
+func (s *FileService) deleteFile(w http.ResponseWriter, r *http.Request) {
+	fileName := requestFileName(r, "/delete/")
+	log.Info().
+		Str("fileName", fileName).
+		Msg("Processing delete")
+
+	if err := s.Delete(fileName); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete deletes the stored file name, once the uploads
+// of it are done. Downloads don't hold the file's lock, so
+// they aren't waited for, the ones in progress keep reading
+// the content they opened (it is only unlinked)
+func (s *FileService) Delete(name string) error {
+	if s.AppendOnly {
+		log.Info().Msg("Rejecting delete, server is append-only")
+		return errAppendOnly
+	}
+	name = s.resolveName(name)
+	fileObj, found := s.lookup(name)
+	if found {
+		// Wait for uploads of the file to finish, then
+		// re-check it wasn't replaced or removed meanwhile
+		fileObj.Mu.Lock()
+		defer fileObj.Mu.Unlock()
+		current, stillFound := s.lookup(name)
+		found = stillFound && current == fileObj
+	}
+	if !found {
+		log.Debug().
+			Msg("No such file found")
+		return ErrNotFound
+	}
+
+	if err := s.removeFile(name, fileObj); err != nil {
+		log.Error().Err(err).Msg("Unable to delete file")
+		return newServerError("Server encountered an exception deleting the file", err)
+	}
+	return nil
+}
+
+// storedName returns the name an uploaded file is stored
+// under, which is the name given unless slugify is enabled
+func (s *FileService) storedName(name string) string {
+	if s.SlugifyNames {
+		return slugify(name)
+	}
+	return name
+}
+
+// uploadName returns the name a file uploaded by the
+// request as name is stored under, the stored name
+// prefixed with RequiredNamePrefix when the request asks
+// for it with ?autoprefix=true, and with the date dir
+// (after RequiredNamePrefix) with DateLayoutNames
+func (s *FileService) uploadName(r *http.Request, name string) string {
+	name = s.storedName(name)
+	if name != "" && r.URL.Query().Get("autoprefix") == "true" && !strings.HasPrefix(name, s.RequiredNamePrefix) {
+		name = s.RequiredNamePrefix + name
+	}
+	if name != "" && s.DateLayoutNames {
+		prefix := ""
+		if rest, found := strings.CutPrefix(name, s.RequiredNamePrefix); found {
+			prefix, name = s.RequiredNamePrefix, rest
+		}
+		name = prefix + time.Now().In(s.DateLayoutLocation).Format(dateDirLayout) + "/" + name
+	}
+	return name
+}
+
+// writeCreated writes the response to a successful upload,
+// pointing the client at the (possibly normalized or
+// generated) name the file was stored under
+func (s *FileService) writeCreated(w http.ResponseWriter, fileName string, generated bool) {
+	location := "/download/" + url.PathEscape(fileName)
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusCreated)
+	if generated {
+		w.Write([]byte("Upload successful, stored as " + fileName + "\n" + location))
+		return
+	}
+	if s.SlugifyNames {
+		w.Write([]byte("Upload successful, stored as " + fileName))
 		return
 	}
+	w.Write([]byte("Upload successful"))
+}
+
+// lookup returns the FileObject for the file name
+// With LazyLoad a file not in the DB yet is looked up on
+// disk, and added to the DB if it is there
+func (s *FileService) lookup(name string) (*FileObject, bool) {
+	s.DBMu.RLock()
+	fileObj, found := s.DB[name]
+	s.DBMu.RUnlock()
+	if !found && s.LazyLoad {
+		return s.loadFile(name)
+	}
+	return fileObj, found
+}
+
+// loadFile adds the file name to the DB if it is on disk,
+// for LazyLoad
+func (s *FileService) loadFile(name string) (*FileObject, bool) {
+	filePath, err := s.localPath(name)
+	if err != nil {
+		return nil, false
+	}
+
+	// Statted under the lock, so a file deleted meanwhile
+	// isn't added back
+	s.DBMu.Lock()
+	defer s.DBMu.Unlock()
+	if fileObj, found := s.DB[name]; found {
+		return fileObj, true
+	}
+	if s.isWriting(filePath) {
+		return nil, false
+	}
+	fi, err := os.Stat(filePath)
+	if err != nil || !fi.Mode().IsRegular() || (s.GzipSidecars && isGzipSidecar(filePath)) {
+		return nil, false
+	}
+	fileObj := &FileObject{
+		Path:       filePath,
+		Mu:         sync.RWMutex{},
+		Metadata:   s.readExpiry(name),
+		UploadedAt: fi.ModTime(),
+		Size:       s.plainSize(fi.Size()),
+	}
+	s.DB[name] = fileObj
+	s.totalBytes += fileObj.Size
+	s.indexName(name)
+	s.invalidateList()
+	log.Debug().
+		Str("fileName", name).
+		Msg("Loaded file from disk")
+	return fileObj, true
 }
 
 // Start starts the fileservice
 func (s *FileService) Start() error {
 	log.Info().Str("Port", s.Port).Msg("Starting server..")
-	var err error
-	go func() {
-		err = s.HTTPServer.ListenAndServe()
-	}()
+	if s.RescanInterval > 0 {
+		go s.reconcile(s.RescanInterval)
+	}
+	if s.quota != nil {
+		go s.evictQuota()
+	}
+	if s.listLimiter != nil {
+		go s.evictRequestLimiters(s.listLimiter)
+	}
+	if s.mirror != nil {
+		go s.runMirror()
+	}
+	if s.DriftCheckInterval > 0 {
+		go s.watchDrift(s.DriftCheckInterval)
+	}
+	if s.UploadSessionTTL > 0 {
+		go s.expireSessions()
+	}
+	if s.RangeUploadTTL > 0 {
+		go s.expireRangeUploads()
+	}
+	go s.computeChecksums()
+	if s.OverwriteBackupRetention > 0 {
+		go s.pruneBackups()
+	}
+	if s.ExpirySweepInterval > 0 && !s.AppendOnly && !s.ReadOnly {
+		go s.sweepExpiredFiles()
+	}
+
+	// Listening before serving in the background reports
+	// errors such as the port being in use to the caller
+	listener, err := net.Listen("tcp", s.HTTPServer.Addr)
 	if err != nil {
 		log.Err(err).Msg("Error starting the server..")
 		return err
 	}
+	// Connections over the limit wait in the OS accept
+	// queue until one is closed
+	if s.MaxConnections > 0 {
+		listener = netutil.LimitListener(listener, int(s.MaxConnections))
+	}
+	go func() {
+		if err := s.HTTPServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Err(err).Msg("Server stopped serving..")
+		}
+	}()
 	return nil
 }
 
 // Stop shutsdown the file service
+// Keep-alives are disabled first, so connections close
+// once their in-flight request is done instead of idling
+// until the drain deadline
+// It logs how many connections had to be drained and how
+// long that took, to help debug slow terminations
 func (s *FileService) Stop(ctx context.Context) error {
-	log.Info().Msg("Stopping server..")
+	open, active := s.conns.counts()
+	log.Info().
+		Int("openConnections", open).
+		Int("activeConnections", active).
+		Msg("Stopping server..")
+
+	start := time.Now()
+	close(s.done)
+	s.HTTPServer.SetKeepAlivesEnabled(false)
 	err := s.HTTPServer.Shutdown(ctx)
+	if s.audit != nil {
+		if closeErr := s.audit.close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("Unable to close the audit log")
+		}
+	}
+
+	open, active = s.conns.counts()
+	event := log.Info()
 	if err != nil {
-		log.Err(err).Msg("Error starting the server..")
-		return err
+		event = log.Error().Err(err)
 	}
-	return nil
+	event.
+		Dur("drainDuration", time.Since(start)).
+		Bool("deadlineExceeded", errors.Is(err, context.DeadlineExceeded)).
+		Int("remainingConnections", open).
+		Int("remainingActiveConnections", active).
+		Msg("Stopped server")
+	return err
+}
+
+// mutating wraps a handler that modifies the stored files
+// so it is refused while the service is in read-only mode
+func (s *FileService) mutating(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.ReadOnly {
+			log.Info().
+				Str("path", r.URL.Path).
+				Msg("Rejecting request, server is in read-only mode")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Server is in read-only mode"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// modifying wraps a handler that modifies stored files
+// (rather than adding new ones) so it is also refused
+// while the service is in append-only mode
+func (s *FileService) modifying(h http.HandlerFunc) http.HandlerFunc {
+	return s.mutating(func(w http.ResponseWriter, r *http.Request) {
+		if s.AppendOnly {
+			log.Info().
+				Str("path", r.URL.Path).
+				Msg("Rejecting request, server is append-only")
+			s.writeError(w, errAppendOnly)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// enumerating wraps a handler that reveals the names of
+// stored files so it is hidden when listing is disabled
+func (s *FileService) enumerating(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.DisableList {
+			log.Debug().
+				Str("path", r.URL.Path).
+				Msg("Rejecting request, listing is disabled")
+			http.NotFound(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// withListTimeout wraps a handler that should never hang
+// so the client gets a 503 once ListTimeout passes
+// Uploads and downloads aren't wrapped, they need to stream
+// (the timeout handler buffers the whole response)
+func (s *FileService) withListTimeout(h http.HandlerFunc) http.Handler {
+	if s.ListTimeout <= 0 {
+		return h
+	}
+	return http.TimeoutHandler(h, s.ListTimeout, "Server timed out processing the request")
+}
+
+// withRequestTimeout wraps the mux so requests get a 503
+// once RequestTimeout passes, except the ones to the
+// RequestTimeoutExempt paths which stream (the timeout
+// handler buffers the whole response), they only stop
+// once the client goes away
+func (s *FileService) withRequestTimeout(h http.Handler) http.Handler {
+	if s.RequestTimeout <= 0 {
+		return h
+	}
+	timeoutHandler := http.TimeoutHandler(h, s.RequestTimeout, "Server timed out processing the request")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, exempt := range s.RequestTimeoutExempt {
+			exempt = strings.TrimSuffix(exempt, "/")
+			if r.URL.Path == exempt || strings.HasPrefix(r.URL.Path, exempt+"/") {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		timeoutHandler.ServeHTTP(w, r)
+	})
 }
 
 // httpRequestLoggerWrapper is a wrapper around mux
-// which logs every request to the server
-func httpRequestLoggerWrapper(h http.Handler) http.Handler {
+// which logs every request (or 1 in AccessLogSampleRate)
+// to the server, mux is returned as is without AccessLog
+func (s *FileService) httpRequestLoggerWrapper(h http.Handler) http.Handler {
+	if !s.AccessLog {
+		return h
+	}
+	rate := uint64(s.AccessLogSampleRate)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := strings.Split(r.URL.Path, "/")
-		if !slices.Contains(ignoredPaths, path[1]) {
+		if !slices.Contains(ignoredPaths, path[1]) && (rate <= 1 || s.accessLogCount.Add(1)%rate == 0) {
 			log.Info().Msgf("Server received %s request at path %s", r.Method, r.URL.Path)
 		}
 		h.ServeHTTP(w, r)
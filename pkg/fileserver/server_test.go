@@ -0,0 +1,491 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// newTestService returns a service storing its files in a
+// temp dir and configured by opts, along with a test
+// server serving it
+func newTestService(t testing.TB, opts ...Option) (*FileService, *httptest.Server) {
+	t.Helper()
+	DefaultStoragePath = filepath.Join(t.TempDir(), "files")
+	s, err := NewFileService(opts...)
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	srv := httptest.NewServer(s.HTTPServer.Handler)
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// doRequest sends a request to the test server, returning
+// the response along with its body
+func doRequest(t testing.TB, method, url string, body io.Reader, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading the response to %s %s: %v", method, url, err)
+	}
+	return resp, string(content)
+}
+
+// uploadFile uploads content as the file name, failing the
+// test unless it is stored
+func uploadFile(t testing.TB, srv *httptest.Server, name, content string) {
+	t.Helper()
+	resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/"+name, strings.NewReader(content), nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("uploading %s: got %d (%s), want %d", name, resp.StatusCode, body, http.StatusCreated)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, srv := newTestService(t)
+	uploadFile(t, srv, "a.txt", "hello")
+
+	tests := []struct {
+		readOnly bool
+		method   string
+		path     string
+		want     int
+	}{
+		{true, http.MethodPut, "/upload/b.txt", http.StatusForbidden},
+		{true, http.MethodDelete, "/delete/a.txt", http.StatusForbidden},
+		{true, http.MethodGet, "/download/a.txt", http.StatusOK},
+		{true, http.MethodGet, "/list/", http.StatusOK},
+		{true, http.MethodGet, "/stats", http.StatusOK},
+		{false, http.MethodPut, "/upload/b.txt", http.StatusCreated},
+		{false, http.MethodDelete, "/delete/b.txt", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		s.ReadOnly = tt.readOnly
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader("content"), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("read-only %v: %s %s got %d (%s), want %d", tt.readOnly, tt.method, tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	for _, readOnly := range []bool{true, false} {
+		s.ReadOnly = readOnly
+		want := ModeReadWrite
+		if readOnly {
+			want = ModeReadOnly
+		}
+
+		var health Health
+		_, body := doRequest(t, http.MethodGet, srv.URL+"/healthz", nil, nil)
+		if err := json.Unmarshal([]byte(body), &health); err != nil {
+			t.Fatalf("decoding healthz: %v", err)
+		}
+		var stats StorageStats
+		_, body = doRequest(t, http.MethodGet, srv.URL+"/stats", nil, nil)
+		if err := json.Unmarshal([]byte(body), &stats); err != nil {
+			t.Fatalf("decoding stats: %v", err)
+		}
+		if health.Mode != want || stats.Mode != want {
+			t.Errorf("read-only %v: healthz mode %q and stats mode %q, want %q", readOnly, health.Mode, stats.Mode, want)
+		}
+	}
+}
+
+func TestConsumeOnce(t *testing.T) {
+	_, srv := newTestService(t)
+
+	tests := []struct {
+		name      string
+		consumers int
+	}{
+		{"two.txt", 2},
+		{"many.txt", 16},
+	}
+	for _, tt := range tests {
+		content := strings.Repeat("x", 1<<20)
+		uploadFile(t, srv, tt.name, content)
+
+		var wg sync.WaitGroup
+		statuses := make(chan int, tt.consumers)
+		for i := 0; i < tt.consumers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name+"?consume=true", nil, nil)
+				if resp.StatusCode == http.StatusOK && body != content {
+					t.Errorf("%s: consumer got %d bytes, want %d", tt.name, len(body), len(content))
+				}
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		got := map[int]int{}
+		for status := range statuses {
+			got[status]++
+		}
+		if got[http.StatusOK] != 1 || got[http.StatusNotFound] != tt.consumers-1 {
+			t.Errorf("%s: %d consumers got %v, want a single 200 and 404s", tt.name, tt.consumers, got)
+		}
+	}
+}
+
+func TestFailFastWrites(t *testing.T) {
+	tests := []struct {
+		failFast bool
+		want     int
+	}{
+		{true, http.StatusConflict},
+		{false, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		s, srv := newTestService(t, func(s *FileService) { s.FailFastWrites = tt.failFast })
+		uploadFile(t, srv, "busy.txt", "original")
+		fileObj, _ := s.lookup("busy.txt")
+
+		// The first overwrite holds the file until its body
+		// is closed
+		body, bodyWriter := io.Pipe()
+		first := make(chan int)
+		go func() {
+			resp, _ := doRequest(t, http.MethodPut, srv.URL+"/upload/busy.txt", body, nil)
+			first <- resp.StatusCode
+		}()
+		bodyWriter.Write([]byte("first "))
+		for fileObj.Mu.TryLock() {
+			fileObj.Mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+
+		second := make(chan int)
+		go func() {
+			resp, _ := doRequest(t, http.MethodPut, srv.URL+"/upload/busy.txt", strings.NewReader("second"), nil)
+			second <- resp.StatusCode
+		}()
+		if tt.failFast {
+			if got := <-second; got != tt.want {
+				t.Errorf("fail fast: second overwrite got %d, want %d", got, tt.want)
+			}
+		}
+		bodyWriter.Write([]byte("overwrite"))
+		bodyWriter.Close()
+		if got := <-first; got != http.StatusCreated {
+			t.Errorf("fail fast %v: first overwrite got %d, want %d", tt.failFast, got, http.StatusCreated)
+		}
+		if !tt.failFast {
+			if got := <-second; got != tt.want {
+				t.Errorf("waiting: second overwrite got %d, want %d", got, tt.want)
+			}
+		}
+	}
+}
+
+func TestQueryNames(t *testing.T) {
+	s, srv := newTestService(t)
+
+	names := []string{"dir/sub/a.txt", "100%.txt", "dir/50% off.txt", "a%2Fb.txt"}
+	for _, name := range names {
+		query := "?name=" + url.QueryEscape(name)
+		tests := []struct {
+			method string
+			path   string
+			body   io.Reader
+			want   int
+		}{
+			{http.MethodPut, "/upload" + query, strings.NewReader("content of " + name), http.StatusCreated},
+			{http.MethodGet, "/download" + query, nil, http.StatusOK},
+			{http.MethodGet, "/download/?name=" + url.QueryEscape(name), nil, http.StatusOK},
+			{http.MethodDelete, "/delete" + query, nil, http.StatusNoContent},
+			{http.MethodGet, "/download" + query, nil, http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			resp, body := doRequest(t, tt.method, srv.URL+tt.path, tt.body, nil)
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s %s got %d (%s), want %d", tt.method, tt.path, resp.StatusCode, body, tt.want)
+			}
+			if tt.method == http.MethodGet && tt.want == http.StatusOK && body != "content of "+name {
+				t.Errorf("%s %s got %q, want the content of %s", tt.method, tt.path, body, name)
+			}
+			if tt.method == http.MethodPut {
+				// The name is stored unescaped, as given
+				if _, found := s.lookup(name); !found {
+					t.Errorf("%s isn't stored under its unescaped name", name)
+				}
+			}
+		}
+	}
+
+	// The path form still works for nested names
+	uploadFile(t, srv, "dir/path.txt", "content")
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/download?name=dir/path.txt", nil, nil); body != "content" {
+		t.Errorf("path form upload downloaded with the query form got %q", body)
+	}
+}
+
+// startTestService starts a service configured by opts on
+// a free port, returning it along with its base URL
+// The caller stops it
+func startTestService(t *testing.T, opts ...Option) (*FileService, string) {
+	t.Helper()
+	// Start listens on the port itself, pick a free one
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+
+	DefaultStoragePath = filepath.Join(t.TempDir(), "files")
+	s, err := NewFileService(append(opts, func(s *FileService) { s.Port = port })...)
+	if err != nil {
+		t.Fatalf("NewFileService: %v", err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	return s, "http://127.0.0.1:" + port
+}
+
+func TestStopDisablesKeepAlives(t *testing.T) {
+	s, baseURL := startTestService(t)
+	draining := make(chan struct{})
+	s.HTTPServer.RegisterOnShutdown(func() { close(draining) })
+
+	// Before stopping, connections are kept alive
+	resp, _ := doRequest(t, http.MethodPut, baseURL+"/upload/a.txt", strings.NewReader("content"), nil)
+	if resp.Close {
+		t.Errorf("upload before stopping closed the connection")
+	}
+
+	// An upload in progress when the server stops is
+	// answered with its connection closed
+	body, bodyWriter := io.Pipe()
+	uploaded := make(chan *http.Response)
+	go func() {
+		resp, _ := doRequest(t, http.MethodPut, baseURL+"/upload/b.txt", body, nil)
+		uploaded <- resp
+	}()
+	bodyWriter.Write([]byte("in "))
+	for _, active := s.conns.counts(); active == 0; _, active = s.conns.counts() {
+		time.Sleep(time.Millisecond)
+	}
+	stopped := make(chan error)
+	go func() { stopped <- s.Stop(context.Background()) }()
+	<-draining
+
+	bodyWriter.Write([]byte("flight"))
+	bodyWriter.Close()
+	resp = <-uploaded
+	if resp.StatusCode != http.StatusCreated || !resp.Close {
+		t.Errorf("upload while draining got %d with Connection %q, want %d with the connection closed", resp.StatusCode, resp.Header.Get("Connection"), http.StatusCreated)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) {
+		s.RequestTimeout = 100 * time.Millisecond
+		s.ListTimeout = 0
+	})
+
+	// A list waiting on the DB is cut off
+	s.DBMu.Lock()
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil)
+	s.DBMu.Unlock()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("slow list got %d (%s), want %d", resp.StatusCode, body, http.StatusServiceUnavailable)
+	}
+
+	// An upload taking longer is exempt
+	content, contentWriter := io.Pipe()
+	go func() {
+		contentWriter.Write([]byte("slow "))
+		time.Sleep(3 * s.RequestTimeout)
+		contentWriter.Write([]byte("upload"))
+		contentWriter.Close()
+	}()
+	if resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/slow.txt", content, nil); resp.StatusCode != http.StatusCreated {
+		t.Errorf("slow upload got %d (%s), want %d", resp.StatusCode, body, http.StatusCreated)
+	}
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/download/slow.txt", nil, nil); body != "slow upload" {
+		t.Errorf("slow upload stored %q, want %q", body, "slow upload")
+	}
+
+	// Fast requests aren't affected
+	if resp, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil); resp.StatusCode != http.StatusOK || body != "slow.txt" {
+		t.Errorf("list got %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, "slow.txt")
+	}
+}
+
+func BenchmarkAccessLog(b *testing.B) {
+	// The access log is written by the global logger
+	logger, level := log.Logger, zerolog.GlobalLevel()
+	b.Cleanup(func() {
+		log.Logger = logger
+		zerolog.SetGlobalLevel(level)
+	})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	log.Logger = zerolog.New(io.Discard)
+
+	tests := []struct {
+		desc       string
+		enabled    bool
+		sampleRate int64
+	}{
+		{"off", false, 1},
+		{"on", true, 1},
+		{"sampled=100", true, 100},
+	}
+	for _, tt := range tests {
+		s, srv := newTestService(b, func(s *FileService) {
+			s.AccessLog = tt.enabled
+			s.AccessLogSampleRate = tt.sampleRate
+		})
+		uploadFile(b, srv, "a.txt", "hello")
+		handler := s.HTTPServer.Handler
+
+		b.Run(tt.desc, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stat/a.txt", nil))
+				if rec.Code != http.StatusOK {
+					b.Fatalf("stat got %d", rec.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestEmptyUploads(t *testing.T) {
+	// emptyChunked is an empty body the client can't tell is
+	// empty before sending it, so it is sent chunked
+	emptyChunked := func() io.Reader {
+		body, bodyWriter := io.Pipe()
+		go func() {
+			time.Sleep(300 * time.Millisecond)
+			bodyWriter.Close()
+		}()
+		return body
+	}
+
+	tests := []struct {
+		allowEmpty bool
+		want       int
+	}{
+		{false, http.StatusBadRequest},
+		{true, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		s, srv := newTestService(t, func(s *FileService) { s.AllowEmpty = tt.allowEmpty })
+
+		bodies := map[string]io.Reader{
+			".keep":       strings.NewReader(""),
+			"chunked.txt": emptyChunked(),
+		}
+		for name, body := range bodies {
+			resp, respBody := doRequest(t, http.MethodPut, srv.URL+"/upload/"+name, body, nil)
+			if resp.StatusCode != tt.want {
+				t.Errorf("allow empty %v: uploading %s got %d (%s), want %d", tt.allowEmpty, name, resp.StatusCode, respBody, tt.want)
+			}
+
+			fileObj, found := s.lookup(name)
+			if found != tt.allowEmpty {
+				t.Errorf("allow empty %v: %s stored %v", tt.allowEmpty, name, found)
+			}
+			if !found {
+				filePath, _ := s.localPath(name)
+				if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+					t.Errorf("allow empty %v: %s was left on disk: %v", tt.allowEmpty, name, err)
+				}
+				continue
+			}
+			if fi, err := os.Stat(fileObj.Path); err != nil || fi.Size() != 0 {
+				t.Errorf("allow empty %v: %s isn't an empty file on disk: %v", tt.allowEmpty, name, err)
+			}
+			resp, respBody = doRequest(t, http.MethodGet, srv.URL+"/download/"+name, nil, nil)
+			if resp.StatusCode != http.StatusOK || respBody != "" || resp.ContentLength != 0 {
+				t.Errorf("allow empty %v: downloading %s got %d with %d bytes", tt.allowEmpty, name, resp.StatusCode, len(respBody))
+			}
+		}
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	_, srv := newTestService(t, func(s *FileService) { s.AppendOnly = true })
+	uploadFile(t, srv, "a.txt", "original")
+
+	// The steps run in order
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"overwrite", http.MethodPut, "/upload/a.txt", "overwrite", http.StatusConflict},
+		{"delete", http.MethodDelete, "/delete/a.txt", "", http.StatusForbidden},
+		{"consuming download", http.MethodGet, "/download/a.txt?consume=true", "", http.StatusForbidden},
+		{"new upload", http.MethodPut, "/upload/b.txt", "new", http.StatusCreated},
+		{"overwrite of the new upload", http.MethodPut, "/upload/b.txt", "overwrite", http.StatusConflict},
+		{"download", http.MethodGet, "/download/a.txt", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader(tt.body), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	// The files are untouched
+	for name, want := range map[string]string{"a.txt": "original", "b.txt": "new"} {
+		if resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/"+name, nil, nil); resp.StatusCode != http.StatusOK || body != want {
+			t.Errorf("%s: got %d %q, want %q", name, resp.StatusCode, body, want)
+		}
+	}
+
+	// The mode is reported to clients
+	for _, path := range []string{"/healthz", "/stats"} {
+		var reported struct {
+			Mode string `json:"mode"`
+		}
+		_, body := doRequest(t, http.MethodGet, srv.URL+path, nil, nil)
+		if err := json.Unmarshal([]byte(body), &reported); err != nil || reported.Mode != ModeAppendOnly {
+			t.Errorf("%s reports mode %q (%v), want %q", path, reported.Mode, err, ModeAppendOnly)
+		}
+	}
+}
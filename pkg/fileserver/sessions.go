@@ -0,0 +1,462 @@
+package fileserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxSessionParts bounds the part numbers of an upload
+// session, parts are numbered from 0
+const maxSessionParts = 10000
+
+// sessionPathRegex matches the path (after /upload/) of a
+// request to an upload session, e.g. "<id>/part/3",
+// "<id>/commit" or "<id>/abort"
+var sessionPathRegex = regexp.MustCompile(`^([0-9a-f]{32})/(?:part/(\d+)|(commit|abort))$`)
+
+// uploadSession is a file being assembled from parts
+// uploaded (in any order) through the session API, it is
+// stored once committed
+type uploadSession struct {
+	mu       sync.Mutex
+	name     string
+	dir      string
+	metadata map[string]string
+
+	// parts maps the part numbers received to their size
+	parts map[int]int64
+
+	lastActive time.Time
+	closed     bool
+}
+
+// sessionsDir is where the parts of upload sessions are
+// kept until they are committed or aborted
+func (s *FileService) sessionsDir() string {
+	return filepath.Join(s.StoragePath, internalDir, "sessions")
+}
+
+// size returns the sum of the sizes of the parts except
+// part n
+func (u *uploadSession) size(except int) int64 {
+	var size int64
+	for n, partSize := range u.parts {
+		if n != except {
+			size += partSize
+		}
+	}
+	return size
+}
+
+// startSession starts an upload session for the file in
+// ?name=, returning its ID, the custom metadata headers
+// of the start request are stored with the file
+// Other methods than POST upload a file named "start"
+// curl -X POST "http://127.0.0.1:37899/upload/start?name=filename"
+func (s *FileService) startSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || isJSONRequest(r) {
+		s.upload(w, r)
+		return
+	}
+
+	fileName := s.uploadName(r, r.URL.Query().Get("name"))
+	if fileName == "" {
+		log.Error().Msg("Upload session is missing the file name")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a file name in ?name="))
+		return
+	}
+	if _, err := s.localPath(fileName); err != nil {
+		log.Error().Err(err).Msg("Invalid file name. Skipping.")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a valid file name."))
+		return
+	}
+	if err := s.checkNameConflict(fileName); err != nil {
+		log.Error().Err(err).Msg("File name conflicts with a stored file. Skipping.")
+		s.writeError(w, err)
+		return
+	}
+	metadata, err := s.uploadMetadata(r.Header)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid metadata headers. Skipping.")
+		if errors.Is(err, errMetadataTooLarge) {
+			w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+			w.Write([]byte(fmt.Sprintf("Invalid metadata headers (%v)", err)))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Invalid metadata headers (%v)", err)))
+		return
+	}
+
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		log.Error().Err(err).Msg("Unable to generate an upload session ID")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception starting the upload session"))
+		return
+	}
+	id := hex.EncodeToString(rawID)
+	session := &uploadSession{
+		name:       fileName,
+		dir:        filepath.Join(s.sessionsDir(), id),
+		metadata:   metadata,
+		parts:      map[int]int64{},
+		lastActive: time.Now(),
+	}
+	if err := os.MkdirAll(session.dir, 0774); err != nil {
+		log.Error().Err(err).Msg("Unable to create the upload session dir")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception starting the upload session"))
+		return
+	}
+
+	s.sessionsMu.Lock()
+	s.sessions[id] = session
+	s.sessionsMu.Unlock()
+
+	log.Info().
+		Str("sessionID", id).
+		Str("fileName", fileName).
+		Msg("Started upload session")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+// uploadSessionRequest handles the part, commit and abort
+// requests of upload sessions, returning false when the
+// request isn't one (so it is a regular upload)
+func (s *FileService) uploadSessionRequest(w http.ResponseWriter, r *http.Request) bool {
+	matches := sessionPathRegex.FindStringSubmatch(strings.TrimPrefix(r.URL.Path, "/upload/"))
+	if matches == nil {
+		return false
+	}
+	id, part, action := matches[1], matches[2], matches[3]
+	switch {
+	case part != "" && r.Method == http.MethodPut:
+		n, err := strconv.Atoi(part)
+		if err != nil || n >= maxSessionParts {
+			log.Error().Str("part", part).Msg("Invalid upload session part number")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Part numbers must be from 0 to %d", maxSessionParts-1)))
+			return true
+		}
+		s.uploadPart(w, r, id, n)
+	case action == "commit" && r.Method == http.MethodPost:
+		s.commitSession(w, r, id)
+	case action == "abort" && r.Method == http.MethodPost:
+		s.abortSession(w, id)
+	default:
+		return false
+	}
+	return true
+}
+
+// lookupSession returns the open upload session with the ID
+func (s *FileService) lookupSession(id string) (*uploadSession, bool) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	session, found := s.sessions[id]
+	return session, found
+}
+
+// closeSession removes the upload session with the ID,
+// parts still being uploaded to it are then discarded
+func (s *FileService) closeSession(id string) (*uploadSession, bool) {
+	s.sessionsMu.Lock()
+	session, found := s.sessions[id]
+	delete(s.sessions, id)
+	s.sessionsMu.Unlock()
+	if !found {
+		return nil, false
+	}
+
+	session.mu.Lock()
+	session.closed = true
+	session.mu.Unlock()
+	return session, true
+}
+
+// writeUnknownSession responds to a request for a session
+// that doesn't exist (or was closed)
+func writeUnknownSession(w http.ResponseWriter, id string) {
+	log.Error().Str("sessionID", id).Msg("Unknown upload session")
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("Upload session not found, it may have expired"))
+}
+
+// uploadPart stores part n of an upload session, a part
+// sent again replaces the previous one
+// curl -T part http://127.0.0.1:37899/upload/<id>/part/0
+func (s *FileService) uploadPart(w http.ResponseWriter, r *http.Request, id string, n int) {
+	session, found := s.lookupSession(id)
+	if !found {
+		writeUnknownSession(w, id)
+		return
+	}
+
+	if !s.checkContentLength(w, r) {
+		return
+	}
+	var body io.Reader = r.Body
+	maxUploadSize := s.maxUploadSize(session.name)
+	if maxUploadSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	}
+	body, settle, err := s.reserveQuota(s.clientIP(r), body, r.ContentLength)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	body, release, err := s.reserveInFlight(body, r.ContentLength)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer release()
+
+	// Parts are written to temp files so parts uploaded
+	// concurrently don't block each other
+	partFile, err := os.CreateTemp(session.dir, ".part-*")
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			writeUnknownSession(w, id)
+			return
+		}
+		log.Error().Err(err).Msg("Unable to create part file on the server.")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("Server encountered an exception creating the file locally (%v)", err)))
+		return
+	}
+	writtenBytes, err := copyWithContext(r.Context(), partFile, body)
+	if closeErr := partFile.Close(); err == nil {
+		err = closeErr
+	}
+	settle(writtenBytes)
+	if err != nil {
+		os.Remove(partFile.Name())
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case isAborted(err):
+			log.Info().
+				Err(err).
+				Int64("writtenBytes", writtenBytes).
+				Msg("Part upload aborted by the client")
+		case errors.As(err, &maxBytesErr):
+			log.Error().Msg("Part exceeded the maximum upload size")
+			s.writeTooLarge(w, session.name)
+		case errors.Is(err, errTooManyInFlight), errors.Is(err, ErrQuotaExceeded):
+			s.writeError(w, err)
+		case isDiskFull(err):
+			log.Warn().Err(err).Msg("Storage is full, discarded the part")
+			w.WriteHeader(http.StatusInsufficientStorage)
+			w.Write([]byte("Server is out of storage space, please try again later"))
+		default:
+			log.Error().Err(err).Msg("Unable to write the part to disk")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception in processing the upload"))
+		}
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.closed {
+		os.Remove(partFile.Name())
+		writeUnknownSession(w, id)
+		return
+	}
+	if maxUploadSize > 0 && session.size(n)+writtenBytes > maxUploadSize {
+		os.Remove(partFile.Name())
+		log.Error().
+			Int64("maxUploadSize", maxUploadSize).
+			Msg("Upload session exceeds the maximum upload size. Skipping.")
+		s.writeTooLarge(w, session.name)
+		return
+	}
+	if err := os.Rename(partFile.Name(), filepath.Join(session.dir, strconv.Itoa(n))); err != nil {
+		os.Remove(partFile.Name())
+		log.Error().Err(err).Msg("Unable to store the part")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception in processing the upload"))
+		return
+	}
+	session.parts[n] = writtenBytes
+	session.lastActive = time.Now()
+
+	log.Info().
+		Str("sessionID", id).
+		Int("part", n).
+		Int64("writtenBytes", writtenBytes).
+		Msg("Wrote part of upload session")
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Received part %d (%d bytes)", n, writtenBytes)))
+}
+
+// commitSession concatenates the parts of an upload
+// session in the order of their numbers and stores the
+// result as the session's file
+// curl -X POST http://127.0.0.1:37899/upload/<id>/commit
+func (s *FileService) commitSession(w http.ResponseWriter, r *http.Request, id string) {
+	session, found := s.lookupSession(id)
+	if !found {
+		writeUnknownSession(w, id)
+		return
+	}
+	session.mu.Lock()
+	empty := len(session.parts) == 0
+	session.mu.Unlock()
+	if empty {
+		log.Error().Str("sessionID", id).Msg("Upload session has no parts to commit")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please upload at least one part before committing"))
+		return
+	}
+
+	if session, found = s.closeSession(id); !found {
+		writeUnknownSession(w, id)
+		return
+	}
+	defer os.RemoveAll(session.dir)
+
+	size, assembledPath, err := session.assemble(r.Context())
+	if err == nil {
+		err = s.commitFile(session.name, assembledPath, size, session.metadata)
+	}
+	if err != nil {
+		switch {
+		case isAborted(err):
+			log.Info().Err(err).Msg("Upload session commit aborted by the client")
+		case errors.Is(err, ErrConflict):
+			log.Error().Err(err).Msg("File name conflicts with a stored file. Skipping.")
+			s.writeError(w, err)
+		case errors.Is(err, ErrContentMismatch):
+			s.writeError(w, err)
+		case errors.Is(err, ErrInfected):
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(fmt.Sprintf("Upload rejected (%v)", err)))
+		case isDiskFull(err):
+			log.Warn().Err(err).Msg("Storage is full, discarded the upload session")
+			w.WriteHeader(http.StatusInsufficientStorage)
+			w.Write([]byte("Server is out of storage space, please try again later"))
+		default:
+			log.Error().Err(err).Msg("Unable to commit the upload session")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Server encountered an exception while comitting data to local file"))
+		}
+		return
+	}
+
+	log.Info().
+		Str("sessionID", id).
+		Str("fileName", session.name).
+		Int("parts", len(session.parts)).
+		Int64("size", size).
+		Msg("Committed upload session")
+
+	s.writeCreated(w, session.name, false)
+	s.uploadCommitted(session.name, size)
+}
+
+// assemble concatenates the parts in the order of their
+// numbers into a file in the session dir, returning its
+// size and path
+func (u *uploadSession) assemble(ctx context.Context) (int64, string, error) {
+	numbers := make([]int, 0, len(u.parts))
+	for n := range u.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	assembled, err := os.CreateTemp(u.dir, ".assembled-*")
+	if err != nil {
+		return 0, "", err
+	}
+	defer assembled.Close()
+
+	var size int64
+	for _, n := range numbers {
+		part, err := os.Open(filepath.Join(u.dir, strconv.Itoa(n)))
+		if err != nil {
+			return 0, "", err
+		}
+		written, err := copyWithContext(ctx, assembled, part)
+		part.Close()
+		if err != nil {
+			return 0, "", err
+		}
+		size += written
+	}
+	return size, assembled.Name(), assembled.Close()
+}
+
+// abortSession discards an upload session and its parts
+// curl -X POST http://127.0.0.1:37899/upload/<id>/abort
+func (s *FileService) abortSession(w http.ResponseWriter, id string) {
+	session, found := s.closeSession(id)
+	if !found {
+		writeUnknownSession(w, id)
+		return
+	}
+	if err := os.RemoveAll(session.dir); err != nil {
+		log.Error().Err(err).Str("sessionID", id).Msg("Unable to remove the upload session dir")
+	}
+
+	log.Info().Str("sessionID", id).Msg("Aborted upload session")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// expireSessions periodically discards the upload sessions
+// without activity for UploadSessionTTL until the service
+// is stopped
+func (s *FileService) expireSessions() {
+	ticker := time.NewTicker(s.UploadSessionTTL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.sessionsMu.Lock()
+			var expired []string
+			for id, session := range s.sessions {
+				session.mu.Lock()
+				if time.Since(session.lastActive) > s.UploadSessionTTL {
+					expired = append(expired, id)
+				}
+				session.mu.Unlock()
+			}
+			s.sessionsMu.Unlock()
+
+			for _, id := range expired {
+				if session, found := s.closeSession(id); found {
+					log.Info().Str("sessionID", id).Msg("Upload session expired")
+					os.RemoveAll(session.dir)
+				}
+			}
+		}
+	}
+}
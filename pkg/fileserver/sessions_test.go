@@ -0,0 +1,103 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// startTestSession starts an upload session for name,
+// returning its ID
+func startTestSession(t *testing.T, srv *httptest.Server, name string) string {
+	t.Helper()
+	resp, body := doRequest(t, http.MethodPost, srv.URL+"/upload/start?name="+name, nil, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("starting a session for %s got %d (%s)", name, resp.StatusCode, body)
+	}
+	var session struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal([]byte(body), &session); err != nil {
+		t.Fatalf("decoding the session: %v", err)
+	}
+	return session.ID
+}
+
+func TestUploadSession(t *testing.T) {
+	s, srv := newTestService(t)
+
+	tests := []struct {
+		name  string
+		parts map[int]string
+		order []int
+		want  string
+	}{
+		{"in-order.txt", map[int]string{0: "aaa", 1: "bbb", 2: "ccc"}, []int{0, 1, 2}, "aaabbbccc"},
+		{"reversed.txt", map[int]string{0: "aaa", 1: "bbb", 2: "ccc"}, []int{2, 1, 0}, "aaabbbccc"},
+		{"shuffled.txt", map[int]string{0: "a", 1: "bb", 2: "ccc", 3: "dddd"}, []int{3, 0, 2, 1}, "abbcccdddd"},
+		// Numbers need not be contiguous, they only order the parts
+		{"sparse.txt", map[int]string{5: "second", 1: "first"}, []int{5, 1}, "firstsecond"},
+	}
+	for _, tt := range tests {
+		id := startTestSession(t, srv, tt.name)
+		for _, n := range tt.order {
+			resp, body := doRequest(t, http.MethodPut, fmt.Sprintf("%s/upload/%s/part/%d", srv.URL, id, n), strings.NewReader(tt.parts[n]), nil)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: part %d got %d (%s)", tt.name, n, resp.StatusCode, body)
+			}
+		}
+		resp, body := doRequest(t, http.MethodPost, srv.URL+"/upload/"+id+"/commit", nil, nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("%s: commit got %d (%s)", tt.name, resp.StatusCode, body)
+		}
+
+		_, body = doRequest(t, http.MethodGet, srv.URL+"/download/"+tt.name, nil, nil)
+		if body != tt.want {
+			t.Errorf("%s: assembled %q, want %q", tt.name, body, tt.want)
+		}
+	}
+
+	entries, err := os.ReadDir(s.sessionsDir())
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d session dirs are left after committing", len(entries))
+	}
+}
+
+func TestAbortUploadSession(t *testing.T) {
+	s, srv := newTestService(t)
+	id := startTestSession(t, srv, "aborted.txt")
+	doRequest(t, http.MethodPut, srv.URL+"/upload/"+id+"/part/0", strings.NewReader("part"), nil)
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodPost, "/upload/" + id + "/abort", http.StatusNoContent},
+		{http.MethodPost, "/upload/" + id + "/abort", http.StatusNotFound},
+		{http.MethodPut, "/upload/" + id + "/part/1", http.StatusNotFound},
+		{http.MethodPost, "/upload/" + id + "/commit", http.StatusNotFound},
+		{http.MethodGet, "/download/aborted.txt", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, strings.NewReader("part"), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s %s got %d (%s), want %d", tt.method, tt.path, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	entries, err := os.ReadDir(s.sessionsDir())
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d session dirs are left after aborting", len(entries))
+	}
+}
@@ -0,0 +1,122 @@
+package fileserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// gzipSidecarExt is the extension of the precompressed
+// variant of a file, stored next to it
+const gzipSidecarExt = ".gz"
+
+// acceptsGzip reports whether the client accepts gzip
+// encoded responses (and didn't refuse them with q=0)
+func acceptsGzip(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// isGzipSidecar reports whether the file at filePath is
+// the precompressed variant of another file, e.g.
+// "app.js.gz" next to "app.js"
+func isGzipSidecar(filePath string) bool {
+	base, found := strings.CutSuffix(filePath, gzipSidecarExt)
+	if !found {
+		return false
+	}
+	fi, err := os.Stat(base)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// serveGzipSidecar sends the precompressed variant of the
+// file, if the client accepts gzip and there is one at
+// least as new as the file, reporting whether it did
+// Slices, trailers and decompressed downloads are of the
+// file itself, they are never served from the variant
+func (s *FileService) serveGzipSidecar(w http.ResponseWriter, r *http.Request, fileName string, fileObj *FileObject) bool {
+	query := r.URL.Query()
+	if !acceptsGzip(r) || query.Has("offset") || query.Has("length") ||
+		query.Get("trailer") == "true" || query.Get("decompress") == "true" {
+		return false
+	}
+
+	sidecar, err := os.Open(fileObj.Path + gzipSidecarExt)
+	if err != nil {
+		return false
+	}
+	defer sidecar.Close()
+	fi, err := sidecar.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	fileObj.attrMu.RLock()
+	file := File{StoredFile: StoredFile{
+		Name:       fileName,
+		Size:       fileObj.Size,
+		Metadata:   copyStringMap(fileObj.Metadata),
+		Checksums:  copyStringMap(fileObj.Checksums),
+		UploadedAt: fileObj.UploadedAt,
+	}}
+	fileObj.attrMu.RUnlock()
+
+	// A variant older than the file was made from a
+	// previous upload of it
+	if fi.ModTime().Before(file.UploadedAt) {
+		log.Debug().
+			Str("fileName", fileName).
+			Msg("Skipping gzip variant older than the file")
+		return false
+	}
+
+	// The content type is that of the file, sniffed from
+	// the decompressed variant
+	decompressed, head, err := newGzipReader(sidecar)
+	if err != nil {
+		log.Warn().Err(err).
+			Str("fileName", fileName).
+			Msg("Skipping invalid gzip variant")
+		return false
+	}
+	decompressed.Close()
+	if _, err := sidecar.Seek(0, io.SeekStart); err != nil {
+		log.Error().Err(err).Msg("Unable to seek in gzip variant")
+		return false
+	}
+
+	if s.DownloadRateLimit > 0 {
+		w = newThrottledWriter(r.Context(), w, s.DownloadRateLimit)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	w.Header().Set("Content-Type", s.contentType(fileName, head))
+	w.Header().Set("Content-Encoding", "gzip")
+	if s.untrustedContent(fileName) {
+		setUntrustedContentHeaders(w.Header())
+	}
+	setMetadataHeaders(w.Header(), file.Metadata)
+	setChecksumHeaders(w.Header(), file.Checksums)
+
+	// The variant has an ETag of its own, so ranges of it
+	// aren't resumed against the file or the other way
+	// around
+	w.Header().Set("ETag", strings.TrimSuffix(file.etag(), `"`)+`-gzip"`)
+	http.ServeContent(w, r, fileName, file.UploadedAt, sidecar)
+	return true
+}
@@ -0,0 +1,91 @@
+package fileserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGzipSidecar(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.GzipSidecars = true })
+	content := "console.log('precompressed');\n"
+	uploadFile(t, srv, "app.js", content)
+	fileObj, found := s.lookup("app.js")
+	if !found {
+		t.Fatal("app.js isn't in the DB")
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(content))
+	gz.Close()
+	if err := os.WriteFile(fileObj.Path+gzipSidecarExt, compressed.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The file system clock may be coarser than the upload
+	// time, leaving the variant looking older than the file
+	now := time.Now()
+	if err := os.Chtimes(fileObj.Path+gzipSidecarExt, now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc           string
+		acceptEncoding string
+		query          string
+		wantGzip       bool
+	}{
+		{"gzip accepted", "gzip, deflate", "", true},
+		{"gzip refused", "gzip;q=0, br", "", false},
+		{"no Accept-Encoding", "", "", false},
+		{"slice", "gzip", "?offset=0&length=7", false},
+	}
+	for _, tt := range tests {
+		// Setting Accept-Encoding keeps the client from
+		// decompressing the response itself
+		header := http.Header{"Accept-Encoding": {tt.acceptEncoding}}
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/app.js"+tt.query, nil, header)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d, want %d", tt.desc, resp.StatusCode, http.StatusOK)
+			continue
+		}
+		if got := resp.Header.Get("Content-Type"); got != "text/javascript; charset=utf-8" {
+			t.Errorf("%s: Content-Type %q, want the file's", tt.desc, got)
+		}
+		if !tt.wantGzip {
+			if resp.Header.Get("Content-Encoding") != "" || body != content[:len(body)] {
+				t.Errorf("%s: got %q encoded %q, want the file", tt.desc, body, resp.Header.Get("Content-Encoding"))
+			}
+			continue
+		}
+		if resp.Header.Get("Content-Encoding") != "gzip" || body != compressed.String() {
+			t.Errorf("%s: got %d bytes encoded %q, want the gzip variant", tt.desc, len(body), resp.Header.Get("Content-Encoding"))
+			continue
+		}
+		decompressed, err := gzip.NewReader(bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.desc, err)
+		}
+		if got, _ := io.ReadAll(decompressed); string(got) != content {
+			t.Errorf("%s: decompressed to %q, want %q", tt.desc, got, content)
+		}
+	}
+
+	// The variant isn't a file of its own
+	if _, err := s.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/list/", nil, nil); body != "app.js" {
+		t.Errorf("list got %q, want %q", body, "app.js")
+	}
+
+	// A variant older than the file isn't served
+	uploadFile(t, srv, "app.js", "console.log('newer');\n")
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/app.js", nil, http.Header{"Accept-Encoding": {"gzip"}})
+	if resp.Header.Get("Content-Encoding") != "" || body != "console.log('newer');\n" {
+		t.Errorf("after an overwrite got %q encoded %q, want the new file", body, resp.Header.Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,81 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// uploadSizeError is returned for an upload over the size
+// limit applying to its name
+type uploadSizeError struct {
+	limit int64
+
+	// ext is the extension whose limit applies, empty for
+	// MaxUploadSize
+	ext string
+	err error
+}
+
+func (e *uploadSizeError) Error() string { return e.err.Error() }
+func (e *uploadSizeError) Unwrap() error { return e.err }
+
+// message returns what the client is told, naming the
+// limit the upload exceeded
+func (e *uploadSizeError) message() string {
+	if e.ext != "" {
+		return fmt.Sprintf("File exceeds the maximum upload size of %d bytes for %s files", e.limit, e.ext)
+	}
+	return fmt.Sprintf("File exceeds the maximum upload size of %d bytes", e.limit)
+}
+
+// maxUploadSize returns the largest upload (in bytes)
+// accepted as the file name, the limit of its extension
+// if it has one or else MaxUploadSize, 0 means unlimited
+func (s *FileService) maxUploadSize(name string) int64 {
+	limit, _ := s.uploadSizeLimit(name)
+	return limit
+}
+
+// uploadSizeLimit returns the limit of maxUploadSize, along
+// with the extension it is configured for
+func (s *FileService) uploadSizeLimit(name string) (int64, string) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if limit, found := s.ExtensionMaxUploadSizes[ext]; found && ext != "" {
+		return limit, ext
+	}
+	return s.MaxUploadSize, ""
+}
+
+// largestUploadSize returns the largest upload accepted
+// whatever its name, for bodies read before the name is
+// known, 0 means unlimited
+func (s *FileService) largestUploadSize() int64 {
+	largest := s.MaxUploadSize
+	if largest == 0 {
+		return 0
+	}
+	for _, limit := range s.ExtensionMaxUploadSizes {
+		if limit == 0 {
+			return 0
+		}
+		largest = max(largest, limit)
+	}
+	return largest
+}
+
+// uploadTooLarge returns the error for an upload of name
+// over its size limit, wrapping err
+func (s *FileService) uploadTooLarge(name string, err error) error {
+	limit, ext := s.uploadSizeLimit(name)
+	return withKind(ErrTooLarge, &uploadSizeError{limit: limit, ext: ext, err: err})
+}
+
+// writeTooLarge rejects an upload of name over its size
+// limit with a 413
+func (s *FileService) writeTooLarge(w http.ResponseWriter, name string) {
+	limit, ext := s.uploadSizeLimit(name)
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte((&uploadSizeError{limit: limit, ext: ext}).message()))
+}
@@ -0,0 +1,50 @@
+package fileserver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExtensionMaxUploadSizes(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) {
+		s.MaxUploadSize = 1 << 20
+		s.ExtensionMaxUploadSizes = map[string]int64{".txt": 1 << 10, ".mp4": 0}
+	})
+
+	tests := []struct {
+		name     string
+		size     int
+		chunked  bool
+		want     int
+		wantBody string
+	}{
+		{"small.txt", 512, false, http.StatusCreated, ""},
+		{"large.txt", 2 << 10, false, http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size of 1024 bytes for .txt files"},
+		// Without a Content-Length the cap is enforced as the
+		// body is read
+		{"streamed.txt", 2 << 10, true, http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size of 1024 bytes for .txt files"},
+		{"LARGE.TXT", 2 << 10, false, http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size of 1024 bytes for .txt files"},
+		// Unlisted extensions fall back to the global limit
+		{"large.bin", 2 << 10, false, http.StatusCreated, ""},
+		{"huge.bin", 2 << 20, false, http.StatusRequestEntityTooLarge, "File exceeds the maximum upload size of 1048576 bytes"},
+		{"huge.mp4", 2 << 20, true, http.StatusCreated, ""},
+	}
+	for _, tt := range tests {
+		var body io.Reader = strings.NewReader(strings.Repeat("x", tt.size))
+		if tt.chunked {
+			body = chunked(body)
+		}
+		resp, respBody := doRequest(t, http.MethodPut, srv.URL+"/upload/"+tt.name, body, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.name, resp.StatusCode, respBody, tt.want)
+		}
+		if tt.wantBody != "" && respBody != tt.wantBody {
+			t.Errorf("%s: got %q, want %q", tt.name, respBody, tt.wantBody)
+		}
+		if _, found := s.lookup(tt.name); found != (tt.want == http.StatusCreated) {
+			t.Errorf("%s: stored %v, want %v", tt.name, found, tt.want == http.StatusCreated)
+		}
+	}
+}
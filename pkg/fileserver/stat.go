@@ -0,0 +1,167 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// FileStat describes a stored file, it is the
+// JSON body returned by the stat endpoint
+type FileStat struct {
+	Name      string            `json:"name"`
+	Size      int64             `json:"size"`
+	ModTime   time.Time         `json:"modTime"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	// StorageClass is the storage class the file was
+	// uploaded with, if any
+	StorageClass string `json:"storageClass,omitempty"`
+}
+
+// statBatchMaxFiles is the most files a stat-batch
+// request may ask about
+const statBatchMaxFiles = 1000
+
+// statBatchRequestMaxSize is the largest accepted
+// stat-batch request body
+const statBatchRequestMaxSize = 1 << 20
+
+// statBatchConcurrency is how many files of a stat-batch
+// request are statted at once
+const statBatchConcurrency = 8
+
+// statBatchRequest is the body of a stat-batch request
+type statBatchRequest struct {
+	Files []string `json:"files"`
+}
+
+// BatchStat describes a file asked about in a stat-batch
+// request, a missing file only has Exists (false)
+type BatchStat struct {
+	Exists bool `json:"exists"`
+	*FileStat
+}
+
+// stat returns the size and modification time of a file
+// so clients (e.g. chunked downloaders) can learn its
+// length without downloading it
+func (s *FileService) stat(w http.ResponseWriter, r *http.Request) {
+	fileName := s.resolveName(strings.TrimPrefix(r.URL.Path, "/stat/"))
+	log.Debug().
+		Str("fileName", fileName).
+		Msg("Processing stat")
+
+	stat, err := s.statFile(fileName)
+	if errors.Is(err, ErrNotFound) {
+		log.Debug().
+			Msg("No such file found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("No such file"))
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to validate file on disk")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception in validating local file object"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stat)
+}
+
+// statBatch returns the stats of many files in one
+// request, keyed by the requested name
+// e.g. {"files":["a.txt","b.txt"]}
+func (s *FileService) statBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Please POST the files to stat"))
+		return
+	}
+
+	var req statBatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, statBatchRequestMaxSize)).Decode(&req); err != nil {
+		log.Error().Err(err).Msg("Unable to decode stat-batch request body")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Request body is not a valid stat-batch request"))
+		return
+	}
+	if len(req.Files) > statBatchMaxFiles {
+		log.Error().Int("files", len(req.Files)).Msg("Too many files in stat-batch request")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("Please stat at most %d files per request", statBatchMaxFiles)))
+		return
+	}
+	log.Debug().
+		Int("files", len(req.Files)).
+		Msg("Processing stat-batch")
+
+	stats := make(map[string]BatchStat, len(req.Files))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, statBatchConcurrency)
+	for _, name := range req.Files {
+		mu.Lock()
+		_, seen := stats[name]
+		stats[name] = BatchStat{}
+		mu.Unlock()
+		if seen {
+			continue
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			stat, err := s.statFile(name)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				stats[name] = BatchStat{Exists: true, FileStat: &stat}
+			case !errors.Is(err, ErrNotFound):
+				// A file that can't be statted is reported as
+				// missing rather than failing the whole batch
+				log.Error().Err(err).Str("fileName", name).Msg("Unable to validate file on disk")
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// statFile returns the stat of the stored file name
+func (s *FileService) statFile(name string) (FileStat, error) {
+	name = s.resolveName(name)
+	fileObj, found := s.lookup(name)
+	if !found {
+		return FileStat{}, ErrNotFound
+	}
+
+	// The attributes are read rather than the file statted,
+	// so a stat doesn't wait on an upload replacing the file
+	fileObj.attrMu.RLock()
+	defer fileObj.attrMu.RUnlock()
+	return FileStat{
+		Name:         name,
+		Size:         fileObj.Size,
+		ModTime:      fileObj.UploadedAt,
+		Metadata:     copyStringMap(fileObj.Metadata),
+		Checksums:    copyStringMap(fileObj.Checksums),
+		StorageClass: fileObj.Metadata[StorageClassMetadataKey],
+	}, nil
+}
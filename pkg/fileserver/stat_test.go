@@ -0,0 +1,124 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadContentLength(t *testing.T) {
+	s, srv := newTestService(t)
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty-ish.txt", "x"},
+		{"sniffed", "<html><body>sniffed as HTML</body></html>"},
+		{"image.png", "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 100)},
+		// Larger than the download buffer, so it is streamed
+		{"large.bin", strings.Repeat("0123456789", 10<<10)},
+	}
+	for _, tt := range tests {
+		uploadFile(t, srv, tt.name, tt.content)
+		fileObj, found := s.lookup(tt.name)
+		if !found {
+			t.Fatalf("%s isn't in the DB", tt.name)
+		}
+		fi, err := os.Stat(fileObj.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strconv.FormatInt(fi.Size(), 10)
+
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			resp, body := doRequest(t, method, srv.URL+"/download/"+tt.name, nil, nil)
+			if got := resp.Header.Get("Content-Length"); got != want {
+				t.Errorf("%s %s: Content-Length %q, want %q", method, tt.name, got, want)
+			}
+			if method == http.MethodGet && body != tt.content {
+				t.Errorf("GET %s: got %d bytes, want %d", tt.name, len(body), len(tt.content))
+			}
+		}
+
+		var stat FileStat
+		_, body := doRequest(t, http.MethodGet, srv.URL+"/stat/"+tt.name, nil, nil)
+		if err := json.Unmarshal([]byte(body), &stat); err != nil {
+			t.Fatalf("decoding the stat of %s: %v", tt.name, err)
+		}
+		if stat.Size != fi.Size() {
+			t.Errorf("stat %s: size %d, want %d", tt.name, stat.Size, fi.Size())
+		}
+	}
+}
+
+func TestListTimeout(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.ListTimeout = 50 * time.Millisecond })
+	uploadFile(t, srv, "a.txt", "hello")
+
+	// Holding the DB lock hangs the handlers looking up files
+	s.DBMu.Lock()
+	defer s.DBMu.Unlock()
+
+	tests := []string{"/list/", "/list/?format=json", "/stat/a.txt", "/stats"}
+	for _, path := range tests {
+		resp, body := doRequest(t, http.MethodGet, srv.URL+path, nil, nil)
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("GET %s got %d (%s), want %d", path, resp.StatusCode, body, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestStatBatch(t *testing.T) {
+	_, srv := newTestService(t)
+	uploadFile(t, srv, "a.txt", "hello")
+	uploadFile(t, srv, "b.txt", "hello world")
+
+	req := `{"files":["a.txt","missing.txt","b.txt","a.txt"]}`
+	resp, body := doRequest(t, http.MethodPost, srv.URL+"/stat-batch", strings.NewReader(req), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stat-batch got %d (%s), want %d", resp.StatusCode, body, http.StatusOK)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &raw); err != nil {
+		t.Fatalf("decoding the stat-batch response: %v", err)
+	}
+	if len(raw) != 3 {
+		t.Errorf("stat-batch has %d files, want 3: %s", len(raw), body)
+	}
+	// A missing file is only reported as such
+	if got := string(raw["missing.txt"]); got != `{"exists":false}` {
+		t.Errorf("missing.txt: got %s, want %s", got, `{"exists":false}`)
+	}
+	for name, size := range map[string]int64{"a.txt": 5, "b.txt": 11} {
+		var stat BatchStat
+		if err := json.Unmarshal(raw[name], &stat); err != nil {
+			t.Fatalf("decoding the stat of %s: %v", name, err)
+		}
+		if !stat.Exists || stat.FileStat == nil || stat.Name != name || stat.Size != size || stat.ModTime.IsZero() {
+			t.Errorf("%s: got %s, want it to exist with size %d", name, raw[name], size)
+		}
+	}
+
+	tests := []struct {
+		desc   string
+		method string
+		body   string
+		want   int
+	}{
+		{"GET", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"not JSON", http.MethodPost, "a.txt", http.StatusBadRequest},
+		{"too many files", http.MethodPost, `{"files":["` + strings.Repeat(`a.txt","`, statBatchMaxFiles) + `b.txt"]}`, http.StatusRequestEntityTooLarge},
+		{"no files", http.MethodPost, `{"files":[]}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+"/stat-batch", strings.NewReader(tt.body), nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+	}
+}
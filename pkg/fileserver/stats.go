@@ -0,0 +1,46 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// StorageStats summarises the stored files, it is the
+// JSON body returned by the stats endpoint
+type StorageStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+
+	// Mode is the write mode, e.g. ModeAppendOnly
+	Mode string `json:"mode"`
+
+	// Mirror is the health of the upload mirror, if any
+	Mirror *MirrorStats `json:"mirror,omitempty"`
+
+	// Cache are the download cache counters, if enabled
+	Cache *CacheStats `json:"cache,omitempty"`
+}
+
+// Stats returns the number and total size of the files
+func (s *FileService) Stats() StorageStats {
+	s.DBMu.RLock()
+	defer s.DBMu.RUnlock()
+	return StorageStats{
+		Files:  len(s.DB),
+		Bytes:  s.totalBytes,
+		Mode:   s.mode(),
+		Mirror: s.mirrorStats(),
+		Cache:  s.cacheStats(),
+	}
+}
+
+// stats returns the number and total size of the files
+// as JSON, without reading the storage dir
+func (s *FileService) stats(w http.ResponseWriter, r *http.Request) {
+	log.Debug().Msg("Processing stats")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Stats())
+}
@@ -0,0 +1,80 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// getStats returns the /stats of the test server
+func getStats(t *testing.T, srvURL string) StorageStats {
+	t.Helper()
+	resp, body := doRequest(t, http.MethodGet, srvURL+"/stats", nil, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/stats got %d (%s)", resp.StatusCode, body)
+	}
+	var stats StorageStats
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatalf("decoding /stats: %v", err)
+	}
+	return stats
+}
+
+func TestStatsAfterOverwrite(t *testing.T) {
+	_, srv := newTestService(t)
+
+	// The steps run in order, each followed by the totals
+	tests := []struct {
+		desc      string
+		method    string
+		name      string
+		content   string
+		wantFiles int
+		wantBytes int64
+	}{
+		{"upload", http.MethodPut, "a.txt", strings.Repeat("a", 10), 1, 10},
+		{"another upload", http.MethodPut, "b.txt", strings.Repeat("b", 5), 2, 15},
+		{"smaller overwrite", http.MethodPut, "a.txt", strings.Repeat("a", 3), 2, 8},
+		{"larger overwrite", http.MethodPut, "a.txt", strings.Repeat("a", 20), 2, 25},
+		{"delete", http.MethodDelete, "b.txt", "", 1, 20},
+	}
+	for _, tt := range tests {
+		path := "/upload/"
+		if tt.method == http.MethodDelete {
+			path = "/delete/"
+		}
+		resp, body := doRequest(t, tt.method, srv.URL+path+tt.name, strings.NewReader(tt.content), nil)
+		if resp.StatusCode >= 300 {
+			t.Fatalf("%s: got %d (%s)", tt.desc, resp.StatusCode, body)
+		}
+		if stats := getStats(t, srv.URL); stats.Files != tt.wantFiles || stats.Bytes != tt.wantBytes {
+			t.Errorf("%s: /stats has %d files of %d bytes, want %d files of %d bytes", tt.desc, stats.Files, stats.Bytes, tt.wantFiles, tt.wantBytes)
+		}
+	}
+}
+
+func TestStatsConcurrentOverwrites(t *testing.T) {
+	s, srv := newTestService(t)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			doRequest(t, http.MethodPut, srv.URL+"/upload/a.txt", strings.NewReader(strings.Repeat("a", size)), nil)
+		}(i * 100)
+	}
+	wg.Wait()
+
+	// Whichever overwrite came last, the totals are its size
+	fileObj, found := s.lookup("a.txt")
+	if !found {
+		t.Fatal("a.txt isn't stored")
+	}
+	want := fileObj.size()
+	if stats := getStats(t, srv.URL); stats.Files != 1 || stats.Bytes != want {
+		t.Errorf("/stats has %d files of %d bytes, want 1 file of %d bytes", stats.Files, stats.Bytes, want)
+	}
+}
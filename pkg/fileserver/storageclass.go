@@ -0,0 +1,50 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// storageClassHeader is the header clients hint the
+// storage class (e.g. "cold") of an upload with
+const storageClassHeader = "X-Storage-Class"
+
+// StorageClassMetadataKey is the custom metadata key the
+// storage class of a file is kept under, for backends to
+// route the file to matching media (e.g. an S3 storage
+// class). The local backend stores every class alike
+const StorageClassMetadataKey = "storage-class"
+
+// uploadMetadata returns the custom metadata carried in
+// the request headers, along with the expiry and the
+// storage class hinted with X-Storage-Class (or
+// X-Meta-Storage-Class), which must be one of
+// StorageClasses
+func (s *FileService) uploadMetadata(h http.Header) (map[string]string, error) {
+	metadata, err := parseMetadata(h)
+	if err != nil {
+		return nil, err
+	}
+	if metadata, err = parseExpiry(h, metadata); err != nil {
+		return nil, err
+	}
+	if class := h.Get(storageClassHeader); class != "" {
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[StorageClassMetadataKey] = class
+	}
+
+	class, found := metadata[StorageClassMetadataKey]
+	if !found {
+		return metadata, nil
+	}
+	class = strings.ToLower(strings.TrimSpace(class))
+	if !slices.Contains(s.StorageClasses, class) {
+		return nil, fmt.Errorf("unknown storage class %q, expected one of %s", class, strings.Join(s.StorageClasses, ", "))
+	}
+	metadata[StorageClassMetadataKey] = class
+	return metadata, nil
+}
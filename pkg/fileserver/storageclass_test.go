@@ -0,0 +1,47 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStorageClass(t *testing.T) {
+	_, srv := newTestService(t, func(s *FileService) { s.StorageClasses = []string{"hot", "cold", "archive"} })
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		want      int
+		wantClass string
+	}{
+		{"hot.txt", http.Header{"X-Storage-Class": {"hot"}}, http.StatusCreated, "hot"},
+		{"cold.txt", http.Header{"X-Storage-Class": {" Cold "}}, http.StatusCreated, "cold"},
+		{"meta.txt", http.Header{"X-Meta-Storage-Class": {"archive"}}, http.StatusCreated, "archive"},
+		{"none.txt", nil, http.StatusCreated, ""},
+		{"unknown.txt", http.Header{"X-Storage-Class": {"glacier"}}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/"+tt.name, strings.NewReader("content"), tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: upload got %d (%s), want %d", tt.name, resp.StatusCode, body, tt.want)
+			continue
+		}
+		if tt.want != http.StatusCreated {
+			continue
+		}
+
+		var stat FileStat
+		_, body = doRequest(t, http.MethodGet, srv.URL+"/stat/"+tt.name, nil, nil)
+		if err := json.Unmarshal([]byte(body), &stat); err != nil {
+			t.Fatalf("decoding the stat of %s: %v", tt.name, err)
+		}
+		if stat.StorageClass != tt.wantClass {
+			t.Errorf("%s: stat has storage class %q, want %q", tt.name, stat.StorageClass, tt.wantClass)
+		}
+		if tt.wantClass == "" && strings.Contains(body, "storageClass") {
+			t.Errorf("%s: stat without a storage class has one: %s", tt.name, body)
+		}
+	}
+}
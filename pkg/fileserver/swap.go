@@ -0,0 +1,154 @@
+package fileserver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/rs/zerolog/log"
+)
+
+// lockPair looks up the files a and b and takes both their
+// write locks, in name order so two swaps of overlapping
+// pairs (e.g. a with b and b with a) can't deadlock. A
+// file replaced meanwhile is looked up again
+func (s *FileService) lockPair(a, b string) (*FileObject, *FileObject, error) {
+	for {
+		fileA, foundA := s.lookup(a)
+		fileB, foundB := s.lookup(b)
+		if !foundA || !foundB {
+			return nil, nil, ErrNotFound
+		}
+
+		first, second := fileA, fileB
+		if b < a {
+			first, second = fileB, fileA
+		}
+		first.Mu.Lock()
+		second.Mu.Lock()
+		currentA, _ := s.lookup(a)
+		currentB, _ := s.lookup(b)
+		if currentA == fileA && currentB == fileB {
+			return fileA, fileB, nil
+		}
+		second.Mu.Unlock()
+		first.Mu.Unlock()
+	}
+}
+
+// Swap exchanges the contents of the stored files a and b,
+// along with their attributes, backups and revisions, so
+// readers see either both files before the swap or both
+// after it
+func (s *FileService) Swap(a, b string) error {
+	a, b = s.resolveName(a), s.resolveName(b)
+	if a == b {
+		return withKind(ErrInvalidName, fmt.Errorf("can't swap %q with itself", a))
+	}
+	fileA, fileB, err := s.lockPair(a, b)
+	if err != nil {
+		return err
+	}
+	defer fileA.Mu.Unlock()
+	defer fileB.Mu.Unlock()
+
+	tmpPath, err := randomPath(s.partialDir())
+	if err != nil {
+		return newServerError("Server encountered an exception swapping the files", err)
+	}
+
+	s.DBMu.Lock()
+	if err := swapPaths(fileA.Path, fileB.Path, tmpPath); err != nil {
+		s.DBMu.Unlock()
+		log.Error().Err(err).Msg("Unable to swap files on disk")
+		return newServerError("Server encountered an exception swapping the files", err)
+	}
+
+	fileA.attrMu.Lock()
+	fileB.attrMu.Lock()
+	fileA.Size, fileB.Size = fileB.Size, fileA.Size
+	fileA.Metadata, fileB.Metadata = fileB.Metadata, fileA.Metadata
+	fileA.Checksums, fileB.Checksums = fileB.Checksums, fileA.Checksums
+	fileA.UploadedAt, fileB.UploadedAt = fileB.UploadedAt, fileA.UploadedAt
+	s.saveExpiry(a, fileA.Metadata)
+	s.saveExpiry(b, fileB.Metadata)
+	fileB.attrMu.Unlock()
+	fileA.attrMu.Unlock()
+
+	// The history of each content moves along with it
+	backupsA, backupsB := s.backups[a], s.backups[b]
+	s.setBackups(a, backupsB)
+	s.setBackups(b, backupsA)
+	revisionsA, foundA := s.revisions[a]
+	revisionsB, foundB := s.revisions[b]
+	delete(s.revisions, a)
+	delete(s.revisions, b)
+	if foundB {
+		s.revisions[a] = revisionsB
+	}
+	if foundA {
+		s.revisions[b] = revisionsA
+	}
+
+	s.invalidateList()
+	s.invalidateCache(a)
+	s.invalidateCache(b)
+	s.DBMu.Unlock()
+
+	s.mirrorUpload(a)
+	s.mirrorUpload(b)
+	return nil
+}
+
+// swapPaths exchanges the files at pathA and pathB by way
+// of tmpPath, putting them back if a rename fails
+func swapPaths(pathA, pathB, tmpPath string) error {
+	if err := os.Rename(pathA, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(pathB, pathA); err != nil {
+		os.Rename(tmpPath, pathA)
+		return err
+	}
+	if err := os.Rename(tmpPath, pathB); err != nil {
+		os.Rename(pathA, pathB)
+		os.Rename(tmpPath, pathA)
+		return err
+	}
+	return nil
+}
+
+// swap exchanges the contents of two files, e.g.
+// POST /swap/blue.conf?with=green.conf
+func (s *FileService) swap(w http.ResponseWriter, r *http.Request) {
+	fileName := requestFileName(r, "/swap/")
+	other := r.URL.Query().Get("with")
+	log.Info().
+		Str("fileName", fileName).
+		Str("with", other).
+		Msg("Processing swap")
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Please POST to swap two files"))
+		return
+	}
+	if fileName == "" || other == "" {
+		log.Error().Msg("Swap is missing a file name")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide the file to swap and the one to swap it with in ?with="))
+		return
+	}
+
+	if err := s.Swap(fileName, other); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	log.Info().
+		Str("fileName", fileName).
+		Str("with", other).
+		Msg("Swapped files")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Swapped %s and %s", fileName, other)))
+}
@@ -0,0 +1,62 @@
+package fileserver
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrentSwaps(t *testing.T) {
+	tests := []struct {
+		desc  string
+		pairs [][2]string
+	}{
+		{"same pair both ways", [][2]string{{"a.txt", "b.txt"}, {"b.txt", "a.txt"}}},
+		{"cycle", [][2]string{{"a.txt", "b.txt"}, {"b.txt", "c.txt"}, {"c.txt", "a.txt"}}},
+		{"shared file", [][2]string{{"a.txt", "b.txt"}, {"a.txt", "c.txt"}, {"c.txt", "b.txt"}}},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t)
+		files := []string{"a.txt", "b.txt", "c.txt"}
+		for _, name := range files {
+			uploadFile(t, srv, name, "content of "+name)
+		}
+
+		var wg sync.WaitGroup
+		for _, pair := range tt.pairs {
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func(a, b string) {
+					defer wg.Done()
+					resp, body := doRequest(t, http.MethodPost, srv.URL+"/swap/"+a+"?with="+b, nil, nil)
+					if resp.StatusCode != http.StatusOK {
+						t.Errorf("%s: swapping %s with %s got %d (%s)", tt.desc, a, b, resp.StatusCode, body)
+					}
+				}(pair[0], pair[1])
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: swaps deadlocked", tt.desc)
+		}
+
+		// Whatever the order, the contents are only exchanged
+		var contents []string
+		for _, name := range files {
+			_, body := doRequest(t, http.MethodGet, srv.URL+"/download/"+name, nil, nil)
+			contents = append(contents, body)
+		}
+		slices.Sort(contents)
+		if !slices.Equal(contents, []string{"content of a.txt", "content of b.txt", "content of c.txt"}) {
+			t.Errorf("%s: contents after the swaps are %q", tt.desc, contents)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package fileserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// throttledWriter is a ResponseWriter whose body is written
+// at most at the rate of its limiter (in bytes per second)
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+// newThrottledWriter limits the body written to w to
+// bytesPerSec
+func newThrottledWriter(ctx context.Context, w http.ResponseWriter, bytesPerSec int64) *throttledWriter {
+	// Writes wait for at most a burst worth of bytes at a time
+	burst := int64(copyBufferSize)
+	if bytesPerSec < burst {
+		burst = bytesPerSec
+	}
+	return &throttledWriter{
+		ResponseWriter: w,
+		ctx:            ctx,
+		limiter:        rate.NewLimiter(rate.Limit(bytesPerSec), int(burst)),
+	}
+}
+
+// Write writes p once the limiter allows it, a burst at a
+// time
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > t.limiter.Burst() {
+			chunk = chunk[:t.limiter.Burst()]
+		}
+		if err := t.limiter.WaitN(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// errUploadTooSlow is returned when an upload's average
+// rate drops below MinUploadRate
+var errUploadTooSlow = errors.New("upload is slower than the minimum upload rate")
+
+// minRateReader fails reading a request body once its
+// average rate (since the start of the request) drops
+// below rate bytes per second, after a grace period for
+// the transfer to get going
+type minRateReader struct {
+	r     io.Reader
+	rc    *http.ResponseController
+	rate  int64
+	grace time.Duration
+	start time.Time
+	read  int64
+}
+
+// newMinRateReader limits reading body, of the request w
+// responds to, to at least bytesPerSec on average
+func newMinRateReader(w http.ResponseWriter, body io.Reader, bytesPerSec int64, grace time.Duration) *minRateReader {
+	return &minRateReader{
+		r:     body,
+		rc:    http.NewResponseController(w),
+		rate:  bytesPerSec,
+		grace: grace,
+		start: time.Now(),
+	}
+}
+
+// deadline is when the average rate drops below the
+// minimum if no more bytes are read
+func (m *minRateReader) deadline() time.Time {
+	due := time.Duration(float64(m.read) / float64(m.rate) * float64(time.Second))
+	return m.start.Add(max(m.grace, due))
+}
+
+// Read fails once the deadline passed, a client sending
+// nothing at all is cut off by the connection's read
+// deadline
+func (m *minRateReader) Read(p []byte) (int, error) {
+	deadline := m.deadline()
+	if time.Now().After(deadline) {
+		return 0, errUploadTooSlow
+	}
+	m.rc.SetReadDeadline(deadline)
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errUploadTooSlow
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+package fileserver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadRateLimit(t *testing.T) {
+	content := strings.Repeat("x", 96<<10)
+	tests := []struct {
+		desc    string
+		limit   int64
+		atLeast time.Duration
+		atMost  time.Duration
+	}{
+		// The first burst (32KB) is sent right away, the
+		// other 64KB at 100KB/s
+		{"throttled", 100 << 10, 500 * time.Millisecond, 5 * time.Second},
+		{"unthrottled", 0, 0, 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		_, srv := newTestService(t, func(s *FileService) {
+			s.DownloadRateLimit = tt.limit
+			s.DownloadBufferSize = 0
+		})
+		uploadFile(t, srv, "a.bin", content)
+
+		start := time.Now()
+		resp, body := doRequest(t, http.MethodGet, srv.URL+"/download/a.bin", nil, nil)
+		elapsed := time.Since(start)
+		if resp.StatusCode != http.StatusOK || body != content {
+			t.Errorf("%s: got %d with %d bytes, want %d with %d", tt.desc, resp.StatusCode, len(body), http.StatusOK, len(content))
+		}
+		if elapsed < tt.atLeast || elapsed > tt.atMost {
+			t.Errorf("%s: download took %v, want between %v and %v", tt.desc, elapsed, tt.atLeast, tt.atMost)
+		}
+	}
+}
+
+func TestMinUploadRate(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) {
+		s.MinUploadRate = 10 << 10
+		s.MinUploadRateGrace = 100 * time.Millisecond
+	})
+
+	// A client trickling its body falls under the rate once
+	// the grace period is over
+	content, contentWriter := io.Pipe()
+	go func() {
+		contentWriter.Write([]byte("slow"))
+		time.Sleep(time.Second)
+		contentWriter.Write([]byte("loris"))
+		contentWriter.Close()
+	}()
+	resp, body := doRequest(t, http.MethodPut, srv.URL+"/upload/slow.txt", content, nil)
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("slow upload got %d (%s), want %d", resp.StatusCode, body, http.StatusRequestTimeout)
+	}
+	if _, found := s.lookup("slow.txt"); found {
+		t.Errorf("slow upload was stored")
+	}
+
+	// Uploads above the rate aren't affected
+	uploadFile(t, srv, "fast.txt", strings.Repeat("x", 64<<10))
+}
@@ -0,0 +1,185 @@
+package fileserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	// Registers the GIF decoder, JPEG and PNG are
+	// registered by the encoders
+	_ "image/gif"
+)
+
+// thumbnailMaxSourcePixels is the largest image (in
+// pixels) thumbnails are made of, decoding a larger one
+// could take too much memory
+const thumbnailMaxSourcePixels = 50_000_000
+
+// thumbnailCacheMaxSize is the largest thumbnail (in bytes)
+// cached, larger ones are made again for every request
+const thumbnailCacheMaxSize = 1 << 20
+
+// thumbnailJPEGQuality is the quality JPEG thumbnails are
+// encoded with
+const thumbnailJPEGQuality = 85
+
+// errNotAnImage is returned for a thumbnail of a file that
+// isn't a JPEG, PNG or GIF image
+var errNotAnImage = errors.New("file is not a JPEG, PNG or GIF image")
+
+// parseThumbnailSize returns the width and height of a
+// ?thumbnail= param, e.g. "200x150", each at most limit
+func parseThumbnailSize(param string, limit int64) (int, int, error) {
+	w, h, found := strings.Cut(param, "x")
+	if !found {
+		return 0, 0, fmt.Errorf("invalid thumbnail size %q, expected WxH", param)
+	}
+	width, errW := strconv.ParseInt(w, 10, 32)
+	height, errH := strconv.ParseInt(h, 10, 32)
+	if errW != nil || errH != nil || width < 1 || height < 1 {
+		return 0, 0, fmt.Errorf("invalid thumbnail size %q, expected WxH", param)
+	}
+	if width > limit || height > limit {
+		return 0, 0, fmt.Errorf("thumbnail size %q exceeds %dx%d", param, limit, limit)
+	}
+	return int(width), int(height), nil
+}
+
+// resizeImage scales src down to fit within width x height,
+// keeping its aspect ratio, averaging the pixels each
+// thumbnail pixel covers. Images that already fit aren't
+// scaled up
+func resizeImage(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	scale := min(float64(width)/float64(srcW), float64(height)/float64(srcH), 1)
+	dstW, dstH := max(1, int(float64(srcW)*scale)), max(1, int(float64(srcH)*scale))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+
+			// RGBA returns premultiplied 16 bit channels, which
+			// average correctly across transparent pixels
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// makeThumbnail decodes the image read from content and
+// returns it scaled to fit within width x height, as a
+// JPEG for JPEG images and a PNG otherwise
+func makeThumbnail(content io.Reader, width, height int) ([]byte, error) {
+	var head bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(content, &head))
+	if err != nil {
+		return nil, fmt.Errorf("%w (%v)", errNotAnImage, err)
+	}
+	if int64(config.Width)*int64(config.Height) > thumbnailMaxSourcePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large", config.Width, config.Height)
+	}
+
+	// The header read to get the size is decoded again
+	src, _, err := image.Decode(io.MultiReader(&head, content))
+	if err != nil {
+		return nil, err
+	}
+	thumb := resizeImage(src, width, height)
+
+	var encoded bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&encoded, thumb, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		err = png.Encode(&encoded, thumb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encoded.Bytes(), nil
+}
+
+// downloadThumbnail sends a thumbnail of an image, scaled
+// to fit within the ?thumbnail= size (e.g. 200x150)
+func (s *FileService) downloadThumbnail(w http.ResponseWriter, r *http.Request, fileName string) {
+	if !s.Thumbnails {
+		log.Info().Msg("Rejecting thumbnail, thumbnails are disabled")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Thumbnails are disabled on this server"))
+		return
+	}
+	param := r.URL.Query().Get("thumbnail")
+	width, height, err := parseThumbnailSize(param, s.ThumbnailMaxSize)
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid thumbnail size")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Please provide a valid thumbnail size (%v)", err)))
+		return
+	}
+
+	file, err := s.Open(fileName)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	// Thumbnails are cached along with the file object and
+	// upload time, so a replaced file's are stale
+	fileObj, _ := s.lookup(file.Name)
+	cacheKey := file.Name + "\x00" + param
+	var thumb []byte
+	found := false
+	if s.thumbnails != nil {
+		thumb, found = s.thumbnails.get(cacheKey, fileObj, file.UploadedAt)
+	}
+	if !found {
+		thumb, err = makeThumbnail(file, width, height)
+		if errors.Is(err, errNotAnImage) {
+			log.Info().Err(err).Str("fileName", file.Name).Msg("Rejecting thumbnail of a file that isn't an image")
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			w.Write([]byte("Thumbnails can only be made of JPEG, PNG and GIF images"))
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Str("fileName", file.Name).Msg("Unable to make thumbnail")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(fmt.Sprintf("Unable to make a thumbnail of the image (%v)", err)))
+			return
+		}
+		if s.thumbnails != nil && len(thumb) <= thumbnailCacheMaxSize {
+			s.thumbnails.put(cacheKey, fileObj, file.UploadedAt, thumb)
+		}
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(thumb))
+	w.Header().Set("ETag", strings.TrimSuffix(file.etag(), `"`)+"-"+param+`"`)
+	http.ServeContent(w, r, file.Name, file.UploadedAt, bytes.NewReader(thumb))
+}
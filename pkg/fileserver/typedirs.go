@@ -0,0 +1,101 @@
+package fileserver
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// typeDirs classifies files into sub dirs of the storage
+// dir by type, its rules map an extension (".jpg"), a
+// content type ("application/pdf") or a content type
+// wildcard ("image/*") to a sub dir
+type typeDirs struct {
+	rules map[string]string
+
+	// dirs are the sub dirs of the rules, longest first
+	dirs []string
+}
+
+// newTypeDirs validates the rules, normalizing the
+// extensions to lowercase with a leading "."
+func newTypeDirs(rules map[string]string) (*typeDirs, error) {
+	t := &typeDirs{rules: make(map[string]string, len(rules))}
+	seen := map[string]bool{}
+	for rule, dir := range rules {
+		dir = path.Clean(filepath.ToSlash(dir))
+		if !filepath.IsLocal(dir) || dir == internalDir || strings.HasPrefix(dir, internalDir+"/") {
+			return nil, fmt.Errorf("invalid sub dir %q for %q", dir, rule)
+		}
+		rule = strings.ToLower(rule)
+		if !strings.Contains(rule, "/") {
+			rule = "." + strings.TrimPrefix(rule, ".")
+		}
+		t.rules[rule] = dir
+		if !seen[dir] {
+			seen[dir] = true
+			t.dirs = append(t.dirs, dir)
+		}
+	}
+	sort.Slice(t.dirs, func(i, j int) bool {
+		return len(t.dirs[i]) > len(t.dirs[j])
+	})
+	return t, nil
+}
+
+// dir returns the sub dir of the file name, "" if no
+// rule matches it
+func (t *typeDirs) dir(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if dir, found := t.rules[ext]; found {
+		return dir
+	}
+
+	mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return ""
+	}
+	if dir, found := t.rules[mediaType]; found {
+		return dir
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	return t.rules[major+"/*"]
+}
+
+// TypeDirKeys wraps a storage layout so files are stored
+// in the sub dir their type maps to by rules (e.g.
+// {"jpg": "images", "application/pdf": "docs"}), files no
+// rule matches are stored as the layout has them
+func TypeDirKeys(rules map[string]string, keyFunc KeyFunc, nameFunc NameFunc) (KeyFunc, NameFunc, error) {
+	t, err := newTypeDirs(rules)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	typeKey := func(name string) string {
+		if dir := t.dir(name); dir != "" {
+			return dir + "/" + keyFunc(name)
+		}
+		return keyFunc(name)
+	}
+	typeName := func(key string) string {
+		for _, dir := range t.dirs {
+			if rest, found := strings.CutPrefix(key, dir+"/"); found {
+				if name := nameFunc(rest); name != "" && t.dir(name) == dir {
+					return name
+				}
+			}
+		}
+		if name := nameFunc(key); name != "" && t.dir(name) == "" {
+			return name
+		}
+		return ""
+	}
+	return typeKey, typeName, nil
+}
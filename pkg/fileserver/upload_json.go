@@ -0,0 +1,130 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+)
+
+// jsonUploadMaxBodySize is the most bytes of a JSON upload
+// body, which is decoded in memory
+const jsonUploadMaxBodySize = 64 << 20
+
+// jsonUploadOverhead is the allowance (in bytes) for the
+// JSON envelope around the base64 content when limiting
+// the size of a JSON upload body
+const jsonUploadOverhead = 4096
+
+// jsonUpload is the body of a JSON upload request
+type jsonUpload struct {
+	Name          string `json:"name"`
+	ContentBase64 string `json:"contentBase64"`
+}
+
+// isJSONRequest reports whether the request body is JSON
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// uploadJSON processes an upload whose body is a JSON
+// document carrying the file name and base64 content
+// e.g. {"name":"x.txt","contentBase64":"aGVsbG8="}
+// The custom metadata comes from the headers, as for
+// other uploads
+func (s *FileService) uploadJSON(w http.ResponseWriter, r *http.Request, metadata map[string]string) {
+	log.Info().
+		Int("contentLength", int(r.ContentLength)).
+		Msg("Processing JSON upload")
+
+	// The body is decoded in memory, so it is always capped.
+	// The name isn't known until it is decoded, so it is
+	// only bounded further by the largest limit
+	maxBodySize := int64(jsonUploadMaxBodySize)
+	if largestUploadSize := s.largestUploadSize(); largestUploadSize > 0 {
+		maxBodySize = min(maxBodySize, int64(base64.StdEncoding.EncodedLen(int(largestUploadSize)))+jsonUploadOverhead)
+	}
+	if r.ContentLength > maxBodySize {
+		log.Error().Msg("JSON upload exceeds the maximum body size")
+		writeJSONTooLarge(w, maxBodySize)
+		return
+	}
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if s.MinUploadRate > 0 {
+		body = newMinRateReader(w, body, s.MinUploadRate, s.MinUploadRateGrace)
+	}
+
+	// The whole body is held until the file is stored, so
+	// it is what counts in the uploads in flight
+	body, release, err := s.reserveInFlight(body, r.ContentLength)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer release()
+
+	var req jsonUpload
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			log.Error().Msg("JSON upload exceeded the maximum body size")
+			writeJSONTooLarge(w, maxBodySize)
+		case errors.Is(err, errUploadTooSlow), errors.Is(err, errTooManyInFlight):
+			s.writeError(w, err)
+		default:
+			log.Error().Err(err).Msg("Unable to decode JSON upload body")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Request body is not a valid JSON upload"))
+		}
+		return
+	}
+
+	req.Name = s.uploadName(r, req.Name)
+	if req.Name == "" {
+		log.Error().Msg("JSON upload is missing the file name")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Please provide a file name."))
+		return
+	}
+
+	content, err := base64.StdEncoding.DecodeString(req.ContentBase64)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to decode base64 content")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("contentBase64 is not valid base64"))
+		return
+	}
+
+	// The limit applies to the file itself, not its encoding
+	if maxUploadSize := s.maxUploadSize(req.Name); maxUploadSize > 0 && int64(len(content)) > maxUploadSize {
+		log.Error().
+			Int("decodedLength", len(content)).
+			Msg("Decoded JSON upload exceeds the maximum upload size")
+		s.writeTooLarge(w, req.Name)
+		return
+	}
+
+	s.storeFile(r.Context(), w, &fileUpload{
+		name:             req.Name,
+		body:             bytes.NewReader(content),
+		contentLength:    int64(len(content)),
+		metadata:         metadata,
+		clientIP:         s.clientIP(r),
+		inFlightReserved: true,
+	})
+}
+
+// writeJSONTooLarge rejects a JSON upload whose body is
+// over maxBodySize
+func writeJSONTooLarge(w http.ResponseWriter, maxBodySize int64) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	w.Write([]byte(fmt.Sprintf("JSON upload exceeds the maximum body size of %d bytes", maxBodySize)))
+}
@@ -0,0 +1,75 @@
+package fileserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// repeatReader reads the byte b forever
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+func TestUploadJSON(t *testing.T) {
+	s, srv := newTestService(t, func(s *FileService) { s.RequireContentLength = true })
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	id := startTestSession(t, srv, "session.txt")
+	doRequest(t, http.MethodPut, srv.URL+"/upload/"+id+"/part/0", strings.NewReader("part"), nil)
+
+	tests := []struct {
+		desc   string
+		path   string
+		body   io.Reader
+		header http.Header
+		want   int
+	}{
+		{"upload", "/upload/", strings.NewReader(`{"name":"a.txt","contentBase64":"aGVsbG8="}`), http.Header{"Content-Type": {"application/json"}, "X-Meta-Owner": {"alice"}}, http.StatusCreated},
+		{"chunked upload", "/upload/", chunked(strings.NewReader(`{"name":"b.txt","contentBase64":"aGVsbG8="}`)), jsonHeader, http.StatusLengthRequired},
+		{"invalid base64", "/upload/", strings.NewReader(`{"name":"c.txt","contentBase64":"!!"}`), jsonHeader, http.StatusBadRequest},
+		{"session commit with a JSON content type", "/upload/" + id + "/commit", nil, jsonHeader, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, http.MethodPost, srv.URL+tt.path, tt.body, tt.header)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+	}
+
+	fileObj, found := s.lookup("a.txt")
+	if !found || fileObj.Metadata["owner"] != "alice" {
+		t.Errorf("JSON upload isn't stored with its metadata headers")
+	}
+	if _, body := doRequest(t, http.MethodGet, srv.URL+"/download/session.txt", nil, nil); body != "part" {
+		t.Errorf("session file is %q, want %q", body, "part")
+	}
+}
+
+func TestUploadJSONMaxBodySize(t *testing.T) {
+	_, srv := newTestService(t)
+
+	// Even without an upload size limit the body is capped
+	content := io.MultiReader(
+		strings.NewReader(`{"name":"huge.txt","contentBase64":"`),
+		io.LimitReader(repeatReader('A'), jsonUploadMaxBodySize),
+		strings.NewReader(`"}`),
+	)
+	resp, body := doRequest(t, http.MethodPost, srv.URL+"/upload/", content, http.Header{"Content-Type": {"application/json"}})
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized JSON upload got %d (%s), want %d", resp.StatusCode, body, http.StatusRequestEntityTooLarge)
+	}
+
+	req, _ := json.Marshal(jsonUpload{Name: "small.txt", ContentBase64: base64.StdEncoding.EncodeToString([]byte("small"))})
+	resp, body = doRequest(t, http.MethodPost, srv.URL+"/upload/", strings.NewReader(string(req)), http.Header{"Content-Type": {"application/json"}})
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("JSON upload under the cap got %d (%s), want %d", resp.StatusCode, body, http.StatusCreated)
+	}
+}
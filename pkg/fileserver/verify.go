@@ -0,0 +1,192 @@
+package fileserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// VerifyMismatch is a file whose content no longer
+// matches the checksum computed on upload
+type VerifyMismatch struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Expected  string `json:"expected"`
+	Actual    string `json:"actual"`
+}
+
+// VerifyReport is the JSON body returned by the verify
+// endpoint
+type VerifyReport struct {
+	// Checked counts the files whose checksums matched
+	Checked int `json:"checked"`
+
+	// Unverified counts the files without checksums (e.g.
+	// found on disk rather than uploaded)
+	Unverified int `json:"unverified"`
+
+	Mismatches []VerifyMismatch `json:"mismatches"`
+
+	// Missing are the files in the DB that can't be read
+	Missing []string `json:"missing"`
+
+	// Orphans are the files on disk that aren't in the DB
+	Orphans []string `json:"orphans"`
+
+	// TimedOut is set when VerifyTimeout passed before
+	// every file was checked
+	TimedOut bool `json:"timedOut"`
+}
+
+// Verify recomputes the checksums of every file and
+// compares them to the ones computed on upload, reading
+// at most VerifyConcurrency files at a time so it doesn't
+// saturate the disk
+func (s *FileService) Verify(ctx context.Context) (VerifyReport, error) {
+	report := VerifyReport{
+		Mismatches: []VerifyMismatch{},
+		Missing:    []string{},
+		Orphans:    []string{},
+	}
+
+	files, err := s.scanStorage()
+	if err != nil {
+		return report, err
+	}
+
+	s.DBMu.RLock()
+	db := make(map[string]*FileObject, len(s.DB))
+	for name, fileObj := range s.DB {
+		db[name] = fileObj
+	}
+	s.DBMu.RUnlock()
+
+	for name := range files {
+		if _, found := db[name]; !found {
+			report.Orphans = append(report.Orphans, name)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, s.VerifyConcurrency)
+	for name, fileObj := range db {
+		select {
+		case <-ctx.Done():
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func(name string, fileObj *FileObject) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				mismatches, verified, err := s.verifyFile(ctx, fileObj)
+
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case isAborted(err):
+				case err != nil:
+					log.Error().Err(err).Str("fileName", name).Msg("Unable to verify file")
+					report.Missing = append(report.Missing, name)
+				case !verified:
+					report.Unverified++
+				case len(mismatches) > 0:
+					for i := range mismatches {
+						mismatches[i].Name = name
+					}
+					report.Mismatches = append(report.Mismatches, mismatches...)
+				default:
+					report.Checked++
+				}
+			}(name, fileObj)
+		}
+	}
+	wg.Wait()
+
+	report.TimedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
+	sort.Strings(report.Missing)
+	sort.Strings(report.Orphans)
+	sort.Slice(report.Mismatches, func(i, j int) bool {
+		return report.Mismatches[i].Name < report.Mismatches[j].Name
+	})
+	return report, nil
+}
+
+// verifyFile recomputes the checksums of the file,
+// returning the ones that don't match and false if it has
+// no checksums to compare with
+func (s *FileService) verifyFile(ctx context.Context, fileObj *FileObject) ([]VerifyMismatch, bool, error) {
+	// An upload overwriting the file meanwhile would
+	// change its content and checksums
+	fileObj.Mu.RLock()
+	defer fileObj.Mu.RUnlock()
+
+	expected := fileObj.copyChecksums()
+	if len(expected) == 0 {
+		return nil, false, nil
+	}
+	algorithms := make([]string, 0, len(expected))
+	for algorithm := range expected {
+		algorithms = append(algorithms, algorithm)
+	}
+
+	content, _, err := s.openFile(fileObj.Path)
+	if err != nil {
+		return nil, true, err
+	}
+	defer content.Close()
+
+	sums := newChecksummer(algorithms)
+	if _, err := copyWithContext(ctx, sums, content); err != nil {
+		return nil, true, err
+	}
+
+	var mismatches []VerifyMismatch
+	for algorithm, actual := range sums.sums() {
+		if actual != expected[algorithm] {
+			mismatches = append(mismatches, VerifyMismatch{
+				Algorithm: algorithm,
+				Expected:  expected[algorithm],
+				Actual:    actual,
+			})
+		}
+	}
+	return mismatches, true, nil
+}
+
+// verify checks the integrity of the stored files and
+// returns a JSON report of the mismatches and orphans
+func (s *FileService) verify(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msg("Processing verify")
+
+	ctx := r.Context()
+	if s.VerifyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.VerifyTimeout)
+		defer cancel()
+	}
+
+	report, err := s.Verify(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to list contents of local file storage dir")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception listing the local file storage dir"))
+		return
+	}
+
+	log.Info().
+		Int("checked", report.Checked).
+		Int("mismatches", len(report.Mismatches)).
+		Int("missing", len(report.Missing)).
+		Int("orphans", len(report.Orphans)).
+		Bool("timedOut", report.TimedOut).
+		Msg("Verified local file storage dir")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
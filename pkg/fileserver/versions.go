@@ -0,0 +1,355 @@
+package fileserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errNoRevision is returned for a revision of a file that
+// doesn't exist or was pruned
+var errNoRevision = fmt.Errorf("%w: no such revision", ErrNotFound)
+
+// Revision is a numbered version of a stored file, the
+// current content is the highest numbered one
+type Revision struct {
+	Revision   int       `json:"revision"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	Current    bool      `json:"current"`
+}
+
+// revision is a previous content of a file
+type revision struct {
+	number int
+	path   string
+	attrs  fileAttrs
+}
+
+// revisionHistory are the previous contents of a file,
+// oldest first, current is the number of its current
+// content
+type revisionHistory struct {
+	current   int
+	revisions []revision
+}
+
+// revisionsDir is where the previous revisions of files
+// are kept
+func (s *FileService) revisionsDir() string {
+	return filepath.Join(s.StoragePath, internalDir, "revisions")
+}
+
+// keepRevision keeps the current content of the file name
+// as a revision before it is overwritten, the caller must
+// hold the DB write lock and the file's write lock
+func (s *FileService) keepRevision(name string, previous *FileObject) error {
+	revisionPath, attrs, err := linkPrevious(previous, s.revisionsDir())
+	if err != nil {
+		return err
+	}
+
+	// A file that was never overwritten is at revision 1
+	history, found := s.revisions[name]
+	if !found {
+		history = &revisionHistory{current: 1}
+		s.revisions[name] = history
+	}
+	history.revisions = append(history.revisions, revision{
+		number: history.current,
+		path:   revisionPath,
+		attrs:  attrs,
+	})
+	history.current++
+	return nil
+}
+
+// discardLatestRevision removes the revision kept last of
+// the file name, the caller must hold the DB write lock
+func (s *FileService) discardLatestRevision(name string) {
+	history, found := s.revisions[name]
+	if !found || len(history.revisions) == 0 {
+		return
+	}
+	latest := history.revisions[len(history.revisions)-1]
+	os.Remove(latest.path)
+	history.revisions = history.revisions[:len(history.revisions)-1]
+	history.current = latest.number
+}
+
+// pruneRevisions removes the oldest revisions of the file
+// name past MaxRevisions, the caller must hold the DB
+// write lock
+func (s *FileService) pruneRevisions(name string) {
+	history, found := s.revisions[name]
+	if !found || int64(len(history.revisions)) <= s.MaxRevisions {
+		return
+	}
+	pruned := len(history.revisions) - int(s.MaxRevisions)
+	for _, rev := range history.revisions[:pruned] {
+		os.Remove(rev.path)
+	}
+	history.revisions = append([]revision(nil), history.revisions[pruned:]...)
+	log.Debug().
+		Str("fileName", name).
+		Int("revisions", pruned).
+		Msg("Pruned old revisions")
+}
+
+// dropRevisions removes every revision of the file name,
+// the caller must hold the DB write lock
+func (s *FileService) dropRevisions(name string) {
+	history, found := s.revisions[name]
+	if !found {
+		return
+	}
+	for _, rev := range history.revisions {
+		os.Remove(rev.path)
+	}
+	delete(s.revisions, name)
+}
+
+// findRevision returns the revision of the file name with
+// the number, the caller must hold the DB lock
+func (s *FileService) findRevision(name string, number int) (revision, bool) {
+	if history, found := s.revisions[name]; found {
+		for _, rev := range history.revisions {
+			if rev.number == number {
+				return rev, true
+			}
+		}
+	}
+	return revision{}, false
+}
+
+// Revisions returns the revisions of the stored file name,
+// oldest first and ending with the current one
+func (s *FileService) Revisions(name string) ([]Revision, error) {
+	name = s.resolveName(name)
+	fileObj, found := s.lookup(name)
+	if !found {
+		return nil, ErrNotFound
+	}
+
+	var revisions []Revision
+	current := 1
+	s.DBMu.RLock()
+	if history, found := s.revisions[name]; found {
+		for _, rev := range history.revisions {
+			revisions = append(revisions, Revision{
+				Revision:   rev.number,
+				Size:       rev.attrs.size,
+				UploadedAt: rev.attrs.uploadedAt,
+			})
+		}
+		current = history.current
+	}
+	s.DBMu.RUnlock()
+
+	fileObj.attrMu.RLock()
+	defer fileObj.attrMu.RUnlock()
+	return append(revisions, Revision{
+		Revision:   current,
+		Size:       fileObj.Size,
+		UploadedAt: fileObj.UploadedAt,
+		Current:    true,
+	}), nil
+}
+
+// OpenRevision opens a previous revision of the stored
+// file name for reading, the caller must close it
+func (s *FileService) OpenRevision(name string, number int) (*File, error) {
+	name = s.resolveName(name)
+
+	// Opened under the lock so the revision isn't pruned
+	// in between
+	s.DBMu.RLock()
+	defer s.DBMu.RUnlock()
+	rev, found := s.findRevision(name, number)
+	if !found {
+		return nil, errNoRevision
+	}
+	content, size, err := s.openFile(rev.path)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to open file revision on the server for reading.")
+		return nil, newServerError(fmt.Sprintf("Server encountered an exception opening the file locally (%v)", err), err)
+	}
+	return &File{
+		ReadSeekCloser: content,
+		StoredFile: StoredFile{
+			Name:       name,
+			Size:       size,
+			Metadata:   copyStringMap(rev.attrs.metadata),
+			Checksums:  copyStringMap(rev.attrs.checksums),
+			UploadedAt: rev.attrs.uploadedAt,
+		},
+	}, nil
+}
+
+// Promote makes a previous revision of the file name its
+// current content again, as a new revision so the
+// content it replaces is kept as well
+func (s *FileService) Promote(name string, number int) (StoredFile, error) {
+	name = s.resolveName(name)
+	fileObj, err := s.lockForReplace(name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer fileObj.Mu.Unlock()
+
+	// The revision is linked rather than moved into place,
+	// so it stays in the history
+	s.DBMu.RLock()
+	rev, found := s.findRevision(name, number)
+	var promotedPath string
+	if found {
+		if promotedPath, err = randomPath(s.revisionsDir()); err == nil {
+			err = os.Link(rev.path, promotedPath)
+		}
+	}
+	s.DBMu.RUnlock()
+	if !found {
+		return StoredFile{}, errNoRevision
+	}
+	if err != nil {
+		return StoredFile{}, newServerError("Server encountered an exception promoting the revision", err)
+	}
+
+	attrs := rev.attrs
+	attrs.uploadedAt = time.Now()
+	if err := s.putFile(name, fileObj, promotedPath, attrs); err != nil {
+		os.Remove(promotedPath)
+		return StoredFile{}, newServerError("Server encountered an exception promoting the revision", err)
+	}
+	s.uploadCommitted(name, attrs.size)
+
+	return StoredFile{
+		Name:       name,
+		Size:       attrs.size,
+		Metadata:   copyStringMap(attrs.metadata),
+		Checksums:  copyStringMap(attrs.checksums),
+		UploadedAt: attrs.uploadedAt,
+	}, nil
+}
+
+// parseRevision returns the revision number of the param
+func parseRevision(param string) (int, error) {
+	number, err := strconv.Atoi(param)
+	if err != nil || number < 1 {
+		return 0, fmt.Errorf("invalid revision %q", param)
+	}
+	return number, nil
+}
+
+// revisionsHandlers are the handlers of the revisions
+// endpoint per method, wrapped once as they are routed
+type revisionsHandlers struct {
+	list    http.Handler
+	promote http.Handler
+}
+
+// revisionsEndpoint lists the revisions of a file (GET), or
+// promotes one of them with ?promote=<revision> (POST)
+func (s *FileService) revisionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.revisionsHandlers.list.ServeHTTP(w, r)
+	case http.MethodPost:
+		s.revisionsHandlers.promote.ServeHTTP(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Please GET the revisions of a file or POST to promote one"))
+	}
+}
+
+// listRevisions returns the JSON list of the revisions of
+// a file
+func (s *FileService) listRevisions(w http.ResponseWriter, r *http.Request) {
+	fileName := requestFileName(r, "/revisions/")
+	log.Debug().
+		Str("fileName", fileName).
+		Msg("Processing revisions")
+
+	revisions, err := s.Revisions(fileName)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// promoteRevision makes a previous revision of a file its
+// current content
+func (s *FileService) promoteRevision(w http.ResponseWriter, r *http.Request) {
+	fileName := requestFileName(r, "/revisions/")
+	log.Info().
+		Str("fileName", fileName).
+		Str("revision", r.URL.Query().Get("promote")).
+		Msg("Processing promote")
+
+	number, err := parseRevision(r.URL.Query().Get("promote"))
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid revision to promote")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Please provide the revision to promote with ?promote= (%v)", err)))
+		return
+	}
+
+	stored, err := s.Promote(fileName, number)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	log.Info().
+		Str("fileName", stored.Name).
+		Int("revision", number).
+		Msg("Promoted revision")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Promoted revision %d", number)))
+}
+
+// downloadRevision sends a previous revision of a file
+func (s *FileService) downloadRevision(w http.ResponseWriter, r *http.Request, fileName string) {
+	number, err := parseRevision(r.URL.Query().Get("revision"))
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid revision to download")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("Please provide a valid revision (%v)", err)))
+		return
+	}
+
+	file, err := s.OpenRevision(fileName, number)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer file.Close()
+
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(file, head)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Error().Err(err).Msg("Unable to seek in file")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Server encountered an exception in processing the download"))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
+	w.Header().Set("Content-Type", s.contentType(fileName, head[:n]))
+	if s.untrustedContent(fileName) {
+		setUntrustedContentHeaders(w.Header())
+	}
+	setMetadataHeaders(w.Header(), file.Metadata)
+	setChecksumHeaders(w.Header(), file.Checksums)
+	w.Header().Set("ETag", file.etag())
+	http.ServeContent(w, r, fileName, file.UploadedAt, file)
+}
@@ -0,0 +1,100 @@
+package fileserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRevisions(t *testing.T) {
+	_, srv := newTestService(t, func(s *FileService) { s.MaxRevisions = 3 })
+	uploadFile(t, srv, "a.txt", "first")
+	uploadFile(t, srv, "a.txt", "second")
+
+	// The steps run in order
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		want   int
+		body   string
+	}{
+		{"list", http.MethodGet, "/revisions/a.txt", http.StatusOK, ""},
+		{"download a revision", http.MethodGet, "/download/a.txt?revision=1", http.StatusOK, "first"},
+		{"promote", http.MethodPost, "/revisions/a.txt?promote=1", http.StatusOK, "Promoted revision 1"},
+		{"download the promoted content", http.MethodGet, "/download/a.txt", http.StatusOK, "first"},
+		{"download the replaced revision", http.MethodGet, "/download/a.txt?revision=2", http.StatusOK, "second"},
+		{"promote a missing revision", http.MethodPost, "/revisions/a.txt?promote=9", http.StatusNotFound, ""},
+		{"promote an invalid revision", http.MethodPost, "/revisions/a.txt?promote=first", http.StatusBadRequest, ""},
+		{"list a missing file", http.MethodGet, "/revisions/missing.txt", http.StatusNotFound, ""},
+		{"unsupported method", http.MethodPut, "/revisions/a.txt", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		resp, body := doRequest(t, tt.method, srv.URL+tt.path, nil, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: got %d (%s), want %d", tt.desc, resp.StatusCode, body, tt.want)
+		}
+		if tt.body != "" && body != tt.body {
+			t.Errorf("%s: got %q, want %q", tt.desc, body, tt.body)
+		}
+	}
+
+	_, body := doRequest(t, http.MethodGet, srv.URL+"/revisions/a.txt", nil, nil)
+	var revisions []Revision
+	if err := json.Unmarshal([]byte(body), &revisions); err != nil {
+		t.Fatalf("decoding the revisions: %v", err)
+	}
+	if len(revisions) != 3 || revisions[2].Revision != 3 || !revisions[2].Current || revisions[2].Size != int64(len("first")) {
+		t.Errorf("revisions after the promotion are %+v, want 3 with the promoted one current", revisions)
+	}
+}
+
+func TestRevisionsWrappers(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	_, srv := newTestService(t, func(s *FileService) {
+		s.MaxRevisions = 3
+		s.AuditLog = auditPath
+		s.ListRateLimit = 1
+		s.ListRateBurst = 1
+	})
+	uploadFile(t, srv, "a.txt", "first")
+	uploadFile(t, srv, "a.txt", "second")
+
+	// Listing revisions is an enumerating request
+	if resp, body := doRequest(t, http.MethodGet, srv.URL+"/revisions/a.txt", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("first revision list got %d (%s), want %d", resp.StatusCode, body, http.StatusOK)
+	}
+	resp, body := doRequest(t, http.MethodGet, srv.URL+"/revisions/a.txt", nil, nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("second revision list got %d (%s) with Retry-After %q, want %d with one", resp.StatusCode, body, resp.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+
+	// Promoting isn't rate limited, but audited
+	if resp, body := doRequest(t, http.MethodPost, srv.URL+"/revisions/a.txt?promote=1", nil, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("promote got %d (%s), want %d", resp.StatusCode, body, http.StatusOK)
+	}
+	srv.Close()
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var promotions []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("decoding audit event: %v", err)
+		}
+		if event.Action == "promote" {
+			promotions = append(promotions, event)
+		}
+	}
+	if len(promotions) != 1 || promotions[0].FileName != "a.txt" || promotions[0].Status != http.StatusOK || promotions[0].Result != "success" {
+		t.Errorf("promotion audit events are %+v, want one successful for a.txt", promotions)
+	}
+}
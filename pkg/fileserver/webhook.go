@@ -0,0 +1,80 @@
+package fileserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// webhookClient sends the upload webhook requests
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// UploadEvent is the JSON body POSTed to the
+// upload webhook after a successful upload
+type UploadEvent struct {
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	Checksum   string    `json:"checksum,omitempty"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// notifyUpload fires the upload webhook (if configured)
+// without blocking the upload response
+func (s *FileService) notifyUpload(event UploadEvent) {
+	if s.UploadWebhookURL == "" {
+		return
+	}
+	go s.sendUploadWebhook(event)
+}
+
+// sendUploadWebhook POSTs the event to the upload webhook,
+// retrying with a linear backoff. Events that can't be
+// delivered are logged in full as a dead letter
+func (s *FileService) sendUploadWebhook(event UploadEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to encode upload webhook event")
+		return
+	}
+
+	for attempt := int64(1); attempt <= s.UploadWebhookAttempts; attempt++ {
+		err = postWebhook(s.UploadWebhookURL, body)
+		if err == nil {
+			log.Debug().
+				Str("fileName", event.Name).
+				Msg("Delivered upload webhook")
+			return
+		}
+		log.Warn().Err(err).
+			Int64("attempt", attempt).
+			Str("fileName", event.Name).
+			Msg("Upload webhook failed")
+
+		if attempt < s.UploadWebhookAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	log.Error().Err(err).
+		RawJSON("event", body).
+		Msg("Dead letter: giving up on upload webhook")
+}
+
+// postWebhook POSTs the JSON body to url, a non 2xx
+// response is treated as a failure
+func postWebhook(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}